@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"wormholes/internal/apikey"
+	"wormholes/internal/clientip"
+	"wormholes/internal/links"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Header API keys can be sent in instead of a bearer token.
+const APIKeyHeader = "X-API-Key"
+
+// Require one of keys, sent as a bearer token or in APIKeyHeader. The ID of
+// the key is kept in the apikey.Local of the request and logged, the key
+// itself never is.
+func requireKey(keys *apikey.Keys) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		id, ok := keys.Lookup(sentKey(ctx))
+		if !ok {
+			requestLog(ctx).Warn().Str("ip", clientip.Of(ctx).String()).Msgf("auth: %s %s with a missing or unknown key", ctx.Method(), ctx.Path())
+
+			return errNoKey
+		}
+		ctx.Locals(apikey.Local, id)
+		requestLog(ctx).Info().Str("key", id).Msgf("auth: %s %s", ctx.Method(), ctx.Path())
+
+		return ctx.Next()
+	}
+}
+
+// Keep the ID of the key sent with a request in apikey.Local if it is one of
+// keys, for routes open to requests without a key.
+func optionalKey(keys *apikey.Keys) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		if id, ok := keys.Lookup(sentKey(ctx)); ok {
+			ctx.Locals(apikey.Local, id)
+		}
+
+		return ctx.Next()
+	}
+}
+
+// API key sent as a bearer token or in APIKeyHeader, empty if there is none.
+func sentKey(ctx *fiber.Ctx) string {
+	secret := ctx.Get(APIKeyHeader)
+	if auth := ctx.Get(fiber.HeaderAuthorization); secret == "" && strings.HasPrefix(auth, "Bearer ") {
+		secret = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	return secret
+}
+
+// ID of the API key of the request, empty without keys.
+func keyID(ctx *fiber.Ctx) string {
+	id, _ := ctx.Locals(apikey.Local).(string)
+
+	return id
+}
+
+// Owner of the links the request may manage, empty for admin keys and
+// without keys.
+func (h *Handler) owner(ctx *fiber.Ctx) string {
+	id := keyID(ctx)
+	if h.keys.Admin(id) {
+		return ""
+	}
+
+	return id
+}
+
+// Whether the key of the request manages link, being an admin key or the key
+// that created it. Without keys, no request does.
+func (h *Handler) owns(ctx *fiber.Ctx, link links.Link) bool {
+	id := keyID(ctx)
+
+	return id != "" && (h.keys.Admin(id) || id == link.Owner)
+}
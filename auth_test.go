@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"wormholes/internal/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Server with the API keys pairs, ID:key.
+func keyServer(t *testing.T, pairs ...string) *testServer {
+	return newTestServer(t, func(conf *config.Config) {
+		conf.APIKeys = pairs
+	})
+}
+
+// Decode the error of resp, failing unless it is errNoKey.
+func wantNoKey(t *testing.T, resp *http.Response, what string) {
+	t.Helper()
+	var body struct {
+		Error APIError `json:"error"`
+	}
+	decode(t, resp, fiber.StatusUnauthorized, &body)
+	if body.Error.Code != errNoKey.Code {
+		t.Errorf("%s: got code %s, want %s", what, body.Error.Code, errNoKey.Code)
+	}
+}
+
+func TestRequireKey(t *testing.T) {
+	s := keyServer(t, "first:"+ownerKey, "second:"+otherKey)
+
+	// sent in either header
+	id := s.create(t, LinkCreateRequest{Target: "https://example.com/first"}, APIKeyHeader, ownerKey)
+	s.create(t, LinkCreateRequest{Target: "https://example.com/second"}, fiber.HeaderAuthorization, "Bearer "+otherKey)
+
+	req := LinkCreateRequest{Target: "https://example.com/denied"}
+	wantNoKey(t, s.do(t, fiber.MethodPut, "/api/", req), "missing key")
+	wantNoKey(t, s.do(t, fiber.MethodPut, "/api/", req, APIKeyHeader, ""), "empty key")
+	wantNoKey(t, s.do(t, fiber.MethodPut, "/api/", req, APIKeyHeader, "unknown-secret-0123456789"), "unknown key")
+	wantNoKey(t, s.do(t, fiber.MethodPut, "/api/", req, fiber.HeaderAuthorization, ownerKey), "key without Bearer")
+	wantNoKey(t, s.do(t, fiber.MethodPost, "/api/"+id, map[string]string{"tag": "new"}), "update without a key")
+	wantNoKey(t, s.do(t, fiber.MethodDelete, "/api/"+id, nil), "delete without a key")
+
+	// reads and redirects stay open
+	s.get(t, id)
+	if resp := s.do(t, fiber.MethodGet, "/"+id, nil); resp.StatusCode != fiber.StatusMovedPermanently {
+		t.Errorf("got status %d redirecting without a key, want a redirect", resp.StatusCode)
+	}
+}
+
+func TestRevokedKey(t *testing.T) {
+	// keys are revoked by removing them from API_KEYS
+	s := keyServer(t, "second:"+otherKey)
+
+	req := LinkCreateRequest{Target: "https://example.com"}
+	wantNoKey(t, s.do(t, fiber.MethodPut, "/api/", req, APIKeyHeader, ownerKey), "revoked key")
+	wantNoKey(t, s.do(t, fiber.MethodPut, "/api/", req, fiber.HeaderAuthorization, "Bearer "+ownerKey), "revoked bearer key")
+	s.create(t, req, APIKeyHeader, otherKey)
+}
+
+func TestOwnership(t *testing.T) {
+	const adminKey = "admin-secret-0123456789"
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.APIKeys = []string{"owner:" + ownerKey, "other:" + otherKey, "admin:" + adminKey}
+		conf.APIAdmins = []string{"admin"}
+	})
+	id := s.create(t, LinkCreateRequest{Target: "https://example.com/owned", Tag: "owned"}, APIKeyHeader, ownerKey)
+
+	// links of other keys don't exist for a key
+	update := map[string]string{"target": "https://example.com/taken"}
+	decode(t, s.do(t, fiber.MethodPost, "/api/"+id, update, APIKeyHeader, otherKey), fiber.StatusNotFound, nil)
+	decode(t, s.do(t, fiber.MethodDelete, "/api/"+id, nil, APIKeyHeader, otherKey), fiber.StatusNotFound, nil)
+	var result LinkDeleteResult
+	decode(t, s.do(t, fiber.MethodPost, "/api/batch/delete", []string{id}, APIKeyHeader, otherKey), fiber.StatusOK, &result)
+	if len(result.Deleted) != 0 || len(result.NotFound) != 1 {
+		t.Errorf("got %+v deleting a batch of another key, want the link not found", result)
+	}
+	if link := s.get(t, id); link.Target != "https://example.com/owned" {
+		t.Fatalf("target changed to %s by another key", link.Target)
+	}
+
+	// the owner and admin keys manage it
+	decode(t, s.do(t, fiber.MethodPost, "/api/"+id, map[string]string{"tag": "updated"}, APIKeyHeader, ownerKey), fiber.StatusOK, nil)
+	decode(t, s.do(t, fiber.MethodPost, "/api/"+id, update, APIKeyHeader, adminKey), fiber.StatusOK, nil)
+	if link := s.get(t, id); link.Target != "https://example.com/taken" || link.Tag != "updated" {
+		t.Errorf("got %s tagged %s, want it updated by the owner and the admin", link.Target, link.Tag)
+	}
+	decode(t, s.do(t, fiber.MethodDelete, "/api/"+id, nil, APIKeyHeader, adminKey), fiber.StatusOK, nil)
+	decode(t, s.do(t, fiber.MethodGet, "/api/"+id, nil), fiber.StatusNotFound, nil)
+}
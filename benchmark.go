@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+	"wormholes/internal/config"
+	"wormholes/ipc"
+
+	"github.com/dustin/go-humanize"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultBenchmarkDuration = 10 * time.Second
+
+// Run `wormholes benchmark [duration]`, generating IDs with the configured
+// generator settings and printing the result as JSON. Neither PostgreSQL nor
+// Redis is connected to.
+func benchmark(conf *config.Config, args []string) {
+	duration := defaultBenchmarkDuration
+	if len(args) > 0 {
+		var err error
+		duration, err = time.ParseDuration(args[0])
+		if err != nil || duration <= 0 {
+			log.Fatal().Msgf("benchmark: invalid duration %q", args[0])
+		}
+	}
+
+	result := ipc.NewFactory(conf, nil).Benchmark(duration)
+	log.Info().Msgf("benchmark: collision rate %.6f, keyspace %.4g", result.CollisionRate, result.Keyspace)
+	log.Info().Msgf("benchmark: keyspace exhausted in %s", projected(result.ExhaustionSeconds))
+	if result.BloomFullSeconds > 0 {
+		log.Info().Msgf("benchmark: bloom filter of %s IDs full in %s",
+			humanize.Comma(int64(result.BloomLimit)), projected(result.BloomFullSeconds))
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		log.Fatal().Err(err).Msg("benchmark: failed to print result")
+	}
+}
+
+// seconds as a duration, or in years when too long for one.
+func projected(seconds float64) string {
+	if seconds >= math.MaxInt64/float64(time.Second) {
+		return fmt.Sprintf("%.3g years", seconds/(365*24*60*60))
+	}
+
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
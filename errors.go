@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"wormholes/internal/links"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// An error returned to clients, with a stable machine readable code.
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+var (
+	errInvalidBody   = &APIError{fiber.StatusBadRequest, "invalid_body", "request body is malformed"}
+	errInvalidID     = &APIError{fiber.StatusBadRequest, "invalid_id", "id is missing"}
+	errIDChange      = &APIError{fiber.StatusBadRequest, "id_immutable", "id of a link can't be changed, rename it instead"}
+	errInvalidTarget = &APIError{fiber.StatusBadRequest, "invalid_target", "target must be an absolute URL with an allowed scheme"}
+	errTargetTooLong = &APIError{fiber.StatusBadRequest, "target_too_long", "target is longer than the maximum target length"}
+	errInvalidDomain = &APIError{fiber.StatusBadRequest, "invalid_domain", "domain is not one of the configured domains"}
+	errInvalidAlias  = &APIError{fiber.StatusBadRequest, "invalid_alias", "alias has an invalid length or characters, or is reserved"}
+	errInvalidCode   = &APIError{fiber.StatusBadRequest, "invalid_redirect_code", "redirect code must be 301, 302, 307 or 308"}
+	errInvalidSplit  = &APIError{fiber.StatusBadRequest, "invalid_variants", "variants must be 2 to 16 valid targets with positive weights"}
+	errInvalidGeo    = &APIError{fiber.StatusBadRequest, "invalid_geo_rules", "geo rules must map two letter country codes to valid targets"}
+	errInvalidLimits = &APIError{fiber.StatusBadRequest, "invalid_limits", "expiry must be in the future and max clicks not negative"}
+	errInvalidTTL    = &APIError{fiber.StatusBadRequest, "invalid_ttl", "ttl must be a positive duration of up to 10 years, like 30m, 24h or 7d, without expiresAt"}
+	errInvalidPass   = &APIError{fiber.StatusBadRequest, "invalid_password", "password is too long"}
+	errInvalidQuery  = &APIError{fiber.StatusBadRequest, "invalid_query", "query parameters are invalid"}
+	errEmptyBatch    = &APIError{fiber.StatusBadRequest, "empty_batch", "batch has no links"}
+	errNotProtected  = &APIError{fiber.StatusBadRequest, "not_protected", "link is not password protected"}
+	errNoPasswords   = &APIError{fiber.StatusBadRequest, "passwords_disabled", "password protected links are not enabled"}
+	errNoSigning     = &APIError{fiber.StatusBadRequest, "signing_disabled", "signed links are not enabled"}
+	errUnauthorized  = &APIError{fiber.StatusUnauthorized, "unauthorized", "a valid token is required"}
+	errNoKey         = &APIError{fiber.StatusUnauthorized, "invalid_api_key", "a valid API key is required"}
+	errWrongPassword = &APIError{fiber.StatusUnauthorized, "wrong_password", "password is incorrect"}
+	errNotFound      = &APIError{fiber.StatusNotFound, "not_found", "link not found"}
+	errExpired       = &APIError{fiber.StatusGone, "expired", "link expired"}
+	errAliasTaken    = &APIError{fiber.StatusConflict, "alias_taken", "alias is already taken"}
+	errHashTaken     = &APIError{fiber.StatusConflict, "id_collision", "no free id could be derived from target"}
+	errInProgress    = &APIError{fiber.StatusConflict, "in_progress", "a request with this Idempotency-Key is in progress"}
+	errBodyTooLarge  = &APIError{fiber.StatusRequestEntityTooLarge, "body_too_large", "request body is too large"}
+	errBatchTooLarge = &APIError{fiber.StatusRequestEntityTooLarge, "batch_too_large", "batch has too many links"}
+	errUnavailable   = &APIError{fiber.StatusServiceUnavailable, "unavailable", "server is shutting down"}
+	errInternal      = &APIError{fiber.StatusInternalServerError, "internal", "internal server error"}
+)
+
+// Error of a target that failed to normalize.
+func targetError(err error) *APIError {
+	if err == links.ErrTargetTooLong {
+		return errTargetTooLong
+	}
+
+	return errInvalidTarget
+}
+
+// Convert any error to an APIError. Fiber errors get a code from their
+// message, anything else is an internal error.
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		code := strings.ToLower(strings.ReplaceAll(fiberErr.Message, " ", "_"))
+		return &APIError{fiberErr.Code, code, strings.ToLower(fiberErr.Message)}
+	}
+
+	return errInternal
+}
+
+// Render errors as {"error": {"code": "...", "message": "..."}}. Errors that
+// aren't meant for clients are logged and hidden behind a generic 500.
+func errorHandler(ctx *fiber.Ctx, err error) error {
+	apiErr := toAPIError(err)
+	if apiErr == errInternal && err != errInternal {
+		requestLog(ctx).Error().Err(err).Msgf("%s %s: unhandled error", ctx.Method(), ctx.Path())
+	}
+
+	return ctx.Status(apiErr.Status).JSON(fiber.Map{"error": apiErr})
+}
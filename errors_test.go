@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Body of a response with status code, failing unless it is exactly
+// {"error": {"code": ..., "message": ...}}.
+func errorBody(t *testing.T, app *fiber.App, path string, code int) APIError {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, path, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != code {
+		t.Fatalf("%s: got status %d, want %d", path, resp.StatusCode, code)
+	}
+	if contentType := resp.Header.Get(fiber.HeaderContentType); !strings.HasPrefix(contentType, fiber.MIMEApplicationJSON) {
+		t.Errorf("%s: got content type %s, want JSON", path, contentType)
+	}
+
+	var body map[string]map[string]string
+	if err := json.Unmarshal(data, &body); err != nil || len(body) != 1 || len(body["error"]) != 2 {
+		t.Fatalf("%s: body %s isn't an error object, %v", path, data, err)
+	}
+
+	return APIError{Code: body["error"]["code"], Message: body["error"]["message"]}
+}
+
+func TestErrorShape(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: errorHandler})
+	app.Get("/invalid", func(*fiber.Ctx) error { return errInvalidBody })
+	app.Get("/internal", func(*fiber.Ctx) error {
+		return errors.New("db: password authentication failed for user wormholes")
+	})
+	app.Get("/fiber", func(*fiber.Ctx) error { return fiber.ErrMethodNotAllowed })
+
+	got := errorBody(t, app, "/invalid", fiber.StatusBadRequest)
+	if got.Code != errInvalidBody.Code || got.Message != errInvalidBody.Message {
+		t.Errorf("got %+v for a bad request, want %+v", got, *errInvalidBody)
+	}
+
+	// details of internal errors are only logged
+	got = errorBody(t, app, "/internal", fiber.StatusInternalServerError)
+	if got.Code != "internal" || got.Message != errInternal.Message {
+		t.Errorf("got %+v for an internal error, want %+v", got, *errInternal)
+	}
+
+	got = errorBody(t, app, "/fiber", fiber.StatusMethodNotAllowed)
+	if got.Code != "method_not_allowed" {
+		t.Errorf("got code %s for a fiber error, want method_not_allowed", got.Code)
+	}
+	got = errorBody(t, app, "/missing", fiber.StatusNotFound)
+	if got.Code == "" || got.Message == "" {
+		t.Errorf("got %+v for an unknown route, want a code and message", got)
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	var body struct {
+		Error APIError `json:"error"`
+	}
+	decode(t, s.do(t, fiber.MethodPut, "/api/", "{"), fiber.StatusBadRequest, &body)
+	if body.Error.Code != errInvalidBody.Code {
+		t.Errorf("got code %s for a malformed body, want %s", body.Error.Code, errInvalidBody.Code)
+	}
+	decode(t, s.do(t, fiber.MethodGet, "/api/missing", nil), fiber.StatusNotFound, &body)
+	if body.Error.Code != errNotFound.Code {
+		t.Errorf("got code %s for a missing link, want %s", body.Error.Code, errNotFound.Code)
+	}
+}
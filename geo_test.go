@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"wormholes/internal/config"
+	"wormholes/internal/geoip"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Reader of the countries of known IPs, every other IP is unknown.
+type fakeGeo map[string]string
+
+func (g fakeGeo) Lookup(ip net.IP) geoip.Location {
+	country, ok := g[ip.String()]
+	if !ok {
+		country = geoip.Unknown
+	}
+
+	return geoip.Location{Country: country, City: geoip.Unknown}
+}
+
+func (fakeGeo) Close() error {
+	return nil
+}
+
+func TestGeoRules(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		// requests sent with app.Test come from 0.0.0.0
+		conf.TrustedProxies = []string{"0.0.0.0/32"}
+	})
+	s.handler.geo = fakeGeo{"203.0.113.1": "DE", "203.0.113.2": "FR", "203.0.113.3": "US"}
+	id := s.create(t, LinkCreateRequest{
+		Target: "https://example.com",
+		GeoRules: map[string]string{
+			"de": "https://example.de",
+			"FR": "https://example.fr",
+		},
+	})
+
+	tests := []struct {
+		name string
+		ip   string
+		want string
+	}{
+		{"country with a rule", "203.0.113.1", "https://example.de"},
+		{"rule given in lower case", "203.0.113.2", "https://example.fr"},
+		{"country without a rule", "203.0.113.3", "https://example.com"},
+		{"unknown country", "198.51.100.1", "https://example.com"},
+	}
+	for _, test := range tests {
+		resp := s.do(t, fiber.MethodGet, "/"+id, nil, "X-Forwarded-For", test.ip)
+		if resp.StatusCode != fiber.StatusMovedPermanently {
+			t.Errorf("%s: got status %d, want a redirect", test.name, resp.StatusCode)
+
+			continue
+		}
+		if location := resp.Header.Get(fiber.HeaderLocation); location != test.want {
+			t.Errorf("%s: redirected to %s, want %s", test.name, location, test.want)
+		}
+	}
+}
@@ -1,50 +1,125 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/url"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 	"wormholes/ingestor"
+	"wormholes/internal/apikey"
+	"wormholes/internal/blacklist"
 	"wormholes/internal/cache"
+	"wormholes/internal/clientip"
+	"wormholes/internal/config"
+	"wormholes/internal/geoip"
+	"wormholes/internal/idgen"
 	"wormholes/internal/links"
+	"wormholes/internal/qr"
+	"wormholes/internal/ratelimit"
+	"wormholes/internal/token"
+	"wormholes/internal/tracing"
 	"wormholes/ipc"
 	"wormholes/store"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/jackc/pgx/v5"
 	"github.com/noquark/nanoid"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Fiber route handlers for link.
 type Handler struct {
-	backend  store.Store
-	ingestor *ingestor.Ingestor
-	cache    *cache.Cache
-	store    *ipc.Store
+	backend   store.Store
+	ingestor  *ingestor.Ingestor
+	clicks    *ingestor.Pipe
+	cache     *cache.Cache
+	store     *ipc.Store
+	config    *config.Config
+	blacklist *blacklist.Blacklist
+	// nil unless IDs are matched regardless of case
+	folder idgen.CaseFolder
+	// generates IDs locally when the generator is down
+	newID func(size int) (string, error)
+	// countries of visitors for links with geo rules
+	geo geoip.Reader
+	// API keys links are created and managed with, none if it is empty
+	keys *apikey.Keys
 }
 
 const (
 	CookieExpiryTime = time.Hour * 24 * 180
 	CacheControl     = "private, max-age=90"
 	CookieName       = "_wh"
+	// followed by the link ID, holds the variant served to the visitor
+	VariantCookie    = "_whv_"
 	MaxTry           = 10
 	CookieSize       = 21
 	backOffTime      = 5e3
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+	IdempotencyKey   = "Idempotency-Key"
+	idempotencyWait  = time.Second * 5
+	idempotencyPoll  = time.Millisecond * 50
+	DefaultQRSize    = 256
+	DefaultRange     = time.Hour * 24 * 30
+	MaxRange         = time.Hour * 24 * 366
+	qrTTL            = time.Minute * 10
+	// streamed, responses of this path can't be buffered for an ETag
+	ExportPath = "/api/export.csv"
+	// rehashes of a target before giving up on a derived ID
+	maxHashAttempts = 8
 )
 
 func NewHandler(
 	backend store.Store,
 	in *ingestor.Ingestor,
+	clicks *ingestor.Pipe,
 	cache *cache.Cache,
 	ipcStore *ipc.Store,
+	conf *config.Config,
+	reserved *blacklist.Blacklist,
+	geo geoip.Reader,
 ) *Handler {
-	return &Handler{
+	h := &Handler{
 		backend,
 		in,
+		clicks,
 		cache,
 		ipcStore,
+		conf,
+		reserved,
+		nil,
+		nil,
+		geo,
+		nil,
 	}
+	// validated with the config
+	h.keys, _ = apikey.Parse(conf.APIKeys, conf.APIAdmins)
+	// validated with the config
+	h.newID, _ = idgen.For(conf.Alphabet, conf.RNG)
+
+	if conf.CaseInsensitive {
+		alphabet := conf.Alphabet
+		if alphabet == "" {
+			alphabet = idgen.DefaultAlphabet
+		}
+		// the alphabet is validated with the config
+		h.folder, _ = idgen.NewCaseFolder(alphabet)
+	}
+
+	return h
 }
 
 // Generate a random cookie with retry on failure.
@@ -65,137 +140,1237 @@ func NewCookie() string {
 }
 
 func (h *Handler) Setup(app fiber.Router) {
+	// validated along with config
+	proxies, _ := ratelimit.ParseCIDRs(h.config.TrustedProxies)
+	app.Use(clientip.New(proxies).Handler())
+	app.Use(requestIDs)
+	// spans are only started when they are exported
+	if h.config.TraceEndpoint != "" {
+		app.Use(traceRequests)
+	}
+	app.Use(requestMetrics)
+	app.Use(limitBody(h.config.BodyLimit))
+	app.Get("/healthz", h.Healthz)
+	app.Get("/readyz", h.Readyz)
+	// also answers HEAD, with the same status and Location but no body
 	app.Get("/:id", h.Redirect)
 
+	// validated along with config
+	allow, _ := ratelimit.ParseCIDRs(h.config.RateAllow)
+	read := ratelimit.New(h.cache, "read", h.config.RateLimitRead, h.config.RateWindow, allow)
+	write := ratelimit.New(h.cache, "write", h.config.RateLimit, h.config.RateWindow, allow)
+	// writes and listing need a key when keys are configured, and are
+	// limited per key
+	auth := func(ctx *fiber.Ctx) error { return ctx.Next() }
+	// links are read without a key, their owner sees protected targets
+	optional := auth
+	if h.keys.Len() > 0 {
+		auth = requireKey(h.keys)
+		optional = optionalKey(h.keys)
+	}
+
+	// writes of a single link take small bodies, batches and imports are
+	// only held to BODY_LIMIT
+	small := limitBody(h.config.WriteBodyLimit)
+
+	app.Post("/:id/unlock", small, write, h.Unlock)
+
 	api := app.Group("api")
-	api.Get("/:id", h.Get)
-	api.Put("/", h.Create)
-	api.Post("/:id", h.Update)
-	api.Delete("/:id", h.Delete)
+	if h.config.CreatorMetrics {
+		api.Get("/metrics", metricsHandler)
+	}
+	api.Get("/", auth, read, h.List)
+	api.Get("/by-tag/:tag", auth, read, h.List)
+	api.Get(strings.TrimPrefix(ExportPath, "/api"), auth, write, h.Export)
+	api.Get("/:id", optional, read, h.Get)
+	api.Get("/:id/stats", auth, read, h.Stats)
+	api.Get("/:id/qr", read, h.QR)
+	api.Get("/:id/analytics", auth, read, h.Analytics)
+	api.Put("/", small, auth, write, h.Create)
+	api.Post("/batch", auth, write, h.CreateBatch)
+	api.Post("/batch/delete", auth, write, h.DeleteBatch)
+	api.Post(strings.TrimPrefix(ImportPath, "/api"), auth, write, h.Import)
+	api.Post("/:id", small, auth, write, h.Update)
+	api.Delete("/:id", auth, write, h.Delete)
+	api.Post("/:id/restore", small, auth, write, h.Restore)
+	api.Post("/:id/rename", small, auth, write, h.Rename)
 }
 
 type LinkCreateRequest struct {
-	Tag    string `json:"tag"`
-	Target string `json:"target"`
+	Domain    string     `json:"domain"`
+	Tag       string     `json:"tag"`
+	Tags      []string   `json:"tags"`
+	Target    string     `json:"target"`
+	Alias     string     `json:"alias"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	// expiry relative to creation, like 30m, 24h or 7d, instead of ExpiresAt
+	TTL       string `json:"ttl"`
+	MaxClicks int64  `json:"maxClicks"`
+	Dedup     bool   `json:"dedup"`
+	// derive the ID from the target instead of generating it
+	Deterministic bool   `json:"deterministic"`
+	Password      string `json:"password"`
+	// targets by country code of visitors, Target for other countries
+	GeoRules map[string]string `json:"geoRules"`
+	// targets to split visitors between by weight, instead of Target
+	Variants []links.Variant `json:"variants"`
+	// REDIRECT_CODE if not set
+	RedirectCode int `json:"redirectCode"`
+	// resolve only with the signature of the ID, always with SIGNED_LINKS
+	Signed bool `json:"signed"`
+	// ID of the API key creating the link
+	Owner string `json:"-"`
+}
+
+type LinkRenameRequest struct {
+	ID string `json:"id"`
+	// keep the old ID redirecting to the new one
+	Redirect bool `json:"redirect"`
+}
+
+type LinkUnlockRequest struct {
+	Password string `json:"password"`
+}
+
+// Result of deleting a batch of links, IDs in the order of the request.
+type LinkDeleteResult struct {
+	Deleted  []string `json:"deleted"`
+	NotFound []string `json:"notFound"`
+}
+
+// Result of creating one link of a batch.
+type LinkBatchResult struct {
+	ID       string `json:"id,omitempty"`
+	ShortURL string `json:"short_url,omitempty"`
+	Target   string `json:"target"`
+	Status   string `json:"status"`
 }
 
 func (h *Handler) Create(ctx *fiber.Ctx) error {
 	var req LinkCreateRequest
 	if err := ctx.BodyParser(&req); err != nil {
-		log.Error().Err(err).Msg("create: failed to parsing request")
+		requestLog(ctx).Error().Err(err).Msg("create: failed to parsing request")
 
-		return fiber.ErrBadRequest
+		return errInvalidBody
+	}
+	if err := h.defaultDomain(ctx, &req); err != nil {
+		return err
 	}
+	req.Owner = keyID(ctx)
 
-	var link *links.Link
+	create := func() ([]byte, error) {
+		link, reused, err := h.createLink(ctx.UserContext(), &req, "")
+		if err != nil {
+			return nil, err
+		}
+
+		status := "Link Created"
+		if reused {
+			status = "Link Reused"
+		}
 
-	newID, err := h.store.GetID()
+		return json.Marshal(fiber.Map{
+			"status":    status,
+			"id":        link.ID,
+			"short_url": h.shortURL(link.Domain, h.publicID(*link)),
+		})
+	}
+
+	var body []byte
+	var err error
+	if key := ctx.Get(IdempotencyKey); key != "" {
+		// keys of one API key never replay responses to another, IDs of
+		// keys can't hold a colon
+		if req.Owner != "" {
+			key = req.Owner + ":" + key
+		}
+		body, err = h.once(ctx, key, create)
+	} else {
+		body, err = create()
+	}
 	if err != nil {
-		log.Error().Err(err).Msg("create: failed to get id")
+		return err
+	}
+
+	ctx.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
 
-		return fiber.ErrInternalServerError
+	return ctx.Status(fiber.StatusOK).Send(body)
+}
+
+// Run create once for an idempotency key and replay its response to retries
+// with the same key. Concurrent requests with the key wait for the first one.
+func (h *Handler) once(ctx *fiber.Ctx, key string, create func() ([]byte, error)) ([]byte, error) {
+	deadline := time.Now().Add(idempotencyWait)
+	for time.Now().Before(deadline) {
+		// claimed briefly so a crashed request doesn't hold the key
+		claimed, err := h.cache.ClaimKey(key, idempotencyWait)
+		if err != nil {
+			requestLog(ctx).Warn().Err(err).Msg("create: failed to claim idempotency key")
+
+			return create()
+		}
+
+		if claimed {
+			body, err := create()
+			if err != nil {
+				// a failed request can be retried with the same key
+				if err := h.cache.ReleaseKey(key); err != nil {
+					requestLog(ctx).Warn().Err(err).Msg("create: failed to release idempotency key")
+				}
+
+				return nil, err
+			}
+
+			if err := h.cache.SetKey(key, string(body), h.config.IdempotencyTTL); err != nil {
+				requestLog(ctx).Warn().Err(err).Msg("create: failed to store idempotent response")
+			}
+
+			return body, nil
+		}
+
+		stored, err := h.cache.GetKey(key)
+		if err != nil {
+			requestLog(ctx).Error().Err(err).Msg("create: failed to get idempotent response")
+
+			return nil, errInternal
+		}
+		if stored != "" {
+			return []byte(stored), nil
+		}
+
+		time.Sleep(idempotencyPoll)
 	}
 
-	link = links.New(newID, req.Target, req.Tag)
-	h.ingestor.Push(link)
+	return nil, errInProgress
+}
 
-	return ctx.Status(fiber.StatusOK).JSON(fiber.Map{
-		"status": "Link Created",
-		"id":     link.ID,
-	})
+// Create links in bulk, failures are reported per link in the same order.
+func (h *Handler) CreateBatch(ctx *fiber.Ctx) error {
+	var reqs []LinkCreateRequest
+	if err := ctx.BodyParser(&reqs); err != nil {
+		requestLog(ctx).Error().Err(err).Msg("create: failed to parsing batch request")
+
+		return errInvalidBody
+	}
+
+	if len(reqs) == 0 {
+		return errEmptyBatch
+	}
+	if len(reqs) > h.config.MaxBatch {
+		return errBatchTooLarge
+	}
+
+	// generated IDs are taken at once, links with an alias or a derived ID
+	// don't need one
+	generated := 0
+	for i := range reqs {
+		if reqs[i].Alias == "" && !h.hashed(&reqs[i]) {
+			generated++
+		}
+	}
+	_, span := tracing.Start(ctx.UserContext(), "ipc.get_ids")
+	ids, err := h.store.GetIDs(generated)
+	tracing.End(span, err)
+	if err != nil {
+		// links without an ID fail on their own
+		requestLog(ctx).Error().Err(err).Msgf("create: got %d of %d ids for batch", len(ids), generated)
+	}
+
+	results := make([]LinkBatchResult, len(reqs))
+	for i := range reqs {
+		newID := ""
+		if reqs[i].Alias == "" && !h.hashed(&reqs[i]) && len(ids) > 0 {
+			newID, ids = ids[0], ids[1:]
+		}
+
+		results[i].Target = reqs[i].Target
+		reqs[i].Owner = keyID(ctx)
+		if err := h.defaultDomain(ctx, &reqs[i]); err != nil {
+			results[i].Status = toAPIError(err).Code
+			if newID != "" {
+				h.store.Recycle(newID)
+			}
+
+			continue
+		}
+
+		link, reused, err := h.createLink(ctx.UserContext(), &reqs[i], newID)
+		if err != nil {
+			results[i].Status = toAPIError(err).Code
+
+			continue
+		}
+		results[i].ID = link.ID
+		results[i].ShortURL = h.shortURL(link.Domain, h.publicID(*link))
+		results[i].Status = "created"
+		if reused {
+			results[i].Status = "reused"
+		}
+	}
+
+	return ctx.Status(fiber.StatusOK).JSON(results)
 }
 
+// Validate req and create a link from it with a custom, derived or generated
+// ID, newID if it is given. With dedup or a derived ID, a live link with the
+// same target is reused, reporting true.
+func (h *Handler) createLink(ctx context.Context, req *LinkCreateRequest, newID string) (*links.Link, bool, error) {
+	// a generated ID is only burned once its link is pushed, until then it
+	// is recycled when the link fails or an existing one is reused
+	unused := newID
+	defer func() {
+		if unused != "" {
+			h.store.Recycle(unused)
+		}
+	}()
+
+	if req.TTL != "" {
+		ttl, err := links.ParseTTL(req.TTL)
+		if err != nil || req.ExpiresAt != nil {
+			return nil, false, errInvalidTTL
+		}
+		expiresAt := time.Now().Add(ttl)
+		req.ExpiresAt = &expiresAt
+	}
+	if req.MaxClicks < 0 || (req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now())) {
+		return nil, false, errInvalidLimits
+	}
+
+	target, err := links.NormalizeTarget(req.Target, h.config.TargetSchemes, h.config.AddScheme, h.config.MaxTargetLength)
+	if err != nil {
+		return nil, false, targetError(err)
+	}
+	geoRules, err := links.NormalizeGeoRules(req.GeoRules, h.config.TargetSchemes, h.config.AddScheme, h.config.MaxTargetLength)
+	if err == links.ErrTargetTooLong {
+		return nil, false, errTargetTooLong
+	}
+	if err != nil {
+		return nil, false, errInvalidGeo
+	}
+	variants, err := links.NormalizeVariants(req.Variants, h.config.TargetSchemes, h.config.AddScheme, h.config.MaxTargetLength)
+	if err == links.ErrTargetTooLong {
+		return nil, false, errTargetTooLong
+	}
+	if err != nil {
+		return nil, false, errInvalidSplit
+	}
+	if req.RedirectCode != 0 && !links.ValidRedirectCode(req.RedirectCode) {
+		return nil, false, errInvalidCode
+	}
+
+	// tokens for protected links can't be signed without a secret
+	if req.Password != "" && h.config.Secret == "" {
+		zerolog.Ctx(ctx).Error().Msg("create: SECRET is required for password protected links")
+
+		return nil, false, errNoPasswords
+	}
+	if req.Signed && h.config.SignSecret == "" {
+		zerolog.Ctx(ctx).Error().Msg("create: SIGN_SECRET is required for signed links")
+
+		return nil, false, errNoSigning
+	}
+
+	// links with an alias, tag, limits, password, geo rules, variants, their
+	// own redirect code or a signature are never shared
+	dedup := (req.Dedup || h.config.Dedup) && req.Alias == "" && req.Tag == "" && len(req.Tags) == 0 &&
+		req.ExpiresAt == nil && req.MaxClicks == 0 && req.Password == "" && len(geoRules) == 0 && len(variants) == 0 &&
+		req.RedirectCode == 0 && !req.Signed
+	if dedup {
+		if link, ok := h.findTarget(ctx, req.Domain, target); ok && link.Owner == req.Owner {
+			return &link, true, nil
+		}
+	}
+
+	hashed := h.hashed(req)
+	if req.Alias != "" {
+		newID = req.Alias
+		if err := h.reserveAlias(ctx, req.Domain, newID); err != nil {
+			return nil, false, err
+		}
+	} else if hashed {
+		var existing *links.Link
+		newID, existing, err = h.hashID(ctx, req.Domain, target, req.Owner)
+		if err != nil {
+			return nil, false, err
+		}
+		if existing != nil {
+			return existing, true, nil
+		}
+	} else if newID == "" {
+		_, span := tracing.Start(ctx, "ipc.get_id")
+		newID, err = h.store.GetID()
+		tracing.End(span, err)
+		// only IDs of the generator are recycled, one generated here isn't in
+		// its bloom filter and could be handed out by it as well
+		if err == nil {
+			unused = newID
+		} else if errors.Is(err, ipc.ErrNoIds) && h.config.LocalIDs {
+			newID, err = h.localID(ctx, req.Domain)
+		}
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("create: failed to get id")
+
+			return nil, false, errInternal
+		}
+	}
+
+	link := links.New(req.Domain, newID, target, req.Tag)
+	link.Tags = req.Tags
+	link.NormalizeTags()
+	link.ExpiresAt = req.ExpiresAt
+	link.MaxClicks = req.MaxClicks
+	link.GeoRules = geoRules
+	link.Variants = variants
+	link.RedirectCode = req.RedirectCode
+	link.Owner = req.Owner
+	link.Signed = req.Signed || h.config.SignedLinks
+
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			// a password too long for bcrypt
+			return nil, false, errInvalidPass
+		}
+		link.PasswordHash = string(hash)
+		link.Protected = true
+	}
+	if err := h.ingestor.Push(link); err != nil {
+		return nil, false, errUnavailable
+	}
+	unused = ""
+
+	if dedup || hashed {
+		// cached so it is found before it is ingested
+		if err := h.cache.SetLink(*link, link.Key()); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("create: failed to cache")
+		} else if dedup {
+			if err := h.cache.SetTarget(link.Domain, target, link.ID); err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Msg("create: failed to cache target")
+			}
+		}
+	}
+
+	return link, false, nil
+}
+
+// Generate an ID in this process while the generator can't provide one,
+// checking PostgreSQL for collisions. Without the bloom filter, an ID held
+// by the generator or a link not yet ingested can still be repeated.
+func (h *Handler) localID(ctx context.Context, domain string) (string, error) {
+	localIDs.Inc()
+	zerolog.Ctx(ctx).Warn().Msg("create: generator unavailable, generating id locally")
+
+	for i := 0; i < MaxTry; i++ {
+		id, err := h.newID(h.config.IDSize)
+		if err != nil {
+			return "", err
+		}
+		if h.blacklist.Match(id) {
+			continue
+		}
+
+		spanCtx, span := tracing.Start(ctx, "db.get")
+		_, err = h.backend.Get(spanCtx, domain, id)
+		span.End()
+		if err == pgx.ErrNoRows {
+			return id, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return "", ipc.ErrNoIds
+}
+
+// Find a live link created for target on domain.
+func (h *Handler) findTarget(ctx context.Context, domain, target string) (links.Link, bool) {
+	shortID, err := h.cache.GetTarget(domain, target)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("create: failed to get target")
+	}
+	if shortID == "" {
+		return links.Link{}, false
+	}
+
+	link, err := h.resolve(ctx, domain, shortID, "create")
+	if err != nil || link.Target != target {
+		return links.Link{}, false
+	}
+
+	return link, true
+}
+
+// ID of the link in the path, folded to the case of the alphabet when IDs are
+// matched regardless of case.
+func (h *Handler) pathID(ctx *fiber.Ctx) string {
+	return h.foldID(ctx.Params("id"))
+}
+
+// Fold id to the case of the alphabet if IDs are matched regardless of case.
+func (h *Handler) foldID(id string) string {
+	if h.folder != nil {
+		id = h.folder.Fold(id)
+	}
+
+	return id
+}
+
+// Whether the ID of a link for req is derived from its target. Links with
+// geo rules or variants have more than one target and get a generated ID, as
+// do signed links, which must not be guessed.
+func (h *Handler) hashed(req *LinkCreateRequest) bool {
+	return req.Alias == "" && len(req.GeoRules) == 0 && len(req.Variants) == 0 && !req.Signed &&
+		(req.Deterministic || h.config.HashIDs)
+}
+
+// Derive an ID on domain from the hash of target and register it, rehashing
+// while the ID belongs to another target or owner. A live link already
+// created with the ID for target by owner is returned to be reused instead.
+func (h *Handler) hashID(ctx context.Context, domain, target, owner string) (string, *links.Link, error) {
+	alphabet := h.config.Alphabet
+	if alphabet == "" {
+		alphabet = idgen.DefaultAlphabet
+	}
+
+	for attempt := 0; attempt < maxHashAttempts; attempt++ {
+		id := idgen.Hash(target, attempt, alphabet, h.config.IDSize)
+		if h.blacklist.Match(id) {
+			continue
+		}
+
+		link, err := h.resolve(ctx, domain, id, "create")
+		if err == nil && link.Target == target && !link.Protected && len(link.GeoRules) == 0 && len(link.Variants) == 0 &&
+			link.Owner == owner {
+			return id, &link, nil
+		}
+		if err == nil || err == errExpired {
+			continue
+		}
+		if err != errNotFound {
+			return "", nil, err
+		}
+
+		// the generator knows of IDs that aren't links yet
+		err = h.store.Register(ctx, domain, id)
+		if err == nil {
+			return id, nil, nil
+		}
+		if err != ipc.ErrIDTaken {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("create: failed to register derived id")
+
+			return "", nil, errInternal
+		}
+	}
+
+	zerolog.Ctx(ctx).Error().Msgf("create: no free id for target after %d attempts", maxHashAttempts)
+
+	return "", nil, errHashTaken
+}
+
+// Whether id could belong to a link, of a size IDs can have, made of
+// characters of the alphabet and not blacklisted, as blacklisted IDs are
+// never generated or accepted as aliases. Without STRICT_IDS any id could.
+func (h *Handler) validID(id string) bool {
+	if !h.config.StrictIDs {
+		return true
+	}
+	alphabet := h.config.Alphabet
+	if alphabet == "" {
+		alphabet = idgen.DefaultAlphabet
+	}
+
+	return idgen.Valid(id, alphabet, ipc.MinIDSize, ipc.MaxIDSize) && !h.blacklist.Match(id)
+}
+
+// Check that a custom alias is valid and free on domain, and register it with
+// the generator so it is never generated.
+func (h *Handler) reserveAlias(ctx context.Context, domain, alias string) error {
+	alphabet := h.config.Alphabet
+	if alphabet == "" {
+		alphabet = idgen.DefaultAlphabet
+	}
+
+	if !idgen.Valid(alias, alphabet, ipc.MinIDSize, ipc.MaxIDSize) || h.blacklist.Match(alias) {
+		return errInvalidAlias
+	}
+
+	spanCtx, span := tracing.Start(ctx, "db.get")
+	_, err := h.backend.Get(spanCtx, domain, alias)
+	span.End()
+	if err == nil {
+		return errAliasTaken
+	}
+	if err != pgx.ErrNoRows {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("create: failed to check alias")
+
+		return errInternal
+	}
+
+	if err := h.store.Register(ctx, domain, alias); err != nil {
+		if err == ipc.ErrIDTaken {
+			return errAliasTaken
+		}
+		zerolog.Ctx(ctx).Error().Err(err).Msg("create: failed to register alias")
+
+		return errInternal
+	}
+
+	return nil
+}
+
+// Update the fields present in the request body, leaving the others as they
+// are. Setting tag or tags replaces all tags of the link.
 func (h *Handler) Update(ctx *fiber.Ctx) error {
-	var link links.Link
-	if err := ctx.BodyParser(&link); err != nil {
-		log.Error().Err(err).Msg("error parsing request")
+	id := h.pathID(ctx)
+	if len(id) == 0 {
+		return errInvalidID
+	}
+	domain, err := h.domain(ctx)
+	if err != nil {
+		return err
+	}
+
+	var patch links.Patch
+	if err := ctx.BodyParser(&patch); err != nil {
+		requestLog(ctx).Error().Err(err).Msg("update: failed to parse request")
+
+		return errInvalidBody
+	}
+	if patch.ID != nil && h.foldID(*patch.ID) != id {
+		return errIDChange
+	}
 
-		return fiber.ErrBadRequest
+	if patch.Target != nil {
+		target, err := links.NormalizeTarget(*patch.Target, h.config.TargetSchemes, h.config.AddScheme, h.config.MaxTargetLength)
+		if err != nil {
+			return targetError(err)
+		}
+		patch.Target = &target
+	}
+	if patch.RedirectCode != nil && *patch.RedirectCode != 0 && !links.ValidRedirectCode(*patch.RedirectCode) {
+		return errInvalidCode
+	}
+	if patch.Tag != nil || patch.Tags != nil {
+		link := links.Link{}
+		if patch.Tag != nil {
+			link.Tag = *patch.Tag
+		}
+		if patch.Tags != nil {
+			link.Tags = *patch.Tags
+		}
+		link.NormalizeTags()
+		patch.Tag, patch.Tags = &link.Tag, &link.Tags
 	}
 
-	if err := h.backend.Update(&link); err != nil {
-		log.Error().Err(err).Msg("error updating link")
+	if err := h.backend.Update(ctx.UserContext(), domain, id, h.owner(ctx), patch); err != nil {
+		if err == pgx.ErrNoRows {
+			return errNotFound
+		}
+		requestLog(ctx).Error().Err(err).Msg("update: error updating link")
 
-		return fiber.ErrInternalServerError
+		return errInternal
+	}
+
+	// the database is the source of truth, a stale entry is only logged
+	if err := h.cache.DeleteLink(links.Key(domain, id)); err != nil {
+		requestLog(ctx).Warn().Err(err).Msg("update: failed to invalidate cache")
 	}
 
 	return ctx.SendStatus(fiber.StatusOK)
 }
 
 func (h *Handler) Get(ctx *fiber.Ctx) error {
-	shortID := ctx.Params("id")
-	if len(shortID) == 0 {
-		return fiber.ErrBadRequest
+	domain, err := h.domain(ctx)
+	if err != nil {
+		return err
 	}
 
-	var link links.Link
+	link, err := h.resolvePath(ctx, domain, "get")
+	if err != nil {
+		return err
+	}
+	// targets of protected links are shown to their owner and with a token
+	// issued for the password only
+	if link.Protected && !h.owns(ctx, link) &&
+		(h.config.Secret == "" || !token.Verify(h.config.Secret, link.Key(), ctx.Query("token"))) {
+		link = hideTargets(link)
+	}
 
-	err := h.cache.GetLink(&link, shortID)
-	if err != nil || reflect.ValueOf(link).IsZero() {
-		log.Err(err).Msg("get: cache miss")
+	return ctx.Status(fiber.StatusOK).JSON(struct {
+		links.Link
+		ShortURL string `json:"short_url"`
+	}{link, h.shortURL(domain, h.publicID(link))})
+}
 
-		// If key does not exists, query db
-		link, err = h.backend.Get(shortID)
+// Copy of link without its target and the targets of its geo rules and
+// variants.
+func hideTargets(link links.Link) links.Link {
+	link.Target = ""
+	if link.GeoRules != nil {
+		rules := make(map[string]string, len(link.GeoRules))
+		for country := range link.GeoRules {
+			rules[country] = ""
+		}
+		link.GeoRules = rules
+	}
+	if link.Variants != nil {
+		variants := make([]links.Variant, len(link.Variants))
+		for i, variant := range link.Variants {
+			variants[i] = links.Variant{Weight: variant.Weight}
+		}
+		link.Variants = variants
+	}
+
+	return link
+}
 
+// List links in pages, ?after takes the next cursor of the previous page.
+// Links are filtered by tag from the path or ?tag.
+func (h *Handler) List(ctx *fiber.Ctx) error {
+	tag := ctx.Params("tag", ctx.Query("tag"))
+	domain, err := h.domain(ctx)
+	if err != nil {
+		return err
+	}
+
+	limit := ctx.QueryInt("limit", DefaultListLimit)
+	if limit <= 0 {
+		return errInvalidQuery
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	result, err := h.backend.List(ctx.UserContext(), domain, h.owner(ctx), ctx.Query("after"), limit, tag)
+	if err != nil {
+		requestLog(ctx).Error().Err(err).Msg("list: error listing links")
+
+		return errInternal
+	}
+
+	next := ""
+	if len(result) == limit {
+		next = result[len(result)-1].ID
+	}
+
+	return ctx.Status(fiber.StatusOK).JSON(fiber.Map{
+		"links": result,
+		"next":  next,
+	})
+}
+
+// Stream links as CSV, filtered by tag like List and by creation time in
+// [?from, ?to).
+func (h *Handler) Export(ctx *fiber.Ctx) error {
+	domain, err := h.domain(ctx)
+	if err != nil {
+		return err
+	}
+	// copied, the body is written after the handler returns
+	tag := utils.CopyString(ctx.Query("tag"))
+
+	to, err := parseTime(ctx.Query("to"), time.Now())
+	if err != nil {
+		return errInvalidQuery
+	}
+	from, err := parseTime(ctx.Query("from"), time.Time{})
+	if err != nil || !from.Before(to) {
+		return errInvalidQuery
+	}
+
+	owner, logger := h.owner(ctx), requestLog(ctx)
+	ctx.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	ctx.Set(fiber.HeaderContentDisposition, `attachment; filename="links.csv"`)
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		start := time.Now()
+		out := csv.NewWriter(w)
+
+		err := out.Write([]string{"id", "target", "tag", "created_at", "clicks"})
+		if err == nil {
+			// streamed after the handler returned, the request context is gone
+			err = h.backend.Export(context.Background(), domain, owner, tag, from, to, func(link links.Link, createdAt time.Time) error {
+				return out.Write([]string{
+					link.ID, link.Target, link.Tag,
+					createdAt.UTC().Format(time.RFC3339), strconv.FormatInt(link.Clicks, 10),
+				})
+			})
+		}
+		out.Flush()
+		if err == nil {
+			err = out.Error()
+		}
+		// the status is already sent, a failed export ends early
 		if err != nil {
-			log.Error().Err(err).Msg("get: error getting link")
+			logger.Error().Err(err).Msg("export: failed to stream links")
+		}
+
+		exportDuration.Observe(time.Since(start).Seconds())
+	})
+
+	return nil
+}
+
+// Clicks and creation time of a link, including clicks not yet flushed.
+func (h *Handler) Stats(ctx *fiber.Ctx) error {
+	shortID := h.pathID(ctx)
+	if len(shortID) == 0 {
+		return errInvalidID
+	}
+
+	domain, err := h.domain(ctx)
+	if err != nil {
+		return err
+	}
 
-			return fiber.ErrBadRequest
+	stats, err := h.backend.Stats(ctx.UserContext(), domain, shortID, h.owner(ctx))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return errNotFound
 		}
+		requestLog(ctx).Error().Err(err).Msg("stats: error getting stats")
+
+		return errInternal
+	}
+
+	pending, err := h.cache.Clicks(links.Key(domain, shortID))
+	if err != nil {
+		requestLog(ctx).Warn().Err(err).Msg("stats: failed to get pending clicks")
+	}
+	stats.Clicks += pending
+
+	return ctx.Status(fiber.StatusOK).JSON(stats)
+}
+
+// Clicks on a link grouped by ?by in the range [?from, ?to), the last 30
+// days by default. Clicks of bots are left out unless ?bots is true.
+func (h *Handler) Analytics(ctx *fiber.Ctx) error {
+	shortID := h.pathID(ctx)
+	if len(shortID) == 0 {
+		return errInvalidID
+	}
+
+	domain, err := h.domain(ctx)
+	if err != nil {
+		return err
+	}
 
-		err = h.cache.SetLink(link, shortID)
+	to, err := parseTime(ctx.Query("to"), time.Now())
+	if err != nil {
+		return errInvalidQuery
+	}
+	from, err := parseTime(ctx.Query("from"), to.Add(-DefaultRange))
+	if err != nil || !from.Before(to) || to.Sub(from) > MaxRange {
+		return errInvalidQuery
+	}
+
+	// clicks aren't owned, only the link is
+	if owner := h.owner(ctx); owner != "" {
+		link, err := h.backend.Get(ctx.UserContext(), domain, shortID)
+		if err == pgx.ErrNoRows || (err == nil && link.Owner != owner) {
+			return errNotFound
+		}
 		if err != nil {
-			log.Warn().Err(err).Msg("get: failed to cache")
+			requestLog(ctx).Error().Err(err).Msg("analytics: error getting link")
+
+			return errInternal
 		}
+	}
 
-		return ctx.Status(fiber.StatusOK).JSON(link)
+	counts, err := h.backend.Analytics(ctx.UserContext(), domain, shortID, from, to,
+		ctx.Query("by", store.ByDay), ctx.QueryBool("bots"))
+	if err != nil {
+		if err == store.ErrDimension {
+			return errInvalidQuery
+		}
+		requestLog(ctx).Error().Err(err).Msg("analytics: error querying clicks")
+
+		return errInternal
 	}
 
-	return ctx.Status(fiber.StatusOK).JSON(link)
+	return ctx.Status(fiber.StatusOK).JSON(counts)
 }
 
-func (h *Handler) Delete(ctx *fiber.Ctx) error {
-	id := ctx.Params("id")
-	if len(id) == 0 {
-		return fiber.ErrBadRequest
+// Parse an RFC 3339 time or a date, fallback if value is empty.
+func parseTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
 	}
 
-	if err := h.backend.Delete(id); err != nil {
-		log.Error().Err(err).Msg("error deleting link")
+	return time.Parse(time.RFC3339, value)
+}
 
-		return fiber.ErrInternalServerError
+// QR code encoding the short URL of a link, as PNG or SVG with ?format=svg.
+func (h *Handler) QR(ctx *fiber.Ctx) error {
+	format := ctx.Query("format", "png")
+	size := ctx.QueryInt("size", DefaultQRSize)
+	if (format != "png" && format != "svg") || size < qr.MinSize || size > qr.MaxSize {
+		return errInvalidQuery
 	}
 
-	return ctx.SendStatus(fiber.StatusOK)
+	domain, err := h.domain(ctx)
+	if err != nil {
+		return err
+	}
+	link, err := h.resolvePath(ctx, domain, "qr")
+	if err != nil {
+		return err
+	}
+	key := link.Key()
+
+	encode, contentType := qr.PNG, "image/png"
+	if format == "svg" {
+		encode, contentType = qr.SVG, "image/svg+xml"
+	}
+	ctx.Set(fiber.HeaderContentType, contentType)
+
+	image, err := h.cache.GetQR(key, format, size)
+	if err != nil {
+		requestLog(ctx).Warn().Err(err).Msg("qr: failed to get cached image")
+	}
+	if len(image) > 0 {
+		return ctx.Status(fiber.StatusOK).Send(image)
+	}
+
+	image, err = encode(h.shortURL(domain, h.publicID(link)), size)
+	if err != nil {
+		requestLog(ctx).Error().Err(err).Msg("qr: failed to encode")
+
+		return errInternal
+	}
+
+	if err := h.cache.SetQR(key, format, size, image, qrTTL); err != nil {
+		requestLog(ctx).Warn().Err(err).Msg("qr: failed to cache image")
+	}
+
+	return ctx.Status(fiber.StatusOK).Send(image)
 }
 
-func (h *Handler) Redirect(c *fiber.Ctx) error {
-	shortID := c.Params("id")
-	if len(shortID) == 0 {
-		return fiber.ErrBadRequest
+// Get link from cache or database, caching it on a miss. Expired links are
+// reported with errExpired.
+func (h *Handler) resolve(ctx context.Context, domain, shortID, op string) (links.Link, error) {
+	// probes for paths like /.env are never links, skip the lookups
+	if !h.validID(shortID) {
+		rejectedIDs.Inc()
+
+		return links.Link{}, errNotFound
 	}
 
 	var link links.Link
+	key := links.Key(domain, shortID)
 
-	err := h.cache.GetLink(&link, shortID)
-	if err != nil || reflect.ValueOf(link).IsZero() {
-		log.Err(err).Msg("redirect: cache miss")
+	cached := true
+	_, span := tracing.Start(ctx, "cache.get_link")
+	err := h.cache.GetLink(&link, key)
+	tracing.End(span, err)
+	switch {
+	case err != nil:
+		// unreachable cache or a broken entry, fall back to the database
+		cacheRequests.WithLabelValues("error").Inc()
+		zerolog.Ctx(ctx).Warn().Err(err).Msgf("%s: failed to get cached link", op)
+		link = links.Link{}
+		cached = false
+	case reflect.ValueOf(link).IsZero():
+		cacheRequests.WithLabelValues("miss").Inc()
+		zerolog.Ctx(ctx).Debug().Msgf("%s: cache miss", op)
+		cached = false
+	default:
+		cacheRequests.WithLabelValues("hit").Inc()
+	}
 
+	if !cached {
 		// If key does not exists, query db
-		link, err := h.backend.Get(shortID)
+		spanCtx, span := tracing.Start(ctx, "db.get")
+		link, err = h.backend.Get(spanCtx, domain, shortID)
+		span.End()
 		if err != nil {
 			if err == pgx.ErrNoRows {
-				return fiber.ErrNotFound
+				return link, errNotFound
 			}
-			log.Error().Err(err).Msg("redirect: error getting link")
+			zerolog.Ctx(ctx).Error().Err(err).Msgf("%s: error getting link", op)
+
+			return link, errInternal
+		}
+
+		err = h.cache.SetLink(link, key)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msgf("%s: failed to cache", op)
+		}
+	}
+
+	clicks := link.Clicks
+	if link.MaxClicks > 0 {
+		pending, err := h.cache.Clicks(key)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msgf("%s: failed to get pending clicks", op)
+		}
+		clicks += pending
+	}
+
+	now := time.Now()
+	expired := link.Expired(now, clicks)
+
+	// keep expired links briefly and others only until they expire, click
+	// limited links are cached without a ttl until they run out
+	var ttl time.Duration
+	switch {
+	case expired && (!cached || link.ExpiresAt == nil):
+		ttl = h.config.ExpiredTTL
+	case !cached && link.ExpiresAt != nil:
+		ttl = link.ExpiresAt.Sub(now)
+	}
+	if ttl > 0 {
+		if err := h.cache.ExpireLink(key, ttl); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msgf("%s: failed to set cache ttl", op)
+		}
+	}
+
+	if expired {
+		return link, errExpired
+	}
+
+	return link, nil
+}
+
+func (h *Handler) Delete(ctx *fiber.Ctx) error {
+	id := h.pathID(ctx)
+	if len(id) == 0 {
+		return errInvalidID
+	}
+	if !h.validID(id) {
+		rejectedIDs.Inc()
+
+		return errNotFound
+	}
+
+	domain, err := h.domain(ctx)
+	if err != nil {
+		return err
+	}
+
+	remove := h.backend.Delete
+	if h.config.SoftDelete {
+		remove = h.backend.SoftDelete
+	}
+
+	if err := remove(ctx.UserContext(), domain, id, h.owner(ctx)); err != nil {
+		if err == pgx.ErrNoRows {
+			return errNotFound
+		}
+		requestLog(ctx).Error().Err(err).Msg("error deleting link")
+
+		return errInternal
+	}
+
+	if err := h.cache.DeleteLink(links.Key(domain, id)); err != nil {
+		requestLog(ctx).Warn().Err(err).Msg("delete: failed to invalidate cache")
+	}
+
+	return ctx.SendStatus(fiber.StatusOK)
+}
+
+// Delete the links with the IDs in the body in a single query, reporting
+// which of them were deleted and which weren't found.
+func (h *Handler) DeleteBatch(ctx *fiber.Ctx) error {
+	domain, err := h.domain(ctx)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	if err := ctx.BodyParser(&ids); err != nil {
+		requestLog(ctx).Error().Err(err).Msg("delete: failed to parse batch request")
+
+		return errInvalidBody
+	}
+	if len(ids) == 0 {
+		return errEmptyBatch
+	}
+	if len(ids) > h.config.MaxBatch {
+		return errBatchTooLarge
+	}
+	for i := range ids {
+		ids[i] = h.foldID(ids[i])
+	}
+
+	remove := h.backend.DeleteBatch
+	if h.config.SoftDelete {
+		remove = h.backend.SoftDeleteBatch
+	}
+	deleted, err := remove(ctx.UserContext(), domain, ids, h.owner(ctx))
+	if err != nil {
+		requestLog(ctx).Error().Err(err).Msg("delete: error deleting batch")
+
+		return errInternal
+	}
+
+	found := make(map[string]bool, len(deleted))
+	keys := make([]string, len(deleted))
+	for i, id := range deleted {
+		found[id] = true
+		keys[i] = links.Key(domain, id)
+	}
+	if err := h.cache.DeleteLinks(keys); err != nil {
+		requestLog(ctx).Warn().Err(err).Msg("delete: failed to invalidate cache")
+	}
+
+	// repeated IDs are reported once
+	result := LinkDeleteResult{Deleted: []string{}, NotFound: []string{}}
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if found[id] {
+			result.Deleted = append(result.Deleted, id)
+		} else {
+			result.NotFound = append(result.NotFound, id)
+		}
+	}
+
+	return ctx.Status(fiber.StatusOK).JSON(result)
+}
+
+// Restore a soft deleted link.
+func (h *Handler) Restore(ctx *fiber.Ctx) error {
+	id := h.pathID(ctx)
+	if len(id) == 0 {
+		return errInvalidID
+	}
+
+	domain, err := h.domain(ctx)
+	if err != nil {
+		return err
+	}
 
-			return fiber.ErrInternalServerError
+	if err := h.backend.Restore(ctx.UserContext(), domain, id, h.owner(ctx)); err != nil {
+		if err == pgx.ErrNoRows {
+			return errNotFound
 		}
+		requestLog(ctx).Error().Err(err).Msg("restore: error restoring link")
+
+		return errInternal
+	}
+
+	return ctx.SendStatus(fiber.StatusOK)
+}
 
-		err = h.cache.SetLink(link, shortID)
+// Change the ID of a link to one validated like an alias, optionally leaving
+// the old ID as a redirect to the new one.
+func (h *Handler) Rename(ctx *fiber.Ctx) error {
+	id := h.pathID(ctx)
+	if len(id) == 0 {
+		return errInvalidID
+	}
+
+	domain, err := h.domain(ctx)
+	if err != nil {
+		return err
+	}
+
+	var req LinkRenameRequest
+	if err := ctx.BodyParser(&req); err != nil {
+		requestLog(ctx).Error().Err(err).Msg("rename: failed to parse request")
+
+		return errInvalidBody
+	}
+
+	// signed links stay signed, with the signature of the new ID
+	renamed := links.Link{Domain: domain, ID: req.ID}
+	if h.config.SignSecret != "" && !h.config.SignedLinks {
+		link, err := h.backend.Get(ctx.UserContext(), domain, id)
+		if err == pgx.ErrNoRows {
+			return errNotFound
+		}
 		if err != nil {
-			log.Warn().Err(err).Msg("redirect: failed to cache")
+			requestLog(ctx).Error().Err(err).Msg("rename: error getting link")
+
+			return errInternal
 		}
+		renamed.Signed = link.Signed
+	}
+
+	// registered with the generator first, a failed rename only leaves the
+	// new ID unused
+	if err := h.reserveAlias(ctx.UserContext(), domain, req.ID); err != nil {
+		return err
+	}
+
+	redirect := ""
+	if req.Redirect {
+		redirect = h.shortURL(domain, h.publicID(renamed))
+	}
+	if err := h.backend.Rename(ctx.UserContext(), domain, id, req.ID, h.owner(ctx), redirect); err != nil {
+		switch err {
+		case pgx.ErrNoRows:
+			return errNotFound
+		case store.ErrIDTaken:
+			return errAliasTaken
+		}
+		requestLog(ctx).Error().Err(err).Msg("rename: error renaming link")
+
+		return errInternal
+	}
+
+	if err := h.cache.DeleteLink(links.Key(domain, id)); err != nil {
+		requestLog(ctx).Warn().Err(err).Msg("rename: failed to invalidate cache")
+	}
+
+	return ctx.Status(fiber.StatusOK).JSON(fiber.Map{
+		"id":        req.ID,
+		"short_url": h.shortURL(domain, h.publicID(renamed)),
+	})
+}
+
+// Check the password of a protected link, issuing a token to redirect with.
+func (h *Handler) Unlock(ctx *fiber.Ctx) error {
+	var req LinkUnlockRequest
+	if err := ctx.BodyParser(&req); err != nil {
+		return errInvalidBody
+	}
+
+	domain := h.hostDomain(ctx)
+	link, err := h.resolvePath(ctx, domain, "unlock")
+	if err != nil {
+		return err
+	}
+	if !link.Protected {
+		return errNotProtected
+	}
+	if h.config.Secret == "" {
+		requestLog(ctx).Error().Msg("unlock: SECRET is not set")
+
+		return errInternal
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(req.Password)) != nil {
+		return errWrongPassword
+	}
+
+	expiry := time.Now().Add(h.config.UnlockTTL)
+
+	return ctx.Status(fiber.StatusOK).JSON(fiber.Map{
+		"token":     token.Sign(h.config.Secret, link.Key(), expiry),
+		"expiresAt": expiry,
+	})
+}
+
+func (h *Handler) Redirect(c *fiber.Ctx) error {
+	domain := h.hostDomain(c)
+	link, err := h.resolvePath(c, domain, "redirect")
+	if err == errExpired && h.config.ExpiredURL != "" {
+		return c.Redirect(h.config.ExpiredURL, fiber.StatusFound)
+	}
+	if err != nil {
+		return err
+	}
+
+	if link.Protected && !token.Verify(h.config.Secret, link.Key(), c.Query("token")) {
+		return errUnauthorized
 	}
 
 	if c.Cookies(CookieName) == "" {
@@ -208,7 +1383,151 @@ func (h *Handler) Redirect(c *fiber.Ctx) error {
 		})
 	}
 
-	c.Set(fiber.HeaderCacheControl, CacheControl)
+	// HEAD requests mostly come from link checkers unfurling the link
+	if c.Method() == fiber.MethodHead && !h.config.CountHead {
+		return h.redirectTo(c, link)
+	}
+
+	// unknown countries and failed lookups go to the default target or a
+	// variant
+	variant := -1
+	geoTarget, ok := "", false
+	if len(link.GeoRules) > 0 {
+		geoTarget, ok = link.GeoTarget(h.geo.Lookup(clientip.Of(c)).Country)
+	}
+	if ok {
+		link.Target = geoTarget
+	} else if len(link.Variants) > 0 {
+		variant = h.variant(c, link)
+		link.Target = link.Variants[variant].Target
+	}
+
+	// counted off the hot path, a lost click never delays the redirect. The
+	// context is reused by fiber once the handler returns, so nothing of it
+	// is read in the goroutine.
+	logger, key := requestLog(c), link.Key()
+	go func() {
+		if err := h.cache.IncrClicks(key); err != nil {
+			logger.Warn().Err(err).Msg("redirect: failed to count click")
+		}
+	}()
+
+	if h.clicks != nil {
+		h.clicks.Push(ingestor.Click{
+			Domain:    domain,
+			ID:        link.ID,
+			Time:      time.Now(),
+			IP:        clientip.Of(c),
+			UserAgent: utils.CopyString(c.Get(fiber.HeaderUserAgent)),
+			Referrer:  utils.CopyString(c.Get(fiber.HeaderReferer)),
+			Variant:   variant,
+		})
+	}
+
+	return h.redirectTo(c, link)
+}
+
+// Variant of link for the visitor, picked by weight on the first visit and
+// kept in a cookie so returning visitors get the same one.
+func (h *Handler) variant(c *fiber.Ctx, link links.Link) int {
+	name := VariantCookie + link.ID
+	if i, err := strconv.Atoi(c.Cookies(name)); err == nil && i >= 0 && i < len(link.Variants) {
+		return i
+	}
+
+	i := link.PickVariant(rand.Float64())
+	c.Cookie(&fiber.Cookie{
+		Name:    name,
+		Value:   strconv.Itoa(i),
+		Expires: time.Now().Add(CookieExpiryTime),
+	})
+
+	return i
+}
+
+func (h *Handler) redirectTo(c *fiber.Ctx, link links.Link) error {
+	// a cached redirect would outlive the token
+	if link.Protected {
+		c.Set(fiber.HeaderCacheControl, "no-store")
+
+		return c.Redirect(link.Target, fiber.StatusFound)
+	}
+
+	code := link.RedirectCode
+	if code == 0 {
+		code = h.config.RedirectCode
+	}
+
+	// browsers keep permanent redirects, temporary ones are asked for again
+	if links.PermanentRedirect(code) {
+		c.Set(fiber.HeaderCacheControl, CacheControl)
+	} else {
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+	}
+
+	return c.Redirect(link.Target, code)
+}
+
+// Domain of an API request, from ?domain or the host, which must be one of
+// DOMAINS. Other hosts use the default domain.
+func (h *Handler) domain(ctx *fiber.Ctx) (string, error) {
+	domain := ctx.Query("domain")
+	if domain == "" {
+		return h.hostDomain(ctx), nil
+	}
+
+	i := slices.Index(h.config.Domains, domain)
+	if i < 0 {
+		return "", errInvalidDomain
+	}
+
+	return h.config.Domains[i], nil
+}
+
+// Domain of the host of a request if it is one of DOMAINS, the default domain
+// otherwise. It is owned by config and safe to keep past the request.
+func (h *Handler) hostDomain(ctx *fiber.Ctx) string {
+	host := ctx.Hostname()
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	if i := slices.Index(h.config.Domains, host); i >= 0 {
+		return h.config.Domains[i]
+	}
+
+	return ""
+}
+
+// Set the domain of req from the request if it has none, checking it
+// otherwise.
+func (h *Handler) defaultDomain(ctx *fiber.Ctx, req *LinkCreateRequest) (err error) {
+	if req.Domain == "" {
+		req.Domain, err = h.domain(ctx)
+
+		return err
+	}
+
+	i := slices.Index(h.config.Domains, req.Domain)
+	if i < 0 {
+		return errInvalidDomain
+	}
+	req.Domain = h.config.Domains[i]
+
+	return nil
+}
+
+// Short URL of link id on domain, BASE_URL for the default domain and its
+// scheme for others.
+func (h *Handler) shortURL(domain, id string) string {
+	if domain == "" {
+		return h.config.BaseURL + "/" + id
+	}
+
+	scheme := "https"
+	if base, err := url.Parse(h.config.BaseURL); err == nil && base.Scheme != "" {
+		scheme = base.Scheme
+	}
 
-	return c.Redirect(link.Target, fiber.StatusMovedPermanently)
+	return scheme + "://" + domain + "/" + id
 }
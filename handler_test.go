@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"wormholes/internal/config"
+	"wormholes/internal/links"
+	"wormholes/store"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Link as returned by Get.
+type getResponse struct {
+	links.Link
+	ShortURL string `json:"short_url"`
+}
+
+func (s *testServer) get(t *testing.T, id string) getResponse {
+	t.Helper()
+	var link getResponse
+	decode(t, s.do(t, fiber.MethodGet, "/api/"+id, nil), fiber.StatusOK, &link)
+
+	return link
+}
+
+func TestUpdateInvalidatesCache(t *testing.T) {
+	s := newTestServer(t, nil)
+	id := s.create(t, LinkCreateRequest{Target: "https://example.com/old"})
+
+	if link := s.get(t, id); link.Target != "https://example.com/old" {
+		t.Fatalf("got target %s, want the created one", link.Target)
+	}
+	if !s.redis.Exists(links.Key("", id)) {
+		t.Fatal("link wasn't cached by Get")
+	}
+
+	decode(t, s.do(t, fiber.MethodPost, "/api/"+id, map[string]string{"target": "https://example.com/new"}), fiber.StatusOK, nil)
+	if link := s.get(t, id); link.Target != "https://example.com/new" {
+		t.Errorf("got target %s after updating, want the new one", link.Target)
+	}
+}
+
+func TestDeleteInvalidatesCache(t *testing.T) {
+	s := newTestServer(t, nil)
+	id := s.create(t, LinkCreateRequest{Target: "https://example.com"})
+	s.get(t, id)
+
+	decode(t, s.do(t, fiber.MethodDelete, "/api/"+id, nil), fiber.StatusOK, nil)
+	if s.redis.Exists(links.Key("", id)) {
+		t.Error("deleted link is still cached")
+	}
+	decode(t, s.do(t, fiber.MethodGet, "/api/"+id, nil), fiber.StatusNotFound, nil)
+}
+
+// Wait until clicks on the link id of the default domain are counted.
+func (s *testServer) waitClicks(t *testing.T, id string, clicks int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		counted, err := s.handler.cache.Clicks(links.Key("", id))
+		if err == nil && counted >= clicks {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("counted %d clicks, want %d", counted, clicks)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestExpiredByTime(t *testing.T) {
+	s := newTestServer(t, nil)
+	link := links.New("", "expired", "https://example.com", "")
+	expiresAt := time.Now().Add(-time.Minute)
+	link.ExpiresAt = &expiresAt
+	if _, err := s.backend.Create(context.Background(), []*links.Link{link}); err != nil {
+		t.Fatal(err)
+	}
+
+	decode(t, s.do(t, fiber.MethodGet, "/expired", nil), fiber.StatusGone, nil)
+	decode(t, s.do(t, fiber.MethodGet, "/api/expired", nil), fiber.StatusGone, nil)
+	// expired links are only cached briefly
+	if ttl := s.redis.TTL(links.Key("", "expired")); ttl <= 0 || ttl > s.conf.ExpiredTTL {
+		t.Errorf("expired link is cached for %s, want at most %s", ttl, s.conf.ExpiredTTL)
+	}
+
+	// visitors are sent to EXPIRED_URL if it is set
+	s.handler.config.ExpiredURL = "https://example.com/expired"
+	resp := s.do(t, fiber.MethodGet, "/expired", nil)
+	if resp.StatusCode != fiber.StatusFound || resp.Header.Get(fiber.HeaderLocation) != s.handler.config.ExpiredURL {
+		t.Errorf("got %d to %q, want a redirect to EXPIRED_URL", resp.StatusCode, resp.Header.Get(fiber.HeaderLocation))
+	}
+}
+
+func TestExpiredByClicks(t *testing.T) {
+	s := newTestServer(t, nil)
+	id := s.create(t, LinkCreateRequest{Target: "https://example.com", MaxClicks: 2})
+
+	for clicks := int64(1); clicks <= 2; clicks++ {
+		resp := s.do(t, fiber.MethodGet, "/"+id, nil)
+		if resp.StatusCode != fiber.StatusMovedPermanently {
+			t.Fatalf("got status %d for click %d, want a redirect", resp.StatusCode, clicks)
+		}
+		s.waitClicks(t, id, clicks)
+	}
+
+	decode(t, s.do(t, fiber.MethodGet, "/"+id, nil), fiber.StatusGone, nil)
+}
+
+func TestInvalidTargets(t *testing.T) {
+	s := newTestServer(t, nil)
+	id := s.create(t, LinkCreateRequest{Target: "https://example.com"})
+
+	for _, target := range []string{"example.com", "javascript:alert(1)", "https://exa mple.com/%zz", ""} {
+		decode(t, s.do(t, fiber.MethodPut, "/api/", LinkCreateRequest{Target: target}), fiber.StatusBadRequest, nil)
+		decode(t, s.do(t, fiber.MethodPost, "/api/"+id, map[string]string{"target": target}), fiber.StatusBadRequest, nil)
+	}
+	if link := s.get(t, id); link.Target != "https://example.com" {
+		t.Errorf("target changed to %s by invalid updates", link.Target)
+	}
+}
+
+func TestPartialUpdate(t *testing.T) {
+	s := newTestServer(t, nil)
+	id := s.create(t, LinkCreateRequest{Target: "https://example.com/old", Tag: "old", MaxClicks: 5})
+
+	decode(t, s.do(t, fiber.MethodPost, "/api/"+id, map[string]string{"target": "https://example.com/new"}), fiber.StatusOK, nil)
+	link := s.get(t, id)
+	if link.Target != "https://example.com/new" || link.Tag != "old" || link.MaxClicks != 5 {
+		t.Errorf("got %+v after updating the target, want only the target changed", link.Link)
+	}
+
+	decode(t, s.do(t, fiber.MethodPost, "/api/"+id, map[string]string{"tag": "new"}), fiber.StatusOK, nil)
+	link = s.get(t, id)
+	if link.Target != "https://example.com/new" || link.Tag != "new" || link.MaxClicks != 5 {
+		t.Errorf("got %+v after updating the tag, want only the tag changed", link.Link)
+	}
+
+	var body struct {
+		Error APIError `json:"error"`
+	}
+	decode(t, s.do(t, fiber.MethodPost, "/api/"+id, map[string]string{"id": "renamed"}), fiber.StatusBadRequest, &body)
+	if body.Error.Code != errIDChange.Code {
+		t.Errorf("got code %s for changing the id, want %s", body.Error.Code, errIDChange.Code)
+	}
+	// the same id isn't a change
+	decode(t, s.do(t, fiber.MethodPost, "/api/"+id, map[string]string{"id": id}), fiber.StatusOK, nil)
+
+	decode(t, s.do(t, fiber.MethodPost, "/api/missing", map[string]string{"tag": "new"}), fiber.StatusNotFound, nil)
+}
+
+func TestCaseInsensitiveIDs(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.CaseInsensitive = true
+		conf.Alphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+		conf.SoftDelete = true
+	})
+	id := s.create(t, LinkCreateRequest{Target: "https://example.com/old"})
+	upper := strings.ToUpper(id)
+
+	resp := s.do(t, fiber.MethodGet, "/"+upper, nil)
+	if resp.StatusCode != fiber.StatusMovedPermanently {
+		t.Errorf("got status %d redirecting %s, want a redirect", resp.StatusCode, upper)
+	}
+	decode(t, s.do(t, fiber.MethodPost, "/api/"+upper, map[string]string{"id": upper, "target": "https://example.com/new"}),
+		fiber.StatusOK, nil)
+	if link := s.get(t, upper); link.ID != id || link.Target != "https://example.com/new" {
+		t.Errorf("got %s to %s, want %s updated through %s", link.ID, link.Target, id, upper)
+	}
+	decode(t, s.do(t, fiber.MethodGet, "/api/"+upper+"/stats", nil), fiber.StatusOK, nil)
+
+	decode(t, s.do(t, fiber.MethodDelete, "/api/"+upper, nil), fiber.StatusOK, nil)
+	decode(t, s.do(t, fiber.MethodGet, "/api/"+id, nil), fiber.StatusNotFound, nil)
+	decode(t, s.do(t, fiber.MethodPost, "/api/"+upper+"/restore", nil), fiber.StatusOK, nil)
+
+	var renamed map[string]string
+	decode(t, s.do(t, fiber.MethodPost, "/api/"+upper+"/rename", LinkRenameRequest{ID: "renamed"}), fiber.StatusOK, &renamed)
+	if link := s.get(t, "RENAMED"); link.Target != "https://example.com/new" {
+		t.Errorf("renamed link has target %s", link.Target)
+	}
+
+	var result LinkDeleteResult
+	decode(t, s.do(t, fiber.MethodPost, "/api/batch/delete", []string{"Renamed"}), fiber.StatusOK, &result)
+	if len(result.Deleted) != 1 || len(result.NotFound) != 0 {
+		t.Errorf("got %+v deleting a batch in the wrong case, want the link deleted", result)
+	}
+}
+
+func TestDeleteBatchInvalidatesCache(t *testing.T) {
+	s := newTestServer(t, nil)
+	deleted := []string{
+		s.create(t, LinkCreateRequest{Target: "https://example.com/1"}),
+		s.create(t, LinkCreateRequest{Target: "https://example.com/2"}),
+	}
+	kept := s.create(t, LinkCreateRequest{Target: "https://example.com/3"})
+	for _, id := range append(deleted, kept) {
+		s.get(t, id)
+	}
+
+	var result LinkDeleteResult
+	decode(t, s.do(t, fiber.MethodPost, "/api/batch/delete", append(deleted, "missing")), fiber.StatusOK, &result)
+	if len(result.Deleted) != 2 || len(result.NotFound) != 1 {
+		t.Fatalf("got %+v, want 2 links deleted and 1 not found", result)
+	}
+	for _, id := range deleted {
+		if s.redis.Exists(links.Key("", id)) {
+			t.Errorf("deleted link %s is still cached", id)
+		}
+		decode(t, s.do(t, fiber.MethodGet, "/"+id, nil), fiber.StatusNotFound, nil)
+	}
+	if !s.redis.Exists(links.Key("", kept)) {
+		t.Errorf("link %s wasn't deleted but was evicted from the cache", kept)
+	}
+}
+
+// Store counting the links looked up or deleted.
+type countingStore struct {
+	store.Store
+	lookups atomic.Int64
+}
+
+func (s *countingStore) Get(ctx context.Context, domain, id string) (links.Link, error) {
+	s.lookups.Add(1)
+
+	return s.Store.Get(ctx, domain, id)
+}
+
+func (s *countingStore) Delete(ctx context.Context, domain, id, owner string) error {
+	s.lookups.Add(1)
+
+	return s.Store.Delete(ctx, domain, id, owner)
+}
+
+func TestRejectedIDs(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.StrictIDs = true
+		// of the alphabet, only the blacklist tells it from an ID
+		conf.Blacklist = append(conf.Blacklist, "wp-admin")
+	})
+	backend := &countingStore{Store: s.backend}
+	s.handler.backend = backend
+
+	rejected := testutil.ToFloat64(rejectedIDs)
+	commands := s.redis.Commands()
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{fiber.MethodGet, "/wp-admin"},
+		{fiber.MethodGet, "/.env"},
+		{fiber.MethodGet, "/abc"},
+		{fiber.MethodGet, "/" + strings.Repeat("a", 22)},
+		{fiber.MethodGet, "/api/.env"},
+		{fiber.MethodDelete, "/api/wp-admin"},
+	}
+	for _, req := range requests {
+		resp := s.do(t, req.method, req.path, nil)
+		if resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("%s %s: got status %d, want %d", req.method, req.path, resp.StatusCode, fiber.StatusNotFound)
+		}
+	}
+
+	if got := testutil.ToFloat64(rejectedIDs) - rejected; got != float64(len(requests)) {
+		t.Errorf("rejected %v IDs, want %d", got, len(requests))
+	}
+	if lookups := backend.lookups.Load(); lookups > 0 {
+		t.Errorf("looked up %d rejected IDs in the store, want none", lookups)
+	}
+	if sent := s.redis.Commands() - commands; sent > 0 {
+		t.Errorf("sent %d commands to Redis for rejected IDs, want none", sent)
+	}
+}
+
+func TestFailedCreateRecyclesID(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.Secret = "secret"
+	})
+	// handed out before any ID of the generator
+	s.handler.store.Recycle("recycled")
+
+	// fails past getting an ID, a password too long for bcrypt
+	var body struct {
+		Error APIError `json:"error"`
+	}
+	failing := LinkCreateRequest{Target: "https://example.com", Password: strings.Repeat("a", 100)}
+	decode(t, s.do(t, fiber.MethodPut, "/api/", failing), fiber.StatusBadRequest, &body)
+	if body.Error.Code != errInvalidPass.Code {
+		t.Fatalf("got code %s, want %s", body.Error.Code, errInvalidPass.Code)
+	}
+
+	if id := s.create(t, LinkCreateRequest{Target: "https://example.com"}); id != "recycled" {
+		t.Errorf("got ID %s after a failed create, want its ID recycled", id)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"google.golang.org/grpc/connectivity"
+)
+
+const checkTimeout = time.Second
+
+// Liveness, the process is up.
+func (h *Handler) Healthz(ctx *fiber.Ctx) error {
+	return ctx.Status(fiber.StatusOK).JSON(fiber.Map{"status": "ok"})
+}
+
+// Readiness, Redis, PostgreSQL and the generator are reachable and there are
+// IDs to create links with. Failed checks are listed with 503.
+func (h *Handler) Readyz(ctx *fiber.Ctx) error {
+	c, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	failed := fiber.Map{}
+	if err := h.cache.Ping(c); err != nil {
+		failed["redis"] = err.Error()
+	}
+	if err := h.backend.Ping(c); err != nil {
+		failed["postgres"] = err.Error()
+	}
+	// an idle connection reconnects on the next fetch
+	if state := h.store.State(); state != connectivity.Ready && state != connectivity.Idle {
+		failed["generator"] = state.String()
+	}
+	if h.store.Available() == 0 {
+		failed["ids"] = "none available"
+	}
+
+	if len(failed) > 0 {
+		return ctx.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"status": "unavailable",
+			"failed": failed,
+		})
+	}
+
+	return ctx.Status(fiber.StatusOK).JSON(fiber.Map{"status": "ok"})
+}
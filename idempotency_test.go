@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"wormholes/internal/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Links in the store once those pushed so far are ingested.
+func (s *testServer) stored(t *testing.T) int {
+	t.Helper()
+	time.Sleep(5 * s.conf.IngestInterval)
+	list, err := s.backend.List(context.Background(), "", "", "", MaxListLimit, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(list)
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	s := newTestServer(t, nil)
+	req := LinkCreateRequest{Target: "https://example.com"}
+
+	var first, second, other map[string]string
+	decode(t, s.do(t, fiber.MethodPut, "/api/", req, IdempotencyKey, "retry"), fiber.StatusOK, &first)
+	decode(t, s.do(t, fiber.MethodPut, "/api/", req, IdempotencyKey, "retry"), fiber.StatusOK, &second)
+	if second["id"] != first["id"] || second["short_url"] != first["short_url"] {
+		t.Errorf("retry got %v, want the first response %v", second, first)
+	}
+	decode(t, s.do(t, fiber.MethodPut, "/api/", req, IdempotencyKey, "other"), fiber.StatusOK, &other)
+	if other["id"] == first["id"] {
+		t.Error("another key got the response of the first one")
+	}
+	if n := s.stored(t); n != 2 {
+		t.Errorf("created %d links, want one for each key", n)
+	}
+
+	// failed requests don't hold their key
+	decode(t, s.do(t, fiber.MethodPut, "/api/", LinkCreateRequest{Target: "invalid"}, IdempotencyKey, "fixed"), fiber.StatusBadRequest, nil)
+	decode(t, s.do(t, fiber.MethodPut, "/api/", req, IdempotencyKey, "fixed"), fiber.StatusOK, nil)
+}
+
+func TestIdempotencyRace(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	const n = 8
+	ids := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(fiber.MethodPut, "/api/", strings.NewReader(`{"target":"https://example.com"}`))
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			req.Header.Set(IdempotencyKey, "race")
+			resp, err := s.app.Test(req, 10_000)
+			if err != nil {
+				t.Error(err)
+
+				return
+			}
+			defer resp.Body.Close()
+			var created map[string]string
+			if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || resp.StatusCode != fiber.StatusOK {
+				t.Errorf("got status %d, %v", resp.StatusCode, err)
+			}
+			ids[i] = created["id"]
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Fatalf("concurrent requests with a key got ids %v, want one", ids)
+		}
+	}
+	if n := s.stored(t); n != 1 {
+		t.Errorf("created %d links, want 1", n)
+	}
+}
+
+func TestIdempotencyScopedByKey(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.APIKeys = []string{"alice:alice-secret-0123456789", "bob:bob-secret-0123456789"}
+	})
+	req := LinkCreateRequest{Target: "https://example.com"}
+
+	var alice, bob, again map[string]string
+	decode(t, s.do(t, fiber.MethodPut, "/api/", req, IdempotencyKey, "shared", APIKeyHeader, "alice-secret-0123456789"),
+		fiber.StatusOK, &alice)
+	decode(t, s.do(t, fiber.MethodPut, "/api/", req, IdempotencyKey, "shared", APIKeyHeader, "bob-secret-0123456789"),
+		fiber.StatusOK, &bob)
+	if bob["id"] == alice["id"] {
+		t.Error("a key replayed the response to another key")
+	}
+	decode(t, s.do(t, fiber.MethodPut, "/api/", req, IdempotencyKey, "shared", APIKeyHeader, "alice-secret-0123456789"),
+		fiber.StatusOK, &again)
+	if again["id"] != alice["id"] {
+		t.Errorf("retry got id %s, want %s", again["id"], alice["id"])
+	}
+}
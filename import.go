@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"wormholes/internal/idgen"
+	"wormholes/internal/links"
+	"wormholes/ipc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// streamed, requests to this path may exceed the body limit
+	ImportPath = "/api/import"
+	// rows with errors beyond this are only counted
+	maxImportErrors = 1000
+)
+
+// A row of an import that wasn't imported.
+type ImportError struct {
+	Row  int    `json:"row"`
+	ID   string `json:"id,omitempty"`
+	Code string `json:"code"`
+}
+
+type ImportResult struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"`
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors"`
+}
+
+// Import links with their existing IDs from a CSV of id,target,tag read as
+// it is streamed. IDs are registered with the generator so they are never
+// generated, repeated IDs in the file are skipped.
+func (h *Handler) Import(ctx *fiber.Ctx) error {
+	domain, err := h.domain(ctx)
+	if err != nil {
+		return err
+	}
+
+	alphabet := h.config.Alphabet
+	if alphabet == "" {
+		alphabet = idgen.DefaultAlphabet
+	}
+
+	body := ctx.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(ctx.Body())
+	}
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	result := ImportResult{Errors: []ImportError{}}
+	fail := func(row int, id, code string) {
+		result.Failed++
+		if len(result.Errors) < maxImportErrors {
+			result.Errors = append(result.Errors, ImportError{row, id, code})
+		}
+	}
+
+	owner := keyID(ctx)
+	seen := make(map[string]bool)
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				// the body can't be read any further
+				requestLog(ctx).Error().Err(err).Msg("import: failed to read body")
+				fail(row, "", errInvalidBody.Code)
+
+				break
+			}
+			fail(row, "", errInvalidBody.Code)
+
+			continue
+		}
+		if row == 1 && len(record) > 0 && record[0] == "id" {
+			continue
+		}
+		if len(record) < 2 || len(record) > 3 {
+			fail(row, "", errInvalidBody.Code)
+
+			continue
+		}
+
+		id := record[0]
+		if !idgen.Valid(id, alphabet, ipc.MinIDSize, ipc.MaxIDSize) || h.blacklist.Match(id) {
+			fail(row, id, errInvalidAlias.Code)
+
+			continue
+		}
+		if seen[id] {
+			requestLog(ctx).Warn().Msgf("import: skipping repeated id %s on row %d", id, row)
+			result.Skipped++
+			if len(result.Errors) < maxImportErrors {
+				result.Errors = append(result.Errors, ImportError{row, id, "duplicate"})
+			}
+
+			continue
+		}
+
+		target, err := links.NormalizeTarget(record[1], h.config.TargetSchemes, h.config.AddScheme, h.config.MaxTargetLength)
+		if err != nil {
+			fail(row, id, targetError(err).Code)
+
+			continue
+		}
+		tag := ""
+		if len(record) == 3 {
+			tag = record[2]
+		}
+
+		if err := h.store.Register(ctx.UserContext(), domain, id); err != nil {
+			if err == ipc.ErrIDTaken {
+				fail(row, id, errAliasTaken.Code)
+
+				continue
+			}
+			requestLog(ctx).Error().Err(err).Msg("import: failed to register id")
+			fail(row, id, errInternal.Code)
+
+			continue
+		}
+		// fields share memory with their row, keep only the id
+		id = string([]byte(id))
+		seen[id] = true
+
+		link := links.New(domain, id, target, tag)
+		link.Owner = owner
+		if err := h.ingestor.Push(link); err != nil {
+			fail(row, id, errUnavailable.Code)
+
+			break
+		}
+		result.Imported++
+	}
+
+	requestLog(ctx).Info().Msgf("import: imported %d links, skipped %d, failed %d", result.Imported, result.Skipped, result.Failed)
+
+	return ctx.Status(fiber.StatusOK).JSON(result)
+}
+
+// Only imports may exceed BODY_LIMIT, their bodies are streamed. Other
+// bodies larger than the limit are read as if they weren't streamed, and
+// rejected as soon as they are known to exceed it.
+func limitBody(limit int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Path() == ImportPath {
+			return c.Next()
+		}
+		if c.Request().Header.ContentLength() > limit {
+			return errBodyTooLarge
+		}
+
+		stream := c.Context().RequestBodyStream()
+		if stream == nil {
+			// read before the handler, without a length
+			if len(c.Request().Body()) > limit {
+				return errBodyTooLarge
+			}
+
+			return c.Next()
+		}
+
+		body, err := io.ReadAll(io.LimitReader(stream, int64(limit)+1))
+		if err != nil {
+			return errInvalidBody
+		}
+		if len(body) > limit {
+			return errBodyTooLarge
+		}
+		c.Request().SetBody(body)
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,70 @@
+package ingestor
+
+import (
+	"context"
+	"log"
+	"time"
+	"wormholes/internal/cache"
+	"wormholes/store"
+)
+
+// Periodically moves click counts from cache to the database, so that
+// redirects never wait on a database write.
+type ClickFlusher struct {
+	store    store.Store
+	cache    *cache.Cache
+	interval time.Duration
+}
+
+func NewClickFlusher(backend store.Store, cache *cache.Cache, interval time.Duration) *ClickFlusher {
+	return &ClickFlusher{
+		store:    backend,
+		cache:    cache,
+		interval: interval,
+	}
+}
+
+func (c *ClickFlusher) Start() *ClickFlusher {
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			c.flush()
+		}
+	}()
+
+	return c
+}
+
+func (c *ClickFlusher) flush() {
+	clicks, err := c.cache.PopClicks()
+	if err != nil {
+		log.Printf("error reading clicks : %v", err)
+	}
+	if len(clicks) == 0 {
+		return
+	}
+
+	// counted by link key
+	err = c.store.AddClicks(context.Background(), clicks)
+	if err != nil {
+		log.Printf("error flushing clicks : %v", err)
+
+		// put them back to retry on the next tick
+		for id, count := range clicks {
+			if err := c.cache.AddClicks(id, count); err != nil {
+				log.Printf("error restoring clicks for %s : %v", id, err)
+			}
+		}
+
+		return
+	}
+
+	// cached links carry flushed clicks, refresh them
+	for id := range clicks {
+		if err := c.cache.DeleteLink(id); err != nil {
+			log.Printf("error invalidating %s : %v", id, err)
+		}
+	}
+}
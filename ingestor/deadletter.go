@@ -0,0 +1,47 @@
+package ingestor
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+	"wormholes/internal/links"
+)
+
+// A link that could not be written, with the password hash that links leave
+// out of JSON.
+type deadLink struct {
+	*links.Link
+	PasswordHash string    `json:"passwordHash,omitempty"`
+	Error        string    `json:"error"`
+	Time         time.Time `json:"time"`
+}
+
+// Append link as a JSON line to the dead letter file, or only log it when
+// there is none.
+func (i *Ingestor) bury(link *links.Link, cause error) {
+	ingestDeadLetters.Inc()
+
+	line, err := json.Marshal(deadLink{link, link.PasswordHash, cause.Error(), time.Now()})
+	if err != nil {
+		log.Printf("error encoding dead link %s : %v", link.ID, err)
+
+		return
+	}
+	if i.deadLetter == "" {
+		log.Printf("dead link : %s", line)
+
+		return
+	}
+
+	file, err := os.OpenFile(i.deadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err == nil {
+		_, err = file.Write(append(line, '\n'))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Printf("error writing dead link %s : %v", line, err)
+	}
+}
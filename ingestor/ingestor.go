@@ -2,59 +2,155 @@ package ingestor
 
 import (
 	"context"
+	"errors"
 	"log"
+	"sync"
 	"time"
 	"wormholes/internal/links"
+	"wormholes/internal/tracing"
+	"wormholes/store"
 
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	TickerInterval = time.Second * 10
+	// attempts to write a batch, waiting retryBackOff before the first retry
+	// and doubling it for each next one.
+	maxTries     = 3
+	retryBackOff = time.Second
 )
 
-// SQL Queries
-const (
-	Insert = "insert into links (id, tag, target) values ($1, $2, $3);"
+var (
+	ErrClosed   = errors.New("ingestor: shut down")
+	ErrConflict = errors.New("ingestor: id belongs to another link")
+)
+
+var (
+	ingestDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "wormholes_ingest_buffer_depth",
+		Help: "Number of links waiting to be written.",
+	})
+	ingestBatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wormholes_ingest_batches_total",
+		Help: "Number of link batches written.",
+	})
+	ingestRows = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wormholes_ingest_rows_total",
+		Help: "Number of links written.",
+	})
+	ingestErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wormholes_ingest_errors_total",
+		Help: "Number of link batches that failed to be written after retries.",
+	})
+	ingestDeadLetters = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wormholes_ingest_dead_letters_total",
+		Help: "Number of links that could not be written and went to the dead letter file.",
+	})
+	ingestConflicts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wormholes_ingest_conflicts_total",
+		Help: "Number of links not written because their ID belongs to a stored link.",
+	})
+	ingestReassigned = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wormholes_ingest_reassigned_total",
+		Help: "Number of links written under a new ID as theirs belongs to a stored link.",
+	})
+	ingestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "wormholes_ingest_flush_duration_seconds",
+		Help:    "Time taken to write a batch of links.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
 )
 
-// A simple link ingestor.
+// A simple link ingestor. Links are written in batches of batchSize, or
+// after interval once the first link of a batch is pushed. Failed batches are
+// retried, links that still can't be written go to the dead letter file.
 type Ingestor struct {
-	db        *pgxpool.Pool
-	batchSize int
-	batch     *pgx.Batch
-	quit      chan struct{}
-	source    chan *links.Link
-	ticker    *time.Ticker
+	store      store.Store
+	batchSize  int
+	interval   time.Duration
+	deadLetter string
+	// wait before the first retry of a failed batch
+	backOff time.Duration
+	// receives the context of Shutdown, done is closed once it is handled.
+	quit   chan context.Context
+	done   chan struct{}
+	source chan *links.Link
+	timer  *time.Timer
+	// held for reading while pushing, closed is set once shutting down.
+	mutex  sync.RWMutex
+	closed bool
+	// links waiting to be written.
+	pending    []*links.Link
+	notify     []func([]*links.Link)
+	onConflict []func(*links.Link)
+	// new IDs for links whose ID is taken
+	reassign func() (string, error)
 }
 
-func New(db *pgxpool.Pool, batchSize int) *Ingestor {
+func New(backend store.Store, batchSize int, interval time.Duration, deadLetter string) *Ingestor {
+	// armed by the first link of a batch
+	timer := time.NewTimer(interval)
+	timer.Stop()
+
 	return &Ingestor{
-		db:        db,
-		batchSize: batchSize,
-		batch:     &pgx.Batch{},
-		quit:      make(chan struct{}),
-		source:    make(chan *links.Link),
-		ticker:    time.NewTicker(TickerInterval),
+		store:      backend,
+		batchSize:  batchSize,
+		interval:   interval,
+		deadLetter: deadLetter,
+		backOff:    retryBackOff,
+		quit:       make(chan context.Context),
+		done:       make(chan struct{}),
+		source:     make(chan *links.Link),
+		timer:      timer,
 	}
 }
 
+// Call fn with links once they are inserted, from the ingesting goroutine,
+// after any fn set before it. It must be set before Start.
+func (i *Ingestor) Notify(fn func([]*links.Link)) *Ingestor {
+	i.notify = append(i.notify, fn)
+
+	return i
+}
+
+// Call fn with links whose ID is taken, before they are given a new one,
+// from the ingesting goroutine. It must be set before Start.
+func (i *Ingestor) OnConflict(fn func(*links.Link)) *Ingestor {
+	i.onConflict = append(i.onConflict, fn)
+
+	return i
+}
+
+// Write links whose ID is taken under a new ID from next rather than
+// burying them, from the ingesting goroutine. It must be set before Start.
+func (i *Ingestor) Reassign(next func() (string, error)) *Ingestor {
+	i.reassign = next
+
+	return i
+}
+
 func (i *Ingestor) Start() *Ingestor {
 	go func() {
-		defer i.ticker.Stop()
+		defer i.timer.Stop()
 
 		for {
 			select {
 			case link := <-i.source:
 				i.add(link)
-			case <-i.quit:
-				close(i.source)
+			case ctx := <-i.quit:
+				if len(i.pending) > 0 {
+					i.ingest(ctx)
+				}
+				close(i.done)
 
 				return
-			case <-i.ticker.C:
-				if i.batch.Len() > 0 {
-					i.ingest()
+			case <-i.timer.C:
+				if len(i.pending) > 0 {
+					i.ingest(context.Background())
 				}
 			}
 		}
@@ -63,32 +159,155 @@ func (i *Ingestor) Start() *Ingestor {
 	return i
 }
 
-func (i *Ingestor) Push(link *links.Link) {
+// Push a link to be written, ErrClosed once shutting down.
+func (i *Ingestor) Push(link *links.Link) error {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	if i.closed {
+		return ErrClosed
+	}
+
 	i.source <- link
+
+	return nil
+}
+
+// Shutdown stops accepting links and writes the buffered ones. Links that
+// can't be written before ctx is done go to the dead letter file.
+func (i *Ingestor) Shutdown(ctx context.Context) error {
+	i.mutex.Lock()
+	if i.closed {
+		i.mutex.Unlock()
+
+		return ErrClosed
+	}
+	i.closed = true
+	i.mutex.Unlock()
+
+	i.quit <- ctx
+	<-i.done
+
+	return ctx.Err()
 }
 
 func (i *Ingestor) add(link *links.Link) {
-	i.batch.Queue(
-		Insert,
-		link.ID, link.Tag, link.Target)
+	if len(i.pending) == 0 {
+		i.timer.Reset(i.interval)
+	}
+
+	i.pending = append(i.pending, link)
+	ingestDepth.Set(float64(len(i.pending)))
 
-	if i.batch.Len() > i.batchSize {
-		i.ingest()
+	if len(i.pending) >= i.batchSize {
+		i.ingest(context.Background())
 	}
 }
 
-func (i *Ingestor) ingest() {
-	batchOp := i.db.SendBatch(context.Background(), i.batch)
+func (i *Ingestor) ingest(ctx context.Context) {
+	// written before it fires, drained so the next batch can arm it
+	if !i.timer.Stop() {
+		select {
+		case <-i.timer.C:
+		default:
+		}
+	}
 
-	_, err := batchOp.Exec()
-	if err != nil {
-		log.Printf("error inserting item : %v", err)
+	ctx, span := tracing.Start(ctx, "ingestor.flush",
+		trace.WithAttributes(attribute.Int("rows", len(i.pending))))
+	start := time.Now()
+	conflicts, err := i.store.Create(ctx, i.pending)
+	wait := i.backOff
+	for try := 1; err != nil && try < maxTries && ctx.Err() == nil; try++ {
+		log.Printf("error inserting batch, retrying in %s : %v", wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+		wait *= 2
+		conflicts, err = i.store.Create(ctx, i.pending)
 	}
+	ingestDuration.Observe(time.Since(start).Seconds())
+	tracing.End(span, err)
 
-	err = batchOp.Close()
+	// a batch fails as a whole, find the links that can't be written
+	written := i.pending
+	if err == nil && len(conflicts) > 0 {
+		written = nil
+		for _, link := range i.pending {
+			if conflicts[link] && !i.conflict(ctx, link) {
+				continue
+			}
+			written = append(written, link)
+		}
+	}
 	if err != nil {
-		log.Printf("error closing batch : %v", err)
+		ingestErrors.Inc()
+		log.Printf("error inserting batch, inserting links one by one : %v", err)
+
+		written = nil
+		for _, link := range i.pending {
+			conflicts, err := i.store.Create(ctx, []*links.Link{link})
+			if err != nil {
+				i.bury(link, err)
+
+				continue
+			}
+			if conflicts[link] && !i.conflict(ctx, link) {
+				continue
+			}
+			written = append(written, link)
+		}
+	}
+
+	ingestBatches.Inc()
+	ingestRows.Add(float64(len(written)))
+	if len(written) > 0 {
+		for _, notify := range i.notify {
+			notify(written)
+		}
 	}
 
-	i.batch = &pgx.Batch{}
+	i.pending = nil
+	ingestDepth.Set(0)
+}
+
+// A link whose ID is already stored, which the bloom filter should have
+// prevented. It can happen with a stale snapshot or two generators, and the
+// stored link is kept rather than overwritten. The link is written under a
+// new ID if it can get one, and buried otherwise. Whether it was written.
+func (i *Ingestor) conflict(ctx context.Context, link *links.Link) bool {
+	for try := 1; ; try++ {
+		ingestConflicts.Inc()
+		for _, fn := range i.onConflict {
+			fn(link)
+		}
+		if i.reassign == nil || try > maxTries {
+			log.Printf("error inserting link, id %s is taken on domain %q", link.ID, link.Domain)
+			i.bury(link, ErrConflict)
+
+			return false
+		}
+
+		id, err := i.reassign()
+		if err != nil {
+			log.Printf("error inserting link, id %s is taken on domain %q and no new id : %v", link.ID, link.Domain, err)
+			i.bury(link, ErrConflict)
+
+			return false
+		}
+		log.Printf("error inserting link, id %s is taken on domain %q, writing it as %s", link.ID, link.Domain, id)
+		link.ID = id
+
+		conflicts, err := i.store.Create(ctx, []*links.Link{link})
+		if err != nil {
+			i.bury(link, err)
+
+			return false
+		}
+		if !conflicts[link] {
+			ingestReassigned.Inc()
+
+			return true
+		}
+	}
 }
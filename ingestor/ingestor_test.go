@@ -0,0 +1,292 @@
+package ingestor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"wormholes/internal/links"
+	"wormholes/store"
+)
+
+// Memory store whose writes fail for the first failures calls, and always
+// for links with an ID starting with bad.
+type failingStore struct {
+	*store.MemStore
+	mutex    sync.Mutex
+	failures int
+	calls    int
+}
+
+func (s *failingStore) Create(ctx context.Context, batch []*links.Link) (map[*links.Link]bool, error) {
+	s.mutex.Lock()
+	s.calls++
+	fail := s.calls <= s.failures
+	s.mutex.Unlock()
+	if fail {
+		return nil, errors.New("connection reset")
+	}
+	for _, link := range batch {
+		if strings.HasPrefix(link.ID, "bad") {
+			return nil, errors.New("value too long")
+		}
+	}
+
+	return s.MemStore.Create(ctx, batch)
+}
+
+// Ingestor writing to backend, retrying without waiting long.
+func testIngestor(t *testing.T, backend store.Store, batchSize int, interval time.Duration) (*Ingestor, string) {
+	t.Helper()
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	i := New(backend, batchSize, interval, deadLetter)
+	i.backOff = time.Millisecond
+
+	return i.Start(), deadLetter
+}
+
+func push(t *testing.T, i *Ingestor, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := i.Push(links.New("", id, "https://example.com/"+id, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Links in the dead letter file at path by ID.
+func buried(t *testing.T, path string) map[string]deadLink {
+	t.Helper()
+	dead := make(map[string]deadLink)
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return dead
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		link := deadLink{Link: &links.Link{}}
+		if err := json.Unmarshal(scanner.Bytes(), &link); err != nil {
+			t.Fatalf("invalid dead letter line %s: %v", scanner.Text(), err)
+		}
+		dead[link.ID] = link
+	}
+
+	return dead
+}
+
+func stored(backend store.Store, id string) bool {
+	_, err := backend.Get(context.Background(), "", id)
+
+	return err == nil
+}
+
+func TestFailingStoreLosesNothing(t *testing.T) {
+	// the batch fails every try, then links are written one by one
+	backend := &failingStore{MemStore: store.WithMemory(), failures: maxTries}
+	i, deadLetter := testIngestor(t, backend, 4, time.Hour)
+
+	ids := []string{"good1", "bad1", "good2", "bad2"}
+	push(t, i, ids...)
+	if err := i.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	dead := buried(t, deadLetter)
+	for _, id := range ids {
+		isStored, isDead := stored(backend, id), dead[id].Link != nil
+		if isStored == isDead {
+			t.Errorf("link %s is stored %t and dead %t, want exactly one", id, isStored, isDead)
+		}
+		if strings.HasPrefix(id, "bad") && (!isDead || dead[id].Error != "value too long") {
+			t.Errorf("link %s failing to write isn't dead with its error, %+v", id, dead[id])
+		}
+	}
+}
+
+func TestRetriedBatchIsWritten(t *testing.T) {
+	backend := &failingStore{MemStore: store.WithMemory(), failures: maxTries - 1}
+	i, deadLetter := testIngestor(t, backend, 3, time.Hour)
+
+	push(t, i, "link1", "link2", "link3")
+	if err := i.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"link1", "link2", "link3"} {
+		if !stored(backend, id) {
+			t.Errorf("link %s wasn't written after retries", id)
+		}
+	}
+	if dead := buried(t, deadLetter); len(dead) > 0 {
+		t.Errorf("%d links went to the dead letter file, want none", len(dead))
+	}
+	if backend.calls != maxTries {
+		t.Errorf("wrote %d times, want %d", backend.calls, maxTries)
+	}
+}
+
+func TestShutdownBuriesUnwritten(t *testing.T) {
+	backend := &failingStore{MemStore: store.WithMemory(), failures: 1_000}
+	i, deadLetter := testIngestor(t, backend, 100, time.Hour)
+
+	var ids []string
+	for n := 0; n < 5; n++ {
+		ids = append(ids, fmt.Sprintf("link%d", n))
+	}
+	push(t, i, ids...)
+	protected := links.New("", "locked", "https://example.com", "")
+	protected.PasswordHash = "$2a$10$hash"
+	if err := i.Push(protected); err != nil {
+		t.Fatal(err)
+	}
+
+	// past the deadline, links aren't retried
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := i.Shutdown(ctx); err != context.Canceled {
+		t.Errorf("got %v shutting down past the deadline, want %v", err, context.Canceled)
+	}
+
+	dead := buried(t, deadLetter)
+	for _, id := range ids {
+		if dead[id].Link == nil {
+			t.Errorf("link %s was lost", id)
+		}
+	}
+	if dead["locked"].PasswordHash != protected.PasswordHash {
+		t.Errorf("dead link has password hash %q, want it kept", dead["locked"].PasswordHash)
+	}
+}
+
+func TestShutdownFlushesPending(t *testing.T) {
+	backend := store.WithMemory()
+	// never written by size or interval, only by Shutdown
+	i, deadLetter := testIngestor(t, backend, 100, time.Hour)
+
+	ids := []string{"link1", "link2", "link3"}
+	push(t, i, ids...)
+	for _, id := range ids {
+		if stored(backend, id) {
+			t.Fatalf("link %s was written before shutting down", id)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := i.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if !stored(backend, id) {
+			t.Errorf("link %s wasn't written on shutdown", id)
+		}
+	}
+	if dead := buried(t, deadLetter); len(dead) > 0 {
+		t.Errorf("%d links went to the dead letter file, want none", len(dead))
+	}
+
+	if err := i.Push(links.New("", "late", "https://example.com", "")); err != ErrClosed {
+		t.Errorf("got %v pushing after shutdown, want %v", err, ErrClosed)
+	}
+	if err := i.Shutdown(ctx); err != ErrClosed {
+		t.Errorf("got %v shutting down twice, want %v", err, ErrClosed)
+	}
+}
+
+func TestPushFlushedWithinInterval(t *testing.T) {
+	backend := store.WithMemory()
+	// the batch never fills, only the interval writes it
+	i, _ := testIngestor(t, backend, 1_000, 20*time.Millisecond)
+	defer i.Shutdown(context.Background())
+
+	start := time.Now()
+	push(t, i, "single")
+	for !stored(backend, "single") {
+		if time.Since(start) > time.Second {
+			t.Fatal("link wasn't written within the interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the interval starts again with the next link
+	time.Sleep(50 * time.Millisecond)
+	push(t, i, "later")
+	start = time.Now()
+	for !stored(backend, "later") {
+		if time.Since(start) > time.Second {
+			t.Fatal("link pushed after a flush wasn't written within the interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConflictReassigned(t *testing.T) {
+	backend := store.WithMemory()
+	taken := links.New("", "taken", "https://example.org", "")
+	if _, err := backend.Create(context.Background(), []*links.Link{taken}); err != nil {
+		t.Fatal(err)
+	}
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	var notified []string
+	// the first new ID is taken as well
+	next := []string{"taken", "fresh"}
+	i := New(backend, 1, time.Hour, deadLetter).Notify(func(written []*links.Link) {
+		for _, link := range written {
+			notified = append(notified, link.ID)
+		}
+	}).Reassign(func() (string, error) {
+		id := next[0]
+		next = next[1:]
+
+		return id, nil
+	}).Start()
+
+	push(t, i, "taken")
+	if err := i.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if link, err := backend.Get(context.Background(), "", "taken"); err != nil || link.Target != taken.Target {
+		t.Errorf("got %s, %v for the taken ID, want the stored link kept", link.Target, err)
+	}
+	if link, err := backend.Get(context.Background(), "", "fresh"); err != nil || link.Target != "https://example.com/taken" {
+		t.Errorf("got %s, %v for the new ID, want the conflicting link", link.Target, err)
+	}
+	if len(notified) != 1 || notified[0] != "fresh" {
+		t.Errorf("notified of %v, want the new ID", notified)
+	}
+	if dead := buried(t, deadLetter); len(dead) > 0 {
+		t.Errorf("%d links went to the dead letter file, want none", len(dead))
+	}
+}
+
+func TestConflictWithoutNewID(t *testing.T) {
+	backend := store.WithMemory()
+	if _, err := backend.Create(context.Background(), []*links.Link{links.New("", "taken", "https://example.org", "")}); err != nil {
+		t.Fatal(err)
+	}
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	i := New(backend, 1, time.Hour, deadLetter).Reassign(func() (string, error) {
+		return "", errors.New("no ids")
+	}).Start()
+
+	push(t, i, "taken")
+	if err := i.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dead := buried(t, deadLetter); dead["taken"].Error != ErrConflict.Error() {
+		t.Errorf("got dead link %+v, want it buried with %v", dead["taken"], ErrConflict)
+	}
+}
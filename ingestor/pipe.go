@@ -0,0 +1,159 @@
+package ingestor
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+	"wormholes/internal/geoip"
+	"wormholes/internal/useragent"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const flushTimeout = time.Second * 10
+
+var (
+	clicksIngested = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wormholes_clicks_ingested_total",
+		Help: "Number of click events written to the database.",
+	})
+	clicksDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wormholes_clicks_dropped_total",
+		Help: "Number of click events dropped because the pipe was full or the database failed.",
+	})
+	clickColumns = []string{"domain", "link_id", "created_at", "ip", "user_agent", "country", "city", "asn", "organization", "browser", "os", "device", "bot", "referrer", "variant"}
+)
+
+// A click on a link.
+type Click struct {
+	Domain    string
+	ID        string
+	Time      time.Time
+	IP        net.IP
+	UserAgent string
+	Referrer  string
+	// index of the variant served, -1 for links without variants
+	Variant int
+}
+
+// Enriches clicks with their location, client and referrer and writes them to the clicks table
+// in batches, from multiple streams.
+type Pipe struct {
+	db        *pgxpool.Pool
+	geo       geoip.Reader
+	streams   int
+	batchSize int
+	referrer  string
+	source    chan Click
+	wg        sync.WaitGroup
+}
+
+func NewPipe(db *pgxpool.Pool, geo geoip.Reader, streams, batchSize int, referrer string) *Pipe {
+	return &Pipe{
+		db:        db,
+		geo:       geo,
+		streams:   streams,
+		batchSize: batchSize,
+		referrer:  referrer,
+		source:    make(chan Click, streams*batchSize),
+	}
+}
+
+func (p *Pipe) Start() *Pipe {
+	for i := 0; i < p.streams; i++ {
+		p.wg.Add(1)
+		go p.stream()
+	}
+
+	return p
+}
+
+// Push a click without blocking, it is dropped when the pipe is full.
+func (p *Pipe) Push(click Click) {
+	select {
+	case p.source <- click:
+	default:
+		clicksDropped.Inc()
+	}
+}
+
+// Close stops accepting clicks and waits for queued ones to be written.
+func (p *Pipe) Close() {
+	close(p.source)
+	p.wg.Wait()
+}
+
+func (p *Pipe) stream() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(TickerInterval)
+	defer ticker.Stop()
+
+	batch := make([][]any, 0, p.batchSize)
+	for {
+		select {
+		case click, ok := <-p.source:
+			if !ok {
+				p.flush(batch)
+
+				return
+			}
+
+			batch = append(batch, p.row(click))
+			if len(batch) >= p.batchSize {
+				p.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			p.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (p *Pipe) row(click Click) []any {
+	location := p.geo.Lookup(click.IP)
+	agent := useragent.Parse(click.UserAgent)
+
+	// unparsable addresses are stored as null
+	var ip any
+	if click.IP != nil {
+		ip = click.IP
+	}
+
+	var variant any
+	if click.Variant >= 0 {
+		variant = int32(click.Variant)
+	}
+
+	return []any{
+		click.Domain, click.ID, click.Time, ip, click.UserAgent,
+		location.Country, location.City, int64(location.ASN), location.Organization,
+		agent.Browser, agent.OS, agent.Device, agent.Bot,
+		normalizeReferrer(click.Referrer, p.referrer), variant,
+	}
+}
+
+func (p *Pipe) flush(batch [][]any) {
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	_, err := p.db.CopyFrom(ctx, pgx.Identifier{"clicks"}, clickColumns, pgx.CopyFromRows(batch))
+	if err != nil {
+		log.Printf("error inserting clicks : %v", err)
+		clicksDropped.Add(float64(len(batch)))
+
+		return
+	}
+
+	clicksIngested.Add(float64(len(batch)))
+}
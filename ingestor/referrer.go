@@ -0,0 +1,30 @@
+package ingestor
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Referrer detail kept with clicks.
+const (
+	ReferrerHost = "host"
+	ReferrerPath = "path"
+	// clicks without a usable referrer
+	Direct = "direct"
+)
+
+// Normalize a Referer header to its lowercase host, without www., and with
+// the path if detail is ReferrerPath. Query and fragment are never kept.
+func normalizeReferrer(referer, detail string) string {
+	ref, err := url.Parse(referer)
+	if err != nil || ref.Hostname() == "" {
+		return Direct
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(ref.Hostname()), "www.")
+	if detail != ReferrerPath {
+		return host
+	}
+
+	return host + strings.TrimSuffix(ref.EscapedPath(), "/")
+}
@@ -0,0 +1,72 @@
+package ingestor
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// SQL Queries
+const (
+	DeleteExpired = "delete from links where expires_at <= now() or (max_clicks > 0 and clicks >= max_clicks);"
+	PurgeDeleted  = "delete from links where deleted_at <= now() - make_interval(secs => $1);"
+)
+
+// Periodically deletes expired links and purges links soft deleted for
+// longer than retention.
+type Sweeper struct {
+	db        *pgxpool.Pool
+	interval  time.Duration
+	retention time.Duration
+}
+
+func NewSweeper(db *pgxpool.Pool, interval, retention time.Duration) *Sweeper {
+	return &Sweeper{
+		db:        db,
+		interval:  interval,
+		retention: retention,
+	}
+}
+
+func (s *Sweeper) Start() *Sweeper {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			s.sweep()
+		}
+	}()
+
+	return s
+}
+
+func (s *Sweeper) sweep() {
+	tag, err := s.db.Exec(context.Background(), DeleteExpired)
+	if err != nil {
+		log.Printf("error deleting expired links : %v", err)
+
+		return
+	}
+
+	if tag.RowsAffected() > 0 {
+		log.Printf("deleted %d expired links", tag.RowsAffected())
+	}
+
+	if s.retention <= 0 {
+		return
+	}
+
+	tag, err = s.db.Exec(context.Background(), PurgeDeleted, s.retention.Seconds())
+	if err != nil {
+		log.Printf("error purging deleted links : %v", err)
+
+		return
+	}
+
+	if tag.RowsAffected() > 0 {
+		log.Printf("purged %d deleted links", tag.RowsAffected())
+	}
+}
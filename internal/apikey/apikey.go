@@ -0,0 +1,78 @@
+package apikey
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strings"
+)
+
+const (
+	// Local of requests holding the ID of the key they were authenticated
+	// with.
+	Local = "apiKey"
+	// Keys shorter than this are rejected.
+	MinLength = 16
+)
+
+var (
+	ErrInvalid      = errors.New("apikey: keys must be id:key pairs with unique ids and keys of at least 16 characters")
+	ErrUnknownAdmin = errors.New("apikey: admin is not the id of a key")
+)
+
+// API keys by the SHA-256 of their secret, so secrets are never compared
+// byte by byte.
+type Keys struct {
+	ids map[[sha256.Size]byte]string
+	// IDs of keys managing links of all keys
+	admins map[string]bool
+}
+
+// Parse id:key pairs, keys with an id in admins have the admin scope. The id
+// identifies the key in logs, limits and links it created, the key is the
+// secret sent by clients.
+func Parse(pairs, admins []string) (*Keys, error) {
+	keys := &Keys{
+		ids:    make(map[[sha256.Size]byte]string, len(pairs)),
+		admins: make(map[string]bool, len(admins)),
+	}
+	seen := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		id, secret, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || len(secret) < MinLength || seen[id] {
+			return nil, ErrInvalid
+		}
+		hash := sha256.Sum256([]byte(secret))
+		if _, ok := keys.ids[hash]; ok {
+			return nil, ErrInvalid
+		}
+		seen[id] = true
+		keys.ids[hash] = id
+	}
+	for _, id := range admins {
+		if !seen[id] {
+			return nil, ErrUnknownAdmin
+		}
+		keys.admins[id] = true
+	}
+
+	return keys, nil
+}
+
+// Whether the key with id manages links of all keys.
+func (k *Keys) Admin(id string) bool {
+	return k.admins[id]
+}
+
+// ID of the key with secret, false if there is none.
+func (k *Keys) Lookup(secret string) (string, bool) {
+	if secret == "" {
+		return "", false
+	}
+	id, ok := k.ids[sha256.Sum256([]byte(secret))]
+
+	return id, ok
+}
+
+func (k *Keys) Len() int {
+	return len(k.ids)
+}
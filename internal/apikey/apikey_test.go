@@ -0,0 +1,53 @@
+package apikey
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		pairs  []string
+		admins []string
+		err    error
+	}{
+		{"valid", []string{"a:secret-0123456789", "b:secret-9876543210"}, []string{"b"}, nil},
+		{"no keys", nil, nil, nil},
+		{"missing separator", []string{"secret-0123456789"}, nil, ErrInvalid},
+		{"missing id", []string{":secret-0123456789"}, nil, ErrInvalid},
+		{"short key", []string{"a:short"}, nil, ErrInvalid},
+		{"duplicate id", []string{"a:secret-0123456789", "a:secret-9876543210"}, nil, ErrInvalid},
+		{"duplicate key", []string{"a:secret-0123456789", "b:secret-0123456789"}, nil, ErrInvalid},
+		{"unknown admin", []string{"a:secret-0123456789"}, []string{"b"}, ErrUnknownAdmin},
+	}
+	for _, test := range tests {
+		if _, err := Parse(test.pairs, test.admins); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	keys, err := Parse([]string{"a:secret-0123456789", "b:secret-9876543210"}, []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		secret string
+		id     string
+		ok     bool
+	}{
+		{"secret-0123456789", "a", true},
+		{"secret-9876543210", "b", true},
+		{"", "", false},
+		{"a", "", false},
+		{"secret-012345678", "", false},
+	}
+	for _, test := range tests {
+		if id, ok := keys.Lookup(test.secret); id != test.id || ok != test.ok {
+			t.Errorf("%q: got %q, %t, want %q, %t", test.secret, id, ok, test.id, test.ok)
+		}
+	}
+	if keys.Admin("a") || !keys.Admin("b") || keys.Admin("") {
+		t.Error("only b should be an admin")
+	}
+}
@@ -0,0 +1,55 @@
+package blacklist
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Reserved words and patterns that generated IDs must not match.
+type Blacklist struct {
+	words    map[string]struct{}
+	patterns []*regexp.Regexp
+}
+
+// Create a blacklist from exact words and regular expressions. Both are
+// matched case insensitively.
+func New(words, patterns []string) (*Blacklist, error) {
+	b := &Blacklist{
+		words: make(map[string]struct{}, len(words)),
+	}
+
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			b.words[strings.ToLower(word)] = struct{}{}
+		}
+	}
+
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("blacklist: invalid pattern %q: %w", pattern, err)
+		}
+		b.patterns = append(b.patterns, re)
+	}
+
+	return b, nil
+}
+
+// Match reports whether id is a reserved word or matches any pattern.
+func (b *Blacklist) Match(id string) bool {
+	if _, ok := b.words[strings.ToLower(id)]; ok {
+		return true
+	}
+
+	for _, re := range b.patterns {
+		if re.MatchString(id) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,35 @@
+package blacklist
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	b, err := New([]string{"admin", " login "}, []string{"^api", "f+u"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"admin", true},
+		{"ADMIN", true},
+		{"login", true},
+		{"admins", false},
+		{"apiKey1", true},
+		{"myapi", false},
+		{"xFFUx", true},
+		{"abc123", false},
+	}
+	for _, tt := range tests {
+		if got := b.Match(tt.id); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidPattern(t *testing.T) {
+	if _, err := New(nil, []string{"("}); err == nil {
+		t.Error("accepted an invalid pattern")
+	}
+}
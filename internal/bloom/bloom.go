@@ -1,6 +1,13 @@
 package bloom
 
 import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/bits-and-blooms/bloom/v3"
@@ -10,36 +17,448 @@ import (
 
 const (
 	ByteSize = 8
+	// Number of independent filters ids are spread over, each with its own
+	// lock, so that concurrent adds rarely wait on each other.
+	Shards = 16
+	// Each new stage of a scalable filter gets this fraction of the error
+	// rate of the previous one, so that the compounded rate stays below the
+	// configured one.
+	TighteningRatio = 0.5
+	// magic bytes identifying a bloom snapshot file.
+	snapshotMagic uint32 = 0x77686267
 )
 
-// A thread safe wrapper around bloom filter with backup and restore.
+var (
+	ErrBadSnapshot  = errors.New("bloom: invalid snapshot")
+	ErrIncompatible = errors.New("bloom: filters differ in limit, error rate, growth or shards")
+)
+
+// A thread safe bloom filter with backup and restore, sharded by id so that
+// each shard is locked on its own. When created with NewScalableBloom, a shard
+// chains a new larger filter stage every time its newest one reaches its
+// capacity.
 type Bloom struct {
-	bloom *bloom.BloomFilter
-	mutex sync.RWMutex
+	shards    []*shard
+	maxLimit  uint
+	errorRate float64
+	growth    uint
+}
+
+type shard struct {
+	stages []*stage
+	mutex  sync.RWMutex
+	count  uint64
+}
+
+type stage struct {
+	filter *bloom.BloomFilter
+	limit  uint
+	count  uint64
+}
+
+// Point in time statistics of a bloom filter.
+type Stats struct {
+	Count             uint64  `json:"count"`
+	Capacity          uint64  `json:"capacity"`
+	FalsePositiveRate float64 `json:"falsePositiveRate"`
+	FillRatio         float64 `json:"fillRatio"`
 }
 
+// snapshot header, written before the shards.
+type header struct {
+	Magic     uint32
+	MaxLimit  uint64
+	ErrorRate uint64
+	Growth    uint64
+	Shards    uint64
+}
+
+// shard header, written before its stages.
+type shardHeader struct {
+	Count  uint64
+	Stages uint64
+}
+
+// stage header, written before each bit array.
+type stageHeader struct {
+	Limit uint64
+	Count uint64
+}
+
+// Create a fixed size bloom filter.
 func New(maxLimit uint, errorRate float64) *Bloom {
 	b := &Bloom{
-		bloom: bloom.NewWithEstimates(maxLimit, errorRate),
-		mutex: sync.RWMutex{},
+		maxLimit:  maxLimit,
+		errorRate: errorRate,
 	}
+	b.init()
 
-	log.Info().Msgf("bloom-filter: size %s", humanize.Bytes(uint64(b.bloom.Cap()/ByteSize)))
 	log.Info().Msgf("bloom-filter: limit %s", humanize.Comma(int64(maxLimit)))
 	log.Info().Msgf("bloom-filter: errorRate %f", errorRate)
+	log.Info().Msgf("bloom-filter: %d shards of size %s", Shards, humanize.Bytes(b.sizeBytes()))
+
+	return b
+}
+
+// Create a bloom filter that starts with initial capacity and grows by the
+// given factor whenever it fills up, keeping the false positive rate near
+// errorRate.
+func NewScalableBloom(initial uint, errorRate float64, growth uint) *Bloom {
+	if growth < 2 {
+		growth = 2
+	}
+
+	b := &Bloom{
+		maxLimit:  initial,
+		errorRate: errorRate,
+		growth:    growth,
+	}
+	b.init()
+
+	log.Info().Msgf("bloom-filter: scalable, initial limit %s", humanize.Comma(int64(initial)))
+	log.Info().Msgf("bloom-filter: errorRate %f, growth %dx", errorRate, growth)
+	log.Info().Msgf("bloom-filter: %d shards of size %s", Shards, humanize.Bytes(b.sizeBytes()))
 
 	return b
 }
 
+// create every shard with its first stage.
+func (b *Bloom) init() {
+	b.shards = make([]*shard, Shards)
+	for i := range b.shards {
+		b.shards[i] = &shard{}
+		b.grow(b.shards[i])
+	}
+}
+
+// size of the first stage of a shard in bytes.
+func (b *Bloom) sizeBytes() uint64 {
+	return uint64(b.shards[0].stages[0].filter.Cap() / ByteSize)
+}
+
+// shard an id belongs to, by its FNV-1a hash.
+func (b *Bloom) shard(id []byte) *shard {
+	hash := uint32(2166136261)
+	for _, c := range id {
+		hash ^= uint32(c)
+		hash *= 16777619
+	}
+
+	return b.shards[hash%uint32(len(b.shards))]
+}
+
+// limit and error rate of the stage at index i of a shard. Every id is
+// tested against one shard only, so shards keep the error rate of the whole
+// filter with their part of the limit.
+func (b *Bloom) stageParams(i int) (uint, float64) {
+	shardLimit := (b.maxLimit + Shards - 1) / Shards
+	if b.growth == 0 {
+		return shardLimit, b.errorRate
+	}
+
+	limit := float64(shardLimit) * math.Pow(float64(b.growth), float64(i))
+	errorRate := b.errorRate * (1 - TighteningRatio) * math.Pow(TighteningRatio, float64(i))
+
+	return uint(limit), errorRate
+}
+
+// append a new stage to s, must be called with its lock held.
+func (b *Bloom) grow(s *shard) {
+	limit, errorRate := b.stageParams(len(s.stages))
+	s.stages = append(s.stages, &stage{filter: bloom.NewWithEstimates(limit, errorRate), limit: limit})
+
+	if len(s.stages) > 1 {
+		log.Info().Msgf("bloom-filter: shard grew to stage %d of size %s",
+			len(s.stages), humanize.Bytes(uint64(s.stages[len(s.stages)-1].filter.Cap()/ByteSize)))
+	}
+}
+
+// add id to s, must be called with its lock held.
+func (b *Bloom) add(s *shard, id []byte) {
+	last := s.stages[len(s.stages)-1]
+	if b.growth > 0 && last.count >= uint64(last.limit) {
+		b.grow(s)
+		last = s.stages[len(s.stages)-1]
+	}
+
+	last.filter.Add(id)
+	last.count++
+	s.count++
+}
+
+func (s *shard) test(id []byte) bool {
+	for _, st := range s.stages {
+		if st.filter.Test(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (b *Bloom) Add(id []byte) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-	b.bloom.Add(id)
+	s := b.shard(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b.add(s, id)
+}
+
+// AddIfAbsent adds id unless it already exists, reporting whether it was added.
+func (b *Bloom) AddIfAbsent(id []byte) bool {
+	s := b.shard(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.test(id) {
+		return false
+	}
+	b.add(s, id)
+
+	return true
 }
 
 func (b *Bloom) Exists(id []byte) bool {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
+	s := b.shard(id)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.test(id)
+}
+
+// Count of ids added to the filter so far.
+func (b *Bloom) Count() uint64 {
+	var count uint64
+	for _, s := range b.shards {
+		s.mutex.RLock()
+		count += s.count
+		s.mutex.RUnlock()
+	}
+
+	return count
+}
+
+// Stats estimates the current false positive rate and the fraction of bits
+// set, from the number of ids added to each stage. The false positive rate
+// is the average of the shards, ids being spread evenly over them.
+func (b *Bloom) Stats() Stats {
+	var stats Stats
+	var falsePositive, setBits, totalBits float64
+
+	for _, s := range b.shards {
+		s.mutex.RLock()
+		stats.Count += s.count
+		notFalsePositive := 1.0
+		for _, st := range s.stages {
+			m := float64(st.filter.Cap())
+			k := float64(st.filter.K())
+			fill := 1 - math.Exp(-k*float64(st.count)/m)
+
+			stats.Capacity += uint64(st.limit)
+			notFalsePositive *= 1 - math.Pow(fill, k)
+			setBits += fill * m
+			totalBits += m
+		}
+		s.mutex.RUnlock()
+		falsePositive += 1 - notFalsePositive
+	}
+
+	stats.FalsePositiveRate = falsePositive / float64(len(b.shards))
+	if totalBits > 0 {
+		stats.FillRatio = setBits / totalBits
+	}
+
+	return stats
+}
+
+// Merge adds all ids of other to b, e.g. to combine snapshots of generators
+// of different partitions. Both must have been created with the same limit,
+// error rate and growth. Stages of a shard are merged by their position, so
+// the count afterwards is an upper bound when both had the same ids.
+func (b *Bloom) Merge(other *Bloom) error {
+	if b == other {
+		return nil
+	}
+	if b.maxLimit != other.maxLimit || b.errorRate != other.errorRate ||
+		b.growth != other.growth || len(b.shards) != len(other.shards) {
+		return ErrIncompatible
+	}
+
+	for i, s := range b.shards {
+		if err := s.merge(other.shards[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OR the stages of other into s, copying the stages s doesn't have yet.
+func (s *shard) merge(other *shard) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	other.mutex.RLock()
+	defer other.mutex.RUnlock()
+
+	for i, st := range other.stages {
+		if i == len(s.stages) {
+			s.stages = append(s.stages, &stage{filter: st.filter.Copy(), limit: st.limit, count: st.count})
+
+			continue
+		}
+		if err := s.stages[i].filter.Merge(st.filter); err != nil {
+			return err
+		}
+		s.stages[i].count += st.count
+	}
+	s.count += other.count
+
+	return nil
+}
+
+// Save writes the filter along with its limit and error rate to path.
+// The file is written to a temporary location first and then renamed.
+func (b *Bloom) Save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	err = binary.Write(w, binary.BigEndian, header{
+		Magic:     snapshotMagic,
+		MaxLimit:  uint64(b.maxLimit),
+		ErrorRate: math.Float64bits(b.errorRate),
+		Growth:    uint64(b.growth),
+		Shards:    uint64(len(b.shards)),
+	})
+	for _, s := range b.shards {
+		if err != nil {
+			break
+		}
+		err = s.writeTo(w)
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// write a shard with its lock held for reading, so shards are saved one at
+// a time without stopping the whole filter.
+func (s *shard) writeTo(w io.Writer) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	err := binary.Write(w, binary.BigEndian, shardHeader{
+		Count:  s.count,
+		Stages: uint64(len(s.stages)),
+	})
+	for _, st := range s.stages {
+		if err != nil {
+			break
+		}
+		err = binary.Write(w, binary.BigEndian, stageHeader{
+			Limit: uint64(st.limit),
+			Count: st.count,
+		})
+		if err == nil {
+			_, err = st.filter.WriteTo(w)
+		}
+	}
+
+	return err
+}
+
+// Load reads a snapshot from path. The snapshot is only accepted if it was
+// written with the same limit, error rate and growth as b, so that a config
+// change invalidates a stale file.
+func (b *Bloom) Load(path string) (*Bloom, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warn().Err(err).Msg("bloom-filter: failed to open snapshot")
+		}
+
+		return nil, false
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+
+	var h header
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil || h.Magic != snapshotMagic {
+		log.Warn().Err(ErrBadSnapshot).Msgf("bloom-filter: ignoring %s", path)
+
+		return nil, false
+	}
+
+	if uint(h.MaxLimit) != b.maxLimit ||
+		math.Float64frombits(h.ErrorRate) != b.errorRate ||
+		uint(h.Growth) != b.growth ||
+		h.Shards != uint64(len(b.shards)) {
+		log.Warn().Msgf("bloom-filter: snapshot limit/errorRate/shards changed, ignoring %s", path)
+
+		return nil, false
+	}
+
+	loaded := &Bloom{
+		shards:    make([]*shard, len(b.shards)),
+		maxLimit:  b.maxLimit,
+		errorRate: b.errorRate,
+		growth:    b.growth,
+	}
+
+	for i := range loaded.shards {
+		s, err := readShard(r)
+		if err != nil {
+			log.Warn().Err(err).Msgf("bloom-filter: failed to read %s", path)
+
+			return nil, false
+		}
+		loaded.shards[i] = s
+	}
+
+	log.Info().Msgf("bloom-filter: restored %s IDs from %s", humanize.Comma(int64(loaded.Count())), path)
+
+	return loaded, true
+}
+
+func readShard(r io.Reader) (*shard, error) {
+	var sh shardHeader
+	if err := binary.Read(r, binary.BigEndian, &sh); err != nil {
+		return nil, err
+	}
+	if sh.Stages == 0 {
+		return nil, ErrBadSnapshot
+	}
+
+	s := &shard{count: sh.Count}
+	for i := uint64(0); i < sh.Stages; i++ {
+		var st stageHeader
+		filter := &bloom.BloomFilter{}
+		err := binary.Read(r, binary.BigEndian, &st)
+		if err == nil {
+			_, err = filter.ReadFrom(r)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.stages = append(s.stages, &stage{
+			filter: filter,
+			limit:  uint(st.Limit),
+			count:  st.Count,
+		})
+	}
 
-	return b.bloom.Test(id)
+	return s, nil
 }
@@ -0,0 +1,173 @@
+package bloom
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// share of n ids never added that b reports as existing.
+func falsePositives(b *Bloom, n int) float64 {
+	found := 0
+	for i := 0; i < n; i++ {
+		if b.Exists([]byte("absent-" + strconv.Itoa(i))) {
+			found++
+		}
+	}
+
+	return float64(found) / float64(n)
+}
+
+func fill(b *Bloom, n int) {
+	for i := 0; i < n; i++ {
+		b.Add([]byte("present-" + strconv.Itoa(i)))
+	}
+}
+
+func TestScalableFalsePositiveRate(t *testing.T) {
+	const (
+		initial   = 10_000
+		errorRate = 0.01
+	)
+	b := NewScalableBloom(initial, errorRate, 2)
+	fill(b, 20*initial)
+
+	for i := 0; i < 20*initial; i++ {
+		if !b.Exists([]byte("present-" + strconv.Itoa(i))) {
+			t.Fatalf("id %d was added but doesn't exist", i)
+		}
+	}
+	if count := b.Count(); count != 20*initial {
+		t.Errorf("count is %d, want %d", count, 20*initial)
+	}
+	if stats := b.Stats(); stats.FalsePositiveRate > errorRate {
+		t.Errorf("estimated false positive rate is %f, want at most %f", stats.FalsePositiveRate, errorRate)
+	}
+	// stages tighten their error rate so the compounded rate stays below
+	// errorRate, the margin only covers sampling noise
+	if rate := falsePositives(b, 100_000); rate > 1.2*errorRate {
+		t.Errorf("false positive rate is %f after growing, want near %f", rate, errorRate)
+	}
+}
+
+func TestFixedFalsePositiveRateDegrades(t *testing.T) {
+	const (
+		limit     = 10_000
+		errorRate = 0.01
+	)
+	b := New(limit, errorRate)
+	fill(b, limit)
+	if rate := falsePositives(b, 100_000); rate > 1.2*errorRate {
+		t.Errorf("false positive rate is %f at the limit, want near %f", rate, errorRate)
+	}
+
+	fill(b, 20*limit)
+	if rate := falsePositives(b, 100_000); rate < 10*errorRate {
+		t.Errorf("false positive rate is %f past the limit, want it to degrade", rate)
+	}
+}
+
+func TestAddIfAbsent(t *testing.T) {
+	b := NewScalableBloom(100, 0.001, 2)
+	for i := 0; i < 1000; i++ {
+		id := []byte(strconv.Itoa(i))
+		if !b.AddIfAbsent(id) {
+			// a false positive of a tiny filter, not a failure
+			continue
+		}
+		if b.AddIfAbsent(id) {
+			t.Fatalf("id %d was added twice", i)
+		}
+	}
+}
+
+func TestConcurrentAddExists(t *testing.T) {
+	const (
+		workers   = 32
+		perWorker = 2_000
+	)
+	// small enough to grow while workers add
+	b := NewScalableBloom(1_000, 0.001, 2)
+
+	var added atomic.Uint64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				own := []byte("worker-" + strconv.Itoa(w) + "-" + strconv.Itoa(i))
+				b.Add(own)
+				added.Add(1)
+				if !b.Exists(own) {
+					t.Errorf("id %s was added but doesn't exist", own)
+					return
+				}
+				// every worker races to add the same shared ids
+				if b.AddIfAbsent([]byte("shared-" + strconv.Itoa(i))) {
+					added.Add(1)
+				}
+				if i%100 == 0 {
+					b.Stats()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if count := b.Count(); count != added.Load() {
+		t.Errorf("count is %d, want the %d ids added", count, added.Load())
+	}
+	// each shared id is added by one worker at most
+	if shared := added.Load() - workers*perWorker; shared > perWorker {
+		t.Errorf("added %d shared ids, want at most %d", shared, perWorker)
+	}
+	for i := 0; i < perWorker; i++ {
+		if !b.Exists([]byte("shared-" + strconv.Itoa(i))) {
+			t.Fatalf("shared id %d doesn't exist", i)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	const initial = 1_000
+	b, other := NewScalableBloom(initial, 0.01, 2), NewScalableBloom(initial, 0.01, 2)
+	fill(b, initial)
+	// other grows stages b doesn't have
+	for i := 0; i < 10*initial; i++ {
+		other.Add([]byte("other-" + strconv.Itoa(i)))
+	}
+
+	if err := b.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < initial; i++ {
+		if !b.Exists([]byte("present-" + strconv.Itoa(i))) {
+			t.Fatalf("id %d of the filter is missing after merging", i)
+		}
+	}
+	for i := 0; i < 10*initial; i++ {
+		if !b.Exists([]byte("other-" + strconv.Itoa(i))) {
+			t.Fatalf("id %d of the merged filter is missing", i)
+		}
+	}
+	if count := b.Count(); count != 11*initial {
+		t.Errorf("count is %d after merging, want %d", count, 11*initial)
+	}
+
+	tests := []struct {
+		name  string
+		other *Bloom
+	}{
+		{"limit", NewScalableBloom(2*initial, 0.01, 2)},
+		{"error rate", NewScalableBloom(initial, 0.001, 2)},
+		{"growth", NewScalableBloom(initial, 0.01, 4)},
+		{"fixed", New(initial, 0.01)},
+	}
+	for _, test := range tests {
+		if err := b.Merge(test.other); err != ErrIncompatible {
+			t.Errorf("%s: got %v merging, want %v", test.name, err, ErrIncompatible)
+		}
+	}
+}
@@ -2,32 +2,297 @@ package cache
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
 	"wormholes/internal/links"
 
 	"github.com/mediocregopher/radix/v4"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	clicksPrefix = "clicks:"
+	targetPrefix = "target:"
+	keyPrefix    = "idempotency:"
+	qrPrefix     = "qr:"
+)
+
+// Commands go to the primary of a single node, of a Sentinel managed
+// replica set or of the Cluster node owning their keys.
 type Cache struct {
-	radix.Client
+	radix.MultiClient
 }
 
+// Connect to a single node.
 func New(uri string) *Cache {
 	client, err := (radix.PoolConfig{}).New(context.Background(), "tcp", uri)
 	if err != nil {
 		log.Error().Err(err).Msg("cache: failed to connect")
 	}
 	return &Cache{
-		client,
+		radix.NewMultiClient(radix.ReplicaSet{Primary: client}),
+	}
+}
+
+// Connect to the primary named master through Sentinels at addrs, following
+// it on failover.
+func NewSentinel(master string, addrs []string, password string) *Cache {
+	cfg := radix.SentinelConfig{
+		PoolConfig: radix.PoolConfig{Dialer: radix.Dialer{AuthPass: password}},
+	}
+	client, err := cfg.New(context.Background(), master, addrs)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cache: failed to connect to sentinel")
+	}
+	return &Cache{client}
+}
+
+// Connect to a Cluster through any of its nodes at addrs.
+func NewCluster(addrs []string, password string) *Cache {
+	cfg := radix.ClusterConfig{
+		PoolConfig: radix.PoolConfig{Dialer: radix.Dialer{AuthPass: password}},
+	}
+	client, err := cfg.New(context.Background(), addrs)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cache: failed to connect to cluster")
 	}
+	return &Cache{client}
+}
+
+// cached link with tags, geo rules and variants encoded as JSON, a hash
+// can't hold a list or a map.
+type cachedLink struct {
+	*links.Link
+	Tags     string `redis:"tags"`
+	GeoRules string `redis:"geoRules"`
+	Variants string `redis:"variants"`
 }
 
 func (c *Cache) GetLink(link *links.Link, shortID string) (err error) {
-	err = c.Do(context.Background(), radix.Cmd(&link, "HGETALL", shortID))
+	cached := cachedLink{Link: link}
+	err = c.Do(context.Background(), radix.Cmd(&cached, "HGETALL", shortID))
+	if err == nil && cached.Tags != "" {
+		err = json.Unmarshal([]byte(cached.Tags), &link.Tags)
+	} else if link.Tag != "" {
+		link.Tags = []string{link.Tag}
+	}
+	if err == nil && cached.GeoRules != "" {
+		err = json.Unmarshal([]byte(cached.GeoRules), &link.GeoRules)
+	}
+	if err == nil && cached.Variants != "" {
+		err = json.Unmarshal([]byte(cached.Variants), &link.Variants)
+	}
+	link.Protected = link.PasswordHash != ""
 	return err
 }
 
 func (c *Cache) SetLink(link links.Link, shortID string) (err error) {
-	err = c.Do(context.Background(), radix.Cmd(nil, "HSET", shortID, "id", link.ID, "target", link.Target, "tag", link.Tag))
+	args := []string{
+		shortID,
+		"domain", link.Domain,
+		"id", link.ID,
+		"target", link.Target,
+		"tag", link.Tag,
+		"clicks", strconv.FormatInt(link.Clicks, 10),
+		"maxClicks", strconv.FormatInt(link.MaxClicks, 10),
+		"redirectCode", strconv.Itoa(link.RedirectCode),
+		"owner", link.Owner,
+	}
+	if link.ExpiresAt != nil {
+		args = append(args, "expiresAt", link.ExpiresAt.Format(time.RFC3339Nano))
+	}
+	if link.PasswordHash != "" {
+		args = append(args, "passwordHash", link.PasswordHash)
+	}
+	if link.Signed {
+		args = append(args, "signed", "1")
+	}
+	if link.Title != "" {
+		args = append(args, "title", link.Title)
+	}
+	if link.Image != "" {
+		args = append(args, "image", link.Image)
+	}
+	if len(link.Tags) > 0 {
+		tags, err := json.Marshal(link.Tags)
+		if err != nil {
+			return err
+		}
+		args = append(args, "tags", string(tags))
+	}
+	if len(link.GeoRules) > 0 {
+		rules, err := json.Marshal(link.GeoRules)
+		if err != nil {
+			return err
+		}
+		args = append(args, "geoRules", string(rules))
+	}
+	if len(link.Variants) > 0 {
+		variants, err := json.Marshal(link.Variants)
+		if err != nil {
+			return err
+		}
+		args = append(args, "variants", string(variants))
+	}
+
+	err = c.Do(context.Background(), radix.Cmd(nil, "HSET", args...))
+	return err
+}
+
+// Drop link with shortID from cache after ttl.
+func (c *Cache) ExpireLink(shortID string, ttl time.Duration) (err error) {
+	err = c.Do(context.Background(), radix.FlatCmd(nil, "PEXPIRE", shortID, ttl.Milliseconds()))
+	return err
+}
+
+func (c *Cache) DeleteLink(shortID string) (err error) {
+	err = c.Do(context.Background(), radix.Cmd(nil, "DEL", shortID))
+	return err
+}
+
+// Drop links with shortIDs from cache in a single DEL. A Cluster can't
+// delete keys of different slots at once, they are deleted one by one.
+func (c *Cache) DeleteLinks(shortIDs []string) (err error) {
+	if len(shortIDs) == 0 {
+		return nil
+	}
+	if _, ok := c.MultiClient.(*radix.Cluster); !ok {
+		return c.Do(context.Background(), radix.Cmd(nil, "DEL", shortIDs...))
+	}
+	for _, shortID := range shortIDs {
+		if err = c.DeleteLink(shortID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count a click on link with shortID.
+func (c *Cache) IncrClicks(shortID string) (err error) {
+	err = c.Do(context.Background(), radix.Cmd(nil, "INCR", clicksPrefix+shortID))
+	return err
+}
+
+// Clicks counted for shortID that aren't flushed yet.
+func (c *Cache) Clicks(shortID string) (clicks int64, err error) {
+	err = c.Do(context.Background(), radix.Cmd(&radix.Maybe{Rcv: &clicks}, "GET", clicksPrefix+shortID))
+	return clicks, err
+}
+
+// Take all counted clicks, removing them from cache. Keys are scanned on
+// every primary, a Cluster spreads them over its nodes.
+func (c *Cache) PopClicks() (map[string]int64, error) {
+	ctx := context.Background()
+	clicks := make(map[string]int64)
+
+	replicaSets, err := c.Clients()
+	if err != nil {
+		return clicks, err
+	}
+
+	for _, rs := range replicaSets {
+		scanner := (radix.ScannerConfig{Pattern: clicksPrefix + "*"}).New(rs.Primary)
+
+		var key string
+		for scanner.Next(ctx, &key) {
+			var count int64
+			if err := c.Do(ctx, radix.Cmd(&radix.Maybe{Rcv: &count}, "GETDEL", key)); err != nil {
+				scanner.Close()
+				return clicks, err
+			}
+			if count > 0 {
+				clicks[strings.TrimPrefix(key, clicksPrefix)] += count
+			}
+		}
+		if err := scanner.Close(); err != nil {
+			return clicks, err
+		}
+	}
+
+	return clicks, nil
+}
+
+// Add clicks back, used when they could not be flushed.
+func (c *Cache) AddClicks(shortID string, count int64) (err error) {
+	err = c.Do(context.Background(), radix.FlatCmd(nil, "INCRBY", clicksPrefix+shortID, count))
+	return err
+}
+
+// targets can be long, keys use their hash.
+func targetKey(domain, target string) string {
+	sum := sha256.Sum256([]byte(links.Key(domain, target)))
+	return targetPrefix + hex.EncodeToString(sum[:])
+}
+
+// ID of the link last created for target on domain, empty if there is none.
+func (c *Cache) GetTarget(domain, target string) (shortID string, err error) {
+	err = c.Do(context.Background(), radix.Cmd(&radix.Maybe{Rcv: &shortID}, "GET", targetKey(domain, target)))
+	return shortID, err
+}
+
+func (c *Cache) SetTarget(domain, target, shortID string) (err error) {
+	err = c.Do(context.Background(), radix.Cmd(nil, "SET", targetKey(domain, target), shortID))
+	return err
+}
+
+// Count a hit in the window at key, expiring it after ttl, and get the hits
+// counted in the window at prevKey. On a Cluster, both keys must hash to the
+// same slot.
+func (c *Cache) IncrWindow(key, prevKey string, ttl time.Duration) (current, previous int64, err error) {
+	p := radix.NewPipeline()
+	p.Append(radix.Cmd(&current, "INCR", key))
+	p.Append(radix.FlatCmd(nil, "PEXPIRE", key, ttl.Milliseconds()))
+	p.Append(radix.Cmd(&radix.Maybe{Rcv: &previous}, "GET", prevKey))
+
+	err = c.Do(context.Background(), p)
+	return current, previous, err
+}
+
+// Claim an idempotency key for ttl, reporting false if it is already taken.
+func (c *Cache) ClaimKey(key string, ttl time.Duration) (bool, error) {
+	var reply string
+	mb := radix.Maybe{Rcv: &reply}
+	err := c.Do(context.Background(), radix.FlatCmd(&mb, "SET", keyPrefix+key, "", "NX", "PX", ttl.Milliseconds()))
+	return err == nil && !mb.Null, err
+}
+
+// Response stored for an idempotency key, empty if it is still pending or
+// not claimed.
+func (c *Cache) GetKey(key string) (value string, err error) {
+	err = c.Do(context.Background(), radix.Cmd(&radix.Maybe{Rcv: &value}, "GET", keyPrefix+key))
+	return value, err
+}
+
+func (c *Cache) SetKey(key, value string, ttl time.Duration) (err error) {
+	err = c.Do(context.Background(), radix.FlatCmd(nil, "SET", keyPrefix+key, value, "PX", ttl.Milliseconds()))
+	return err
+}
+
+func (c *Cache) ReleaseKey(key string) (err error) {
+	err = c.Do(context.Background(), radix.Cmd(nil, "DEL", keyPrefix+key))
+	return err
+}
+
+func qrKey(shortID, format string, size int) string {
+	return qrPrefix + format + ":" + strconv.Itoa(size) + ":" + shortID
+}
+
+// QR code image of a link, empty if it isn't cached.
+func (c *Cache) GetQR(shortID, format string, size int) (image []byte, err error) {
+	err = c.Do(context.Background(), radix.Cmd(&radix.Maybe{Rcv: &image}, "GET", qrKey(shortID, format, size)))
+	return image, err
+}
+
+func (c *Cache) SetQR(shortID, format string, size int, image []byte, ttl time.Duration) (err error) {
+	err = c.Do(context.Background(), radix.FlatCmd(nil, "SET", qrKey(shortID, format, size), image, "PX", ttl.Milliseconds()))
+	return err
+}
+
+func (c *Cache) Ping(ctx context.Context) (err error) {
+	err = c.Do(ctx, radix.Cmd(nil, "PING"))
 	return err
 }
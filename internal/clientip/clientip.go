@@ -0,0 +1,107 @@
+package clientip
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// Local of requests holding their client IP.
+	Local = "clientIP"
+
+	HeaderForwardedFor = fiber.HeaderXForwardedFor
+	HeaderRealIP       = "X-Real-Ip"
+)
+
+// Resolves client IPs of requests sent through trusted proxies.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+func New(trusted []*net.IPNet) *Resolver {
+	return &Resolver{trusted: trusted}
+}
+
+func (r *Resolver) isTrusted(ip net.IP) bool {
+	for _, ipNet := range r.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Resolve the client IP of a request from remote. Headers are only read when
+// remote is a trusted proxy. X-Forwarded-For is read from the right, each
+// trusted proxy appending the address it got the request from, and the first
+// hop that isn't a trusted proxy is the client. Hops left of it may be sent
+// by the client and are never used. A malformed hop ends the chain at the
+// last trusted proxy before it. X-Real-IP is only used without
+// X-Forwarded-For.
+func (r *Resolver) Resolve(remote net.IP, forwardedFor []string, realIP string) net.IP {
+	if len(r.trusted) == 0 || !r.isTrusted(remote) {
+		return remote
+	}
+
+	if len(forwardedFor) == 0 {
+		if ip := parse(realIP); ip != nil {
+			return ip
+		}
+
+		return remote
+	}
+
+	client := remote
+	// repeated headers are a single list, in order
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		hops := strings.Split(forwardedFor[i], ",")
+		for j := len(hops) - 1; j >= 0; j-- {
+			ip := parse(hops[j])
+			if ip == nil {
+				return client
+			}
+			client = ip
+			if !r.isTrusted(ip) {
+				return client
+			}
+		}
+	}
+
+	// every hop is a trusted proxy, the leftmost sent the request
+	return client
+}
+
+// IP of a hop, which some proxies send with a port. nil if it isn't one.
+func parse(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+
+	return net.ParseIP(hop)
+}
+
+// Middleware resolving the client IP of each request, read with Of.
+func (r *Resolver) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var forwardedFor []string
+		for _, value := range c.Request().Header.PeekAll(HeaderForwardedFor) {
+			forwardedFor = append(forwardedFor, string(value))
+		}
+		c.Locals(Local, r.Resolve(c.Context().RemoteIP(), forwardedFor, c.Get(HeaderRealIP)))
+
+		return c.Next()
+	}
+}
+
+// Client IP of a request, its remote address if it wasn't resolved.
+func Of(c *fiber.Ctx) net.IP {
+	if ip, ok := c.Locals(Local).(net.IP); ok {
+		return ip
+	}
+
+	return c.Context().RemoteIP()
+}
@@ -0,0 +1,88 @@
+package clientip
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func trusted(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets
+}
+
+func TestResolve(t *testing.T) {
+	proxies := New(trusted(t, "10.0.0.0/8", "192.168.1.1/32"))
+	proxy, client := net.ParseIP("10.0.0.1"), "203.0.113.7"
+
+	tests := []struct {
+		name         string
+		resolver     *Resolver
+		remote       net.IP
+		forwardedFor []string
+		realIP       string
+		want         string
+	}{
+		{"no trusted proxies", New(nil), proxy, []string{client}, client, "10.0.0.1"},
+		{"untrusted remote", proxies, net.ParseIP("198.51.100.1"), []string{client}, client, "198.51.100.1"},
+		{"proxy next to the edge", proxies, net.ParseIP("192.168.1.1"), []string{client}, "", client},
+		{"proxy without headers", proxies, proxy, nil, "", "10.0.0.1"},
+		{"client", proxies, proxy, []string{client}, "", client},
+		{"chain of proxies", proxies, proxy, []string{client + ", 10.0.0.3, 10.0.0.2"}, "", client},
+		{"spoofed hops", proxies, proxy, []string{"6.6.6.6, 10.0.0.9, " + client}, "", client},
+		{"every hop trusted", proxies, proxy, []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"repeated headers", proxies, proxy, []string{"6.6.6.6", client + ", 10.0.0.2"}, "", client},
+		{"repeated headers of proxies", proxies, proxy, []string{client, "10.0.0.2"}, "", client},
+		{"hop with port", proxies, proxy, []string{client + ":4711"}, "", client},
+		{"IPv6 hop with port", proxies, proxy, []string{"[2001:db8::1]:443"}, "", "2001:db8::1"},
+		{"X-Real-IP", proxies, proxy, nil, client, client},
+		{"X-Real-IP of untrusted remote", proxies, net.ParseIP("198.51.100.1"), nil, client, "198.51.100.1"},
+		{"X-Forwarded-For over X-Real-IP", proxies, proxy, []string{client}, "6.6.6.6", client},
+		{"malformed X-Real-IP", proxies, proxy, nil, "unknown", "10.0.0.1"},
+		{"malformed last hop", proxies, proxy, []string{client + ", unknown"}, "", "10.0.0.1"},
+		{"malformed hop past proxies", proxies, proxy, []string{"unknown, 10.0.0.2"}, "", "10.0.0.2"},
+		{"malformed hop past the client", proxies, proxy, []string{"unknown, " + client}, "", client},
+		{"empty last hop", proxies, proxy, []string{client + ","}, "", "10.0.0.1"},
+		{"empty header", proxies, proxy, []string{""}, "", "10.0.0.1"},
+		{"hop with a network", proxies, proxy, []string{"203.0.113.0/24"}, "", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		got := test.resolver.Resolve(test.remote, test.forwardedFor, test.realIP)
+		if !got.Equal(net.ParseIP(test.want)) {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	// requests sent with app.Test come from 0.0.0.0
+	app := fiber.New()
+	app.Use(New(trusted(t, "0.0.0.0/32")).Handler())
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendString(Of(c).String())
+	})
+
+	req := httptest.NewRequest(fiber.MethodGet, "/", nil)
+	req.Header.Add(HeaderForwardedFor, "6.6.6.6")
+	req.Header.Add(HeaderForwardedFor, "203.0.113.7")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "203.0.113.7" {
+		t.Errorf("got client IP %s, want the last hop of repeated headers", body)
+	}
+}
@@ -1,28 +1,264 @@
 package config
 
 import (
+	"net/url"
+	"strings"
 	"time"
+	"wormholes/internal/apikey"
+	"wormholes/internal/idgen"
+	"wormholes/internal/links"
+	"wormholes/internal/ratelimit"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/rs/zerolog/log"
 )
 
+// Backends links can be stored in.
+const (
+	StorePostgres = "postgres"
+	// links kept in the memory of a single process, lost on exit
+	StoreMemory = "memory"
+)
+
 type Config struct {
-	Port           int           `env:"PORT" envDefault:"5000"`
-	GenPort        int           `env:"GEN_PORT" envDefault:"5001"`
-	BatchSize      int           `env:"BATCH_SIZE" envDefault:"10000"`
-	IDSize         int           `env:"ID_SIZE" envDefault:"7"`
-	BucketSize     int           `env:"BUCKET_SIZE" envDefault:"16"`
-	BucketCapacity int           `env:"BUCKET_CAP" envDefault:"100000"`
-	BloomMaxLimit  uint          `env:"BLOOM_MAX" envDefault:"100000000"`
-	BloomErrorRate float64       `env:"BLOOM_ERROR" envDefault:"0.0000001"`
-	Timeout        time.Duration `env:"TIMEOUT" envDefault:"100ms"`
+	Port              int           `env:"PORT" envDefault:"5000"`
+	RedirectCode      int           `env:"REDIRECT_CODE" envDefault:"301"`
+	CountHead         bool          `env:"COUNT_HEAD" envDefault:"false"`
+	BaseURL           string        `env:"BASE_URL" envDefault:"http://localhost:5000"`
+	Domains           []string      `env:"DOMAINS"`
+	GenPort           int           `env:"GEN_PORT" envDefault:"5001"`
+	GenTLSCert        string        `env:"GEN_TLS_CERT"`
+	GenTLSKey         string        `env:"GEN_TLS_KEY"`
+	GenTLSClientCA    string        `env:"GEN_TLS_CLIENT_CA"`
+	GenTLSCA          string        `env:"GEN_TLS_CA"`
+	GenTLSClientCert  string        `env:"GEN_TLS_CLIENT_CERT"`
+	GenTLSClientKey   string        `env:"GEN_TLS_CLIENT_KEY"`
+	GenTLSServerName  string        `env:"GEN_TLS_SERVER_NAME" envDefault:"localhost"`
+	MetricsAddr       string        `env:"METRICS_ADDR" envDefault:":5002"`
+	CreatorMetrics    bool          `env:"CREATOR_METRICS" envDefault:"true"`
+	MaxConns          int           `env:"MAX_CONNS" envDefault:"262144"`
+	ReadTimeout       time.Duration `env:"READ_TIMEOUT" envDefault:"30s"`
+	WriteTimeout      time.Duration `env:"WRITE_TIMEOUT" envDefault:"0"`
+	IdleTimeout       time.Duration `env:"IDLE_TIMEOUT" envDefault:"60s"`
+	KeepAlive         bool          `env:"KEEP_ALIVE" envDefault:"true"`
+	BodyLimit         int           `env:"BODY_LIMIT" envDefault:"4194304"`
+	WriteBodyLimit    int           `env:"WRITE_BODY_LIMIT" envDefault:"8192"`
+	MaxTargetLength   int           `env:"MAX_TARGET_LENGTH" envDefault:"2048"`
+	LocalIDs          bool          `env:"LOCAL_IDS" envDefault:"false"`
+	LowWatermark      int           `env:"LOW_WATERMARK" envDefault:"1000"`
+	BatchSize         int           `env:"BATCH_SIZE" envDefault:"10000"`
+	IngestInterval    time.Duration `env:"INGEST_INTERVAL" envDefault:"10s"`
+	DeadLetter        string        `env:"DEAD_LETTER" envDefault:"wormholes.dead.jsonl"`
+	MaxBatch          int           `env:"MAX_BATCH" envDefault:"1000"`
+	Secret            string        `env:"SECRET"`
+	UnlockTTL         time.Duration `env:"UNLOCK_TTL" envDefault:"5m"`
+	SignSecret        string        `env:"SIGN_SECRET"`
+	SignPrevious      string        `env:"SIGN_SECRET_PREVIOUS"`
+	SignPreviousUntil time.Time     `env:"SIGN_PREVIOUS_UNTIL"`
+	SignedLinks       bool          `env:"SIGNED_LINKS" envDefault:"false"`
+	IdempotencyTTL    time.Duration `env:"IDEMPOTENCY_TTL" envDefault:"24h"`
+	RateLimit         int           `env:"RATE_LIMIT" envDefault:"60"`
+	RateLimitRead     int           `env:"RATE_LIMIT_READ" envDefault:"600"`
+	RateWindow        time.Duration `env:"RATE_WINDOW" envDefault:"1m"`
+	RateAllow         []string      `env:"RATE_ALLOW"`
+	TrustedProxies    []string      `env:"TRUSTED_PROXIES"`
+	Webhooks          []string      `env:"WEBHOOKS"`
+	WebhookSecret     string        `env:"WEBHOOK_SECRET"`
+	WebhookRetries    int           `env:"WEBHOOK_RETRIES" envDefault:"5"`
+	WebhookTimeout    time.Duration `env:"WEBHOOK_TIMEOUT" envDefault:"5s"`
+	TraceEndpoint     string        `env:"TRACE_ENDPOINT"`
+	TraceInsecure     bool          `env:"TRACE_INSECURE" envDefault:"false"`
+	TraceRatio        float64       `env:"TRACE_RATIO" envDefault:"1"`
+	Preview           bool          `env:"PREVIEW" envDefault:"false"`
+	PreviewTimeout    time.Duration `env:"PREVIEW_TIMEOUT" envDefault:"5s"`
+	PreviewMaxBytes   int64         `env:"PREVIEW_MAX_BYTES" envDefault:"1048576"`
+	ClicksFlush       time.Duration `env:"CLICKS_FLUSH" envDefault:"10s"`
+	Analytics         bool          `env:"ANALYTICS" envDefault:"true"`
+	ClickStreams      int           `env:"CLICK_STREAMS" envDefault:"2"`
+	ClickBatch        int           `env:"CLICK_BATCH" envDefault:"1000"`
+	ReferrerDetail    string        `env:"REFERRER_DETAIL" envDefault:"host"`
+	LogFormat         string        `env:"LOG_FORMAT" envDefault:"console"`
+	Store             string        `env:"STORE" envDefault:"postgres"`
+	GeoIPDir          string        `env:"GEOIP_DIR" envDefault:"."`
+	GeoIPPath         string        `env:"GEOIP_PATH"`
+	GeoIPReload       time.Duration `env:"GEOIP_RELOAD" envDefault:"0"`
+	GeoIPRequired     bool          `env:"GEOIP_REQUIRED" envDefault:"false"`
+	GeoIPLicenseKey   string        `env:"GEOIP_LICENSE_KEY"`
+	GeoIPDownload     bool          `env:"GEOIP_DOWNLOAD" envDefault:"false"`
+	GeoIPRefresh      time.Duration `env:"GEOIP_REFRESH" envDefault:"168h"`
+	TargetSchemes     []string      `env:"TARGET_SCHEMES" envDefault:"http,https"`
+	AddScheme         bool          `env:"ADD_SCHEME" envDefault:"false"`
+	Dedup             bool          `env:"DEDUP" envDefault:"false"`
+	HashIDs           bool          `env:"HASH_IDS" envDefault:"false"`
+	QueryTimeout      time.Duration `env:"QUERY_TIMEOUT" envDefault:"5s"`
+	WarmLinks         int           `env:"WARM_LINKS" envDefault:"0"`
+	ExpiredURL        string        `env:"EXPIRED_URL"`
+	ExpiredTTL        time.Duration `env:"EXPIRED_TTL" envDefault:"1m"`
+	SweepInterval     time.Duration `env:"SWEEP_INTERVAL" envDefault:"1h"`
+	SoftDelete        bool          `env:"SOFT_DELETE" envDefault:"false"`
+	DeleteRetention   time.Duration `env:"DELETE_RETENTION" envDefault:"720h"`
+	IDSize            int           `env:"ID_SIZE" envDefault:"7"`
+	Alphabet          string        `env:"ALPHABET"`
+	RNG               string        `env:"ID_RNG" envDefault:"secure"`
+	Partition         int           `env:"PARTITION" envDefault:"0"`
+	Partitions        int           `env:"PARTITIONS" envDefault:"1"`
+	CaseInsensitive   bool          `env:"CASE_INSENSITIVE" envDefault:"false"`
+	StrictIDs         bool          `env:"STRICT_IDS" envDefault:"true"`
+	Blacklist         []string      `env:"BLACKLIST" envDefault:"api,admin,login,healthz,readyz"`
+	BlacklistPatterns []string      `env:"BLACKLIST_PATTERNS"`
+	BucketSize        int           `env:"BUCKET_SIZE" envDefault:"16"`
+	BucketCapacity    int           `env:"BUCKET_CAP" envDefault:"100000"`
+	MaxRetries        int           `env:"MAX_RETRIES" envDefault:"10000"`
+	PartialBuckets    bool          `env:"PARTIAL_BUCKETS" envDefault:"false"`
+	AdminToken        string        `env:"ADMIN_TOKEN"`
+	APIKeys           []string      `env:"API_KEYS"`
+	APIAdmins         []string      `env:"API_ADMINS"`
+	Workers           int           `env:"WORKERS" envDefault:"0"`
+	BucketSnapshot    string        `env:"BUCKET_SNAPSHOT" envDefault:"wormholes.buckets"`
+	BloomMaxLimit     uint          `env:"BLOOM_MAX" envDefault:"100000000"`
+	BloomErrorRate    float64       `env:"BLOOM_ERROR" envDefault:"0.0000001"`
+	BloomAutoSize     bool          `env:"BLOOM_AUTO_SIZE" envDefault:"false"`
+	BloomHeadroom     float64       `env:"BLOOM_HEADROOM" envDefault:"3"`
+	BloomGrowth       uint          `env:"BLOOM_GROWTH" envDefault:"0"`
+	BloomSnapshot     string        `env:"BLOOM_SNAPSHOT" envDefault:"wormholes.bloom"`
+	BloomDrift        uint64        `env:"BLOOM_DRIFT" envDefault:"0"`
+	Timeout           time.Duration `env:"TIMEOUT" envDefault:"100ms"`
+	ShutdownTimeout   time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"10s"`
+	PrepareChunk      int           `env:"PREPARE_CHUNK" envDefault:"100000"`
+	PrepareWorkers    int           `env:"PREPARE_WORKERS" envDefault:"0"`
+	PrepareTimeout    time.Duration `env:"PREPARE_TIMEOUT" envDefault:"30s"`
 }
 
 func DefaultConfig() *Config {
 	var cfg Config
-	if err := env.Parse(&cfg); err != nil {
-		log.Panic().Err(err)
+	if err := env.Parse(&cfg, env.Options{Environment: Environment()}); err != nil {
+		log.Panic().Err(err).Msg("config: failed to parse")
+	}
+
+	positive := map[string]int{
+		"BATCH_SIZE":        cfg.BatchSize,
+		"MAX_BATCH":         cfg.MaxBatch,
+		"ID_SIZE":           cfg.IDSize,
+		"BUCKET_SIZE":       cfg.BucketSize,
+		"BUCKET_CAP":        cfg.BucketCapacity,
+		"MAX_RETRIES":       cfg.MaxRetries,
+		"PREPARE_CHUNK":     cfg.PrepareChunk,
+		"CLICK_STREAMS":     cfg.ClickStreams,
+		"CLICK_BATCH":       cfg.ClickBatch,
+		"MAX_CONNS":         cfg.MaxConns,
+		"BODY_LIMIT":        cfg.BodyLimit,
+		"WRITE_BODY_LIMIT":  cfg.WriteBodyLimit,
+		"MAX_TARGET_LENGTH": cfg.MaxTargetLength,
+	}
+	for name, value := range positive {
+		if value <= 0 {
+			log.Panic().Msgf("config: %s must be > 0, got %d", name, value)
+		}
+	}
+	if cfg.IngestInterval <= 0 {
+		log.Panic().Msgf("config: INGEST_INTERVAL must be > 0, got %s", cfg.IngestInterval)
+	}
+	if cfg.ReadTimeout < 0 || cfg.WriteTimeout < 0 || cfg.IdleTimeout < 0 {
+		log.Panic().Msg("config: READ_TIMEOUT, WRITE_TIMEOUT and IDLE_TIMEOUT must be >= 0")
+	}
+	if cfg.ClicksFlush <= 0 {
+		log.Panic().Msgf("config: CLICKS_FLUSH must be > 0, got %s", cfg.ClicksFlush)
+	}
+
+	// short URLs are BASE_URL + "/" + id
+	base, err := url.Parse(cfg.BaseURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		log.Panic().Msgf("config: BASE_URL must be an absolute http or https URL, got %q", cfg.BaseURL)
+	}
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+
+	if cfg.ReferrerDetail != "host" && cfg.ReferrerDetail != "path" {
+		log.Panic().Msgf("config: invalid REFERRER_DETAIL %q", cfg.ReferrerDetail)
+	}
+	if cfg.LogFormat != "console" && cfg.LogFormat != "json" {
+		log.Panic().Msgf("config: invalid LOG_FORMAT %q", cfg.LogFormat)
+	}
+	if cfg.Store != StorePostgres && cfg.Store != StoreMemory {
+		log.Panic().Msgf("config: invalid STORE %q", cfg.Store)
+	}
+
+	if !links.ValidRedirectCode(cfg.RedirectCode) {
+		log.Panic().Msgf("config: invalid REDIRECT_CODE %d", cfg.RedirectCode)
+	}
+
+	if _, err := ratelimit.ParseCIDRs(cfg.RateAllow); err != nil {
+		log.Panic().Err(err).Msg("config: invalid RATE_ALLOW")
+	}
+	if _, err := ratelimit.ParseCIDRs(cfg.TrustedProxies); err != nil {
+		log.Panic().Err(err).Msg("config: invalid TRUSTED_PROXIES")
+	}
+	if _, err := apikey.Parse(cfg.APIKeys, cfg.APIAdmins); err != nil {
+		log.Panic().Err(err).Msg("config: invalid API_KEYS")
+	}
+	if cfg.RateWindow <= 0 {
+		log.Panic().Msgf("config: invalid RATE_WINDOW %s", cfg.RateWindow)
+	}
+
+	for _, hook := range cfg.Webhooks {
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Panic().Msgf("config: invalid webhook URL %q", hook)
+		}
+	}
+	if len(cfg.Webhooks) > 0 && cfg.WebhookSecret == "" {
+		log.Panic().Msg("config: WEBHOOK_SECRET is required with WEBHOOKS")
+	}
+	if (cfg.SignedLinks || cfg.SignPrevious != "") && cfg.SignSecret == "" {
+		log.Panic().Msg("config: SIGN_SECRET is required with SIGNED_LINKS and SIGN_SECRET_PREVIOUS")
+	}
+	if (cfg.GenTLSCert == "") != (cfg.GenTLSKey == "") {
+		log.Panic().Msg("config: GEN_TLS_CERT and GEN_TLS_KEY must be set together")
+	}
+	if (cfg.GenTLSClientCert == "") != (cfg.GenTLSClientKey == "") {
+		log.Panic().Msg("config: GEN_TLS_CLIENT_CERT and GEN_TLS_CLIENT_KEY must be set together")
+	}
+	if cfg.GenTLSClientCA != "" && cfg.GenTLSCert == "" {
+		log.Panic().Msg("config: GEN_TLS_CLIENT_CA needs GEN_TLS_CERT")
+	}
+	if cfg.TraceRatio < 0 || cfg.TraceRatio > 1 {
+		log.Panic().Msgf("config: TRACE_RATIO must be between 0 and 1, got %f", cfg.TraceRatio)
+	}
+	if cfg.Preview && (cfg.PreviewTimeout <= 0 || cfg.PreviewMaxBytes <= 0) {
+		log.Panic().Msg("config: PREVIEW_TIMEOUT and PREVIEW_MAX_BYTES must be > 0")
+	}
+	if cfg.GeoIPReload < 0 {
+		log.Panic().Msgf("config: GEOIP_RELOAD must be >= 0, got %s", cfg.GeoIPReload)
+	}
+	// written so NaN is rejected too
+	if !(cfg.BloomHeadroom > 1) {
+		log.Panic().Msgf("config: BLOOM_HEADROOM must be > 1, got %f", cfg.BloomHeadroom)
+	}
+	if cfg.WarmLinks < 0 {
+		log.Panic().Msgf("config: WARM_LINKS must be >= 0, got %d", cfg.WarmLinks)
+	}
+	if cfg.WebhookRetries < 0 {
+		log.Panic().Msgf("config: WEBHOOK_RETRIES must be >= 0, got %d", cfg.WebhookRetries)
+	}
+
+	if cfg.Alphabet != "" {
+		if err := idgen.Validate(cfg.Alphabet, cfg.IDSize, cfg.BloomMaxLimit); err != nil {
+			log.Panic().Err(err).Msg("config: invalid ALPHABET")
+		}
+	}
+	if _, err := idgen.For(cfg.Alphabet, cfg.RNG); err != nil {
+		log.Panic().Msgf("config: invalid ID_RNG %q", cfg.RNG)
+	}
+	alphabet := cfg.Alphabet
+	if alphabet == "" {
+		alphabet = idgen.DefaultAlphabet
+	}
+	if _, err := idgen.Partition(alphabet, cfg.Partition, cfg.Partitions); err != nil {
+		log.Panic().Msgf("config: PARTITION must be >= 0 and below PARTITIONS, which can't exceed the alphabet size, got %d of %d",
+			cfg.Partition, cfg.Partitions)
+	}
+	if cfg.CaseInsensitive {
+		if _, err := idgen.NewCaseFolder(alphabet); err != nil {
+			log.Panic().Err(err).Msg("config: CASE_INSENSITIVE needs an ALPHABET without letters in both cases")
+		}
 	}
 
 	return &cfg
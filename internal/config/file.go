@@ -0,0 +1,81 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const DefaultFile = "wormholes.yaml"
+
+var (
+	environment     map[string]string
+	environmentOnce sync.Once
+)
+
+// Environment to parse config from. Settings are read from the YAML file at
+// CONFIG_FILE, keyed by lowercase env names like bloom_max, and env
+// variables take precedence over them. A missing file is skipped.
+func Environment() map[string]string {
+	environmentOnce.Do(func() {
+		path, ok := os.LookupEnv("CONFIG_FILE")
+		if !ok {
+			path = DefaultFile
+		}
+
+		var err error
+		environment, err = readFile(path)
+		if err != nil {
+			log.Panic().Err(err).Msgf("config: failed to read %s", path)
+		}
+
+		for _, kv := range os.Environ() {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				environment[k] = v
+			}
+		}
+	})
+
+	return environment
+}
+
+func readFile(path string) (map[string]string, error) {
+	vars := make(map[string]string)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return vars, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var settings map[string]any
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, err
+	}
+
+	for key, value := range settings {
+		switch value := value.(type) {
+		case []any:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			vars[strings.ToUpper(key)] = strings.Join(items, ",")
+		case map[string]any:
+			return nil, fmt.Errorf("config: %s must be a value or a list", key)
+		case nil:
+			vars[strings.ToUpper(key)] = ""
+		default:
+			vars[strings.ToUpper(key)] = fmt.Sprint(value)
+		}
+	}
+
+	return vars, nil
+}
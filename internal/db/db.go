@@ -1,18 +1,20 @@
 package db
 
 import (
+	"wormholes/internal/config"
+
 	"github.com/caarlos0/env/v6"
 	"github.com/rs/zerolog/log"
 )
 
 type Config struct {
-	REDIS_URI string `env:"REDIS_URI" envDefault:"redis://localhost:6379/0"`
+	Redis
 	Postgres
 }
 
 func Load() *Config {
 	var cfg Config
-	if err := env.Parse(&cfg); err != nil {
+	if err := env.Parse(&cfg, env.Options{Environment: config.Environment()}); err != nil {
 		log.Panic().Err(err).Msg("db_config: failed to parse")
 	}
 
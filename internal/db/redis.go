@@ -0,0 +1,43 @@
+package db
+
+import (
+	"wormholes/internal/cache"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	RedisSingle   = "single"
+	RedisSentinel = "sentinel"
+	RedisCluster  = "cluster"
+)
+
+// Config for Redis, a single node by default.
+type Redis struct {
+	URI  string `env:"REDIS_URI" envDefault:"redis://localhost:6379/0"`
+	Mode string `env:"REDIS_MODE" envDefault:"single"`
+	// Sentinel or Cluster node addresses, URI is only used by single nodes
+	Addrs    []string `env:"REDIS_ADDRS"`
+	Master   string   `env:"REDIS_MASTER" envDefault:"mymaster"`
+	Password string   `env:"REDIS_PASSWORD"`
+}
+
+func (db *Redis) Connect() *cache.Cache {
+	switch db.Mode {
+	case RedisSingle:
+		return cache.New(db.URI)
+	case RedisSentinel, RedisCluster:
+		if len(db.Addrs) == 0 {
+			log.Fatal().Msgf("redis: REDIS_ADDRS is required in %s mode", db.Mode)
+		}
+		if db.Mode == RedisSentinel {
+			return cache.NewSentinel(db.Master, db.Addrs, db.Password)
+		}
+
+		return cache.NewCluster(db.Addrs, db.Password)
+	default:
+		log.Fatal().Msgf("redis: invalid REDIS_MODE %q", db.Mode)
+
+		return nil
+	}
+}
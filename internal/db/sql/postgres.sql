@@ -1,8 +1,84 @@
 -- links
 create table if not exists links (
-  id text primary key,
+  domain text not null default '',
+  id text not null,
   tag text,
+  tags text[] not null default '{}',
   target text,
-  created_at timestamptz not null default now()
+  clicks bigint not null default 0,
+  max_clicks bigint not null default 0,
+  expires_at timestamptz,
+  deleted_at timestamptz,
+  password_hash text,
+  title text,
+  image text,
+  geo_rules jsonb,
+  variants jsonb,
+  redirect_code integer not null default 0,
+  owner text,
+  signed boolean not null default false,
+  created_at timestamptz not null default now(),
+  primary key (domain, id)
 );
 
+alter table links add column if not exists clicks bigint not null default 0;
+alter table links add column if not exists max_clicks bigint not null default 0;
+alter table links add column if not exists expires_at timestamptz;
+alter table links add column if not exists deleted_at timestamptz;
+alter table links add column if not exists password_hash text;
+alter table links add column if not exists title text;
+alter table links add column if not exists image text;
+alter table links add column if not exists geo_rules jsonb;
+alter table links add column if not exists variants jsonb;
+alter table links add column if not exists redirect_code integer not null default 0;
+alter table links add column if not exists owner text;
+alter table links add column if not exists signed boolean not null default false;
+
+alter table links add column if not exists tags text[] not null default '{}';
+
+-- ids are unique per domain, tables created before domains are keyed by id
+alter table links add column if not exists domain text not null default '';
+do $$
+begin
+  if not exists (
+    select 1 from information_schema.key_column_usage
+    where table_name = 'links' and constraint_name = 'links_pkey' and column_name = 'domain'
+  ) then
+    alter table links drop constraint if exists links_pkey;
+    alter table links add primary key (domain, id);
+  end if;
+end $$;
+
+-- rows created before tags only have a tag, reads fall back to it
+create index if not exists links_tag_idx on links (tag);
+create index if not exists links_tags_idx on links using gin (tags);
+create index if not exists links_owner_idx on links (owner, id) where owner is not null;
+
+-- clicks
+create table if not exists clicks (
+  domain text not null default '',
+  link_id text not null,
+  created_at timestamptz not null,
+  ip inet,
+  user_agent text,
+  country text,
+  city text,
+  asn bigint,
+  organization text,
+  browser text,
+  os text,
+  device text,
+  bot boolean not null default false,
+  referrer text,
+  variant integer
+);
+
+alter table clicks add column if not exists domain text not null default '';
+alter table clicks add column if not exists browser text;
+alter table clicks add column if not exists os text;
+alter table clicks add column if not exists device text;
+alter table clicks add column if not exists bot boolean not null default false;
+alter table clicks add column if not exists referrer text;
+alter table clicks add column if not exists variant integer;
+
+create index if not exists clicks_link_id_created_at_idx on clicks (link_id, created_at);
@@ -0,0 +1,113 @@
+package geoip
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const downloadURL = "https://download.maxmind.com/app/geoip_download"
+
+var ErrChecksum = errors.New("geoip: checksum mismatch")
+
+var client = &http.Client{Timeout: time.Minute * 5}
+
+// Download the database of edition, like GeoLite2-City, into dir unless it
+// was downloaded within refresh. MaxMind publishes updates weekly.
+func Download(dir, edition, licenseKey string, refresh time.Duration) error {
+	path := filepath.Join(dir, edition+".mmdb")
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < refresh {
+		return nil
+	}
+
+	log.Info().Msgf("geoip: downloading %s", edition)
+
+	archive, err := fetch(edition, licenseKey, "tar.gz")
+	if err != nil {
+		return err
+	}
+	checksum, err := fetch(edition, licenseKey, "tar.gz.sha256")
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(archive)
+	expected, _, _ := strings.Cut(strings.TrimSpace(string(checksum)), " ")
+	if hex.EncodeToString(sum[:]) != expected {
+		return ErrChecksum
+	}
+
+	return extract(archive, edition+".mmdb", path)
+}
+
+func fetch(edition, licenseKey, suffix string) ([]byte, error) {
+	query := url.Values{
+		"edition_id":  {edition},
+		"license_key": {licenseKey},
+		"suffix":      {suffix},
+	}
+
+	resp, err := client.Get(downloadURL + "?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("geoip: failed to download %s: %s", edition, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// Write the file named name in a tar.gz archive to path.
+func extract(archive []byte, name, path string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	r := tar.NewReader(gz)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return fmt.Errorf("geoip: %s not found in archive", name)
+		}
+		if err != nil {
+			return err
+		}
+		if filepath.Base(header.Name) != name {
+			continue
+		}
+
+		tmp, err := os.CreateTemp(filepath.Dir(path), name+".*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+
+		_, err = io.Copy(tmp, r)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+
+		return os.Rename(tmp.Name(), path)
+	}
+}
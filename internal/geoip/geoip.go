@@ -0,0 +1,174 @@
+package geoip
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	CityDB    = "GeoLite2-City.mmdb"
+	CountryDB = "GeoLite2-Country.mmdb"
+	ASNDB     = "GeoLite2-ASN.mmdb"
+	Unknown   = "unknown"
+)
+
+var ErrNoDB = errors.New("geoip: no database found")
+
+// Location of an IP, fields not known are Unknown. The autonomous system is
+// only set when an ASN database is open.
+type Location struct {
+	Country      string `json:"country"`
+	City         string `json:"city"`
+	ASN          uint   `json:"asn,omitempty"`
+	Organization string `json:"organization,omitempty"`
+}
+
+// Reader looks up locations of IPs.
+type Reader interface {
+	Lookup(ip net.IP) Location
+	Close() error
+}
+
+// Open the City database in dir, falling back to the Country database.
+// Without either, a reader of unknown locations is returned with ErrNoDB.
+func Open(dir string) (Reader, error) {
+	for _, name := range []string{CityDB, CountryDB} {
+		reader, err := OpenFile(filepath.Join(dir, name))
+		if err == ErrNoDB {
+			continue
+		}
+
+		return reader, err
+	}
+
+	return noopReader{}, ErrNoDB
+}
+
+// Open the City or Country database at path, told apart by its metadata.
+// Failing that, a reader of unknown locations is returned with the error,
+// ErrNoDB if there is no such file.
+func OpenFile(path string) (Reader, error) {
+	db, err := geoip2.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return noopReader{}, ErrNoDB
+	}
+	if err != nil {
+		return noopReader{}, err
+	}
+
+	log.Info().Msgf("geoip: using %s", path)
+	if strings.Contains(db.Metadata().DatabaseType, "City") {
+		return cityReader{db}, nil
+	}
+
+	return countryReader{db}, nil
+}
+
+// Open the ASN database in dir, ErrNoDB if there is none.
+func OpenASN(dir string) (*geoip2.Reader, error) {
+	path := filepath.Join(dir, ASNDB)
+
+	db, err := geoip2.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoDB
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Msgf("geoip: using %s", path)
+
+	return db, nil
+}
+
+// WithASN adds the autonomous system from asn to locations looked up by r.
+func WithASN(r Reader, asn *geoip2.Reader) Reader {
+	return asnReader{Reader: r, asn: asn}
+}
+
+type asnReader struct {
+	Reader
+	asn *geoip2.Reader
+}
+
+func (r asnReader) Lookup(ip net.IP) Location {
+	location := r.Reader.Lookup(ip)
+
+	record, err := r.asn.ASN(ip)
+	if err == nil {
+		location.ASN = record.AutonomousSystemNumber
+		location.Organization = record.AutonomousSystemOrganization
+	}
+
+	return location
+}
+
+func (r asnReader) Close() error {
+	err := r.Reader.Close()
+	if asnErr := r.asn.Close(); err == nil {
+		err = asnErr
+	}
+
+	return err
+}
+
+func known(name string) string {
+	if name == "" {
+		return Unknown
+	}
+
+	return name
+}
+
+type cityReader struct {
+	db *geoip2.Reader
+}
+
+func (r cityReader) Lookup(ip net.IP) Location {
+	record, err := r.db.City(ip)
+	if err != nil {
+		return Location{Country: Unknown, City: Unknown}
+	}
+
+	return Location{
+		Country: known(record.Country.IsoCode),
+		City:    known(record.City.Names["en"]),
+	}
+}
+
+func (r cityReader) Close() error {
+	return r.db.Close()
+}
+
+type countryReader struct {
+	db *geoip2.Reader
+}
+
+func (r countryReader) Lookup(ip net.IP) Location {
+	record, err := r.db.Country(ip)
+	if err != nil {
+		return Location{Country: Unknown, City: Unknown}
+	}
+
+	return Location{Country: known(record.Country.IsoCode), City: Unknown}
+}
+
+func (r countryReader) Close() error {
+	return r.db.Close()
+}
+
+type noopReader struct{}
+
+func (noopReader) Lookup(net.IP) Location {
+	return Location{Country: Unknown, City: Unknown}
+}
+
+func (noopReader) Close() error {
+	return nil
+}
@@ -0,0 +1,124 @@
+package geoip
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Encoders of the MaxMind DB data format, for the types a database needs.
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func mmdbUint(v uint16) []byte {
+	return []byte{5<<5 | 2, byte(v >> 8), byte(v)}
+}
+
+// Map of pairs of keys and encoded values.
+func mmdbMap(pairs ...any) []byte {
+	data := []byte{7<<5 | byte(len(pairs)/2)}
+	for i := 0; i < len(pairs); i += 2 {
+		data = append(data, mmdbString(pairs[i].(string))...)
+		data = append(data, pairs[i+1].([]byte)...)
+	}
+
+	return data
+}
+
+// Write an IPv4 database of kind, like GeoLite2-City, to path. IPs starting
+// with bit 1, like 203.0.113.1, are located at record, others are unknown.
+func writeDB(t *testing.T, path, kind string, record []byte) {
+	t.Helper()
+	// a single node of two 24 bit records, no data for bit 0 and data at
+	// offset 0 for bit 1, past the node count and the separator
+	var db bytes.Buffer
+	db.Write([]byte{0, 0, 1, 0, 0, 1 + 16})
+	db.Write(make([]byte, 16))
+	db.Write(record)
+	db.WriteString("\xAB\xCD\xEFMaxMind.com")
+	db.Write(mmdbMap(
+		"binary_format_major_version", mmdbUint(2),
+		"binary_format_minor_version", mmdbUint(0),
+		"database_type", mmdbString(kind),
+		"ip_version", mmdbUint(4),
+		"node_count", mmdbUint(1),
+		"record_size", mmdbUint(24),
+	))
+	if err := os.WriteFile(path, db.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenMissing(t *testing.T) {
+	reader, err := Open(t.TempDir())
+	if err != ErrNoDB {
+		t.Errorf("got %v opening an empty directory, want %v", err, ErrNoDB)
+	}
+	// locations are unknown rather than failing
+	want := Location{Country: Unknown, City: Unknown}
+	if got := reader.Lookup(net.ParseIP("203.0.113.1")); got != want {
+		t.Errorf("got %+v without a database, want %+v", got, want)
+	}
+	if err := reader.Close(); err != nil {
+		t.Errorf("got %v closing without a database", err)
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, CityDB), []byte("not a database"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := Open(dir)
+	if err == nil || errors.Is(err, ErrNoDB) {
+		t.Errorf("got %v opening an invalid database, want its error", err)
+	}
+	if got := reader.Lookup(net.ParseIP("203.0.113.1")); got.Country != Unknown {
+		t.Errorf("got country %s from an invalid database, want %s", got.Country, Unknown)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	germany := mmdbMap("iso_code", mmdbString("DE"))
+	tests := []struct {
+		name   string
+		file   string
+		kind   string
+		record []byte
+		want   Location
+	}{
+		{"city", CityDB, "GeoLite2-City", mmdbMap(
+			"city", mmdbMap("names", mmdbMap("en", mmdbString("Berlin"))),
+			"country", germany,
+		), Location{Country: "DE", City: "Berlin"}},
+		{"country fallback", CountryDB, "GeoLite2-Country", mmdbMap(
+			"country", germany,
+		), Location{Country: "DE", City: Unknown}},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		writeDB(t, filepath.Join(dir, test.file), test.kind, test.record)
+
+		reader, err := Open(dir)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+
+			continue
+		}
+		if got := reader.Lookup(net.ParseIP("203.0.113.1")); got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+		unknown := Location{Country: Unknown, City: Unknown}
+		if got := reader.Lookup(net.ParseIP("10.0.0.1")); got != unknown {
+			t.Errorf("%s: got %+v for an IP not in the database, want %+v", test.name, got, unknown)
+		}
+		if err := reader.Close(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
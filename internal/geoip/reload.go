@@ -0,0 +1,66 @@
+package geoip
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Readers replaced by a reload are closed after this, so lookups already
+// running on them finish first.
+const closeDelay = time.Minute
+
+// A Reader that can be reloaded while in use, for databases updated while
+// running. The reader is swapped atomically, lookups never wait on a reload.
+type Reloader struct {
+	open    func() (Reader, error)
+	current atomic.Pointer[current]
+	// one reload at a time
+	mutex sync.Mutex
+}
+
+type current struct {
+	Reader
+}
+
+// NewReloader opens a reader with open, which is called again by Reload.
+// Like Open, the reader is returned along with the error of open, if any.
+func NewReloader(open func() (Reader, error)) (*Reloader, error) {
+	reader, err := open()
+	r := &Reloader{open: open}
+	r.current.Store(&current{reader})
+
+	return r, err
+}
+
+func (r *Reloader) Lookup(ip net.IP) Location {
+	return r.current.Load().Lookup(ip)
+}
+
+// Reload opens the databases again and swaps the reader for the new one. If
+// they fail to open, the old reader is kept and the error returned.
+func (r *Reloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	reader, err := r.open()
+	if err != nil {
+		if reader != nil {
+			reader.Close()
+		}
+
+		return err
+	}
+
+	old := r.current.Swap(&current{reader})
+	time.AfterFunc(closeDelay, func() {
+		old.Close()
+	})
+
+	return nil
+}
+
+func (r *Reloader) Close() error {
+	return r.current.Load().Close()
+}
@@ -0,0 +1,310 @@
+package idgen
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/bits"
+	mrand "math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/noquark/nanoid"
+)
+
+const (
+	// Headroom the keyspace must have over the expected number of ids.
+	KeyspaceHeadroom = 10
+	// Characters used by nanoid.
+	DefaultAlphabet = "_-0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+)
+
+// Random sources ids can be generated with.
+const (
+	SecureRNG = "secure"
+	// Seeded PCG, ids can be predicted from earlier ones.
+	FastRNG = "fast"
+)
+
+var (
+	ErrShortAlphabet = errors.New("idgen: alphabet needs at least 2 characters")
+	ErrRNG           = errors.New("idgen: unknown random source")
+	ErrPartition     = errors.New("idgen: partition must be below the number of partitions, which can't exceed the alphabet size")
+)
+
+// A random id generator for a custom alphabet, producing ids the same way
+// nanoid does with a secure random source.
+type Generator struct {
+	alphabet []rune
+	mask     int
+	// ids are generated with a PCG instead of the secure source.
+	fast bool
+	// the alphabet if it is all ASCII, for generating ids as bytes.
+	ascii string
+}
+
+func New(alphabet string) *Generator {
+	runes := []rune(alphabet)
+
+	return &Generator{
+		alphabet: runes,
+		mask:     1<<bits.Len(uint(len(runes)-1)) - 1,
+	}
+}
+
+// NewFast is like New with a PCG source seeded from the secure one, which
+// is faster but makes ids guessable.
+func NewFast(alphabet string) *Generator {
+	g := New(alphabet)
+	g.fast = true
+	if len(g.alphabet) == len(alphabet) {
+		g.ascii = alphabet
+	}
+
+	return g
+}
+
+// Generate function for ids of alphabet, nanoid for the default alphabet and
+// source.
+func For(alphabet, rng string) (func(size int) (string, error), error) {
+	if alphabet == "" {
+		alphabet = DefaultAlphabet
+	}
+
+	switch rng {
+	case SecureRNG:
+		if alphabet == DefaultAlphabet {
+			return func(n int) (string, error) { return nanoid.New(n) }, nil
+		}
+		return New(alphabet).Generate, nil
+	case FastRNG:
+		return NewFast(alphabet).Generate, nil
+	default:
+		return nil, ErrRNG
+	}
+}
+
+// PCG sources are not safe for concurrent use, each is used by one
+// goroutine at a time.
+var pcgs = sync.Pool{
+	New: func() any {
+		var seed [16]byte
+		if _, err := rand.Read(seed[:]); err != nil {
+			panic(err)
+		}
+
+		return mrand.NewPCG(binary.LittleEndian.Uint64(seed[:8]), binary.LittleEndian.Uint64(seed[8:]))
+	},
+}
+
+// Generate an id of given size from a pooled PCG, using the bits of each
+// random word directly.
+func (g *Generator) generateFast(size int) string {
+	pcg := pcgs.Get().(*mrand.PCG)
+	defer pcgs.Put(pcg)
+
+	if g.ascii != "" {
+		id := make([]byte, 0, size)
+		for {
+			word := pcg.Uint64()
+			for i := 0; i < 8; i++ {
+				idx := int(word>>(8*i)) & g.mask
+				if idx < len(g.ascii) {
+					id = append(id, g.ascii[idx])
+					if len(id) == size {
+						// never written again
+						return unsafe.String(unsafe.SliceData(id), size)
+					}
+				}
+			}
+		}
+	}
+
+	id := make([]rune, 0, size)
+	for {
+		word := pcg.Uint64()
+		for i := 0; i < 8; i++ {
+			idx := int(word>>(8*i)) & g.mask
+			if idx < len(g.alphabet) {
+				id = append(id, g.alphabet[idx])
+				if len(id) == size {
+					return string(id)
+				}
+			}
+		}
+	}
+}
+
+// Generate an id of given size.
+func (g *Generator) Generate(size int) (string, error) {
+	if g.fast {
+		return g.generateFast(size), nil
+	}
+
+	id := make([]rune, 0, size)
+	// random bytes outside the alphabet are discarded, so read a few more
+	// than needed to avoid extra reads in the common case.
+	step := 1 + int(1.6*float64(g.mask*size)/float64(len(g.alphabet)))
+	buf := make([]byte, step)
+
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+
+		for _, b := range buf {
+			idx := int(b) & g.mask
+			if idx < len(g.alphabet) {
+				id = append(id, g.alphabet[idx])
+				if len(id) == size {
+					return string(id), nil
+				}
+			}
+		}
+	}
+}
+
+// Hash derives an id of given size from data, the same data always giving
+// the same id. Each attempt after the first rehashes data with the attempt
+// number, for resolving collisions. Sizes beyond what a SHA-256 digest can
+// fill are padded with the first character of alphabet.
+func Hash(data string, attempt int, alphabet string, size int) string {
+	if attempt > 0 {
+		data += "#" + strconv.Itoa(attempt)
+	}
+	sum := sha256.Sum256([]byte(data))
+
+	runes := []rune(alphabet)
+	base := big.NewInt(int64(len(runes)))
+	num := new(big.Int).SetBytes(sum[:])
+	digit := new(big.Int)
+
+	id := make([]rune, size)
+	for i := range id {
+		num.DivMod(num, base, digit)
+		id[i] = runes[digit.Int64()]
+	}
+
+	return string(id)
+}
+
+// Maps characters of ids to their case in an alphabet that has no letter in
+// both cases, so ids can be matched regardless of case.
+type CaseFolder map[rune]rune
+
+func NewCaseFolder(alphabet string) (CaseFolder, error) {
+	folder := make(CaseFolder)
+	for _, r := range alphabet {
+		lower := unicode.ToLower(r)
+		if other, ok := folder[lower]; ok {
+			return nil, fmt.Errorf("idgen: alphabet has %q and %q, the same letter in different case", other, r)
+		}
+		folder[lower] = r
+	}
+
+	return folder, nil
+}
+
+// Fold id to the case of the alphabet, characters not in it are kept as is.
+func (f CaseFolder) Fold(id string) string {
+	return strings.Map(func(r rune) rune {
+		if c, ok := f[unicode.ToLower(r)]; ok {
+			return c
+		}
+
+		return r
+	}, id)
+}
+
+// Validate checks that alphabet has no duplicates and that ids of given size
+// leave enough room for maxLimit ids.
+func Validate(alphabet string, size int, maxLimit uint) error {
+	runes := []rune(alphabet)
+	if len(runes) < 2 {
+		return ErrShortAlphabet
+	}
+
+	seen := make(map[rune]struct{}, len(runes))
+	for _, r := range runes {
+		if _, ok := seen[r]; ok {
+			return fmt.Errorf("idgen: alphabet has duplicate character %q", r)
+		}
+		seen[r] = struct{}{}
+	}
+
+	if Keyspace(len(runes), size) < float64(maxLimit)*KeyspaceHeadroom {
+		return fmt.Errorf("idgen: %d characters of size %d are too few for %d ids", len(runes), size, maxLimit)
+	}
+
+	return nil
+}
+
+// Keyspace is the number of ids of given size from an alphabet of length
+// characters.
+func Keyspace(length, size int) float64 {
+	total := 1.0
+	for i := 0; i < size; i++ {
+		total *= float64(length)
+	}
+
+	return total
+}
+
+// Valid reports whether id is between minSize and maxSize characters, all
+// from alphabet.
+func Valid(id, alphabet string, minSize, maxSize int) bool {
+	size := 0
+	for _, r := range id {
+		if !strings.ContainsRune(alphabet, r) {
+			return false
+		}
+		size++
+	}
+
+	return size >= minSize && size <= maxSize
+}
+
+// Partition returns the characters ids of partition index of count start
+// with, splitting alphabet into contiguous ranges. Generators of different
+// partitions of the same alphabet never produce the same id.
+func Partition(alphabet string, index, count int) (string, error) {
+	runes := []rune(alphabet)
+	if count <= 0 || count > len(runes) || index < 0 || index >= count {
+		return "", ErrPartition
+	}
+
+	return string(runes[index*len(runes)/count : (index+1)*len(runes)/count]), nil
+}
+
+// Partitioned wraps generate, which produces ids of alphabet, so ids start
+// with one of first. The first character of generated ids is mapped into
+// first, characters that would make some more likely than others are
+// generated again.
+func Partitioned(generate func(size int) (string, error), alphabet, first string) func(size int) (string, error) {
+	runes, firsts := []rune(alphabet), []rune(first)
+	position := make(map[rune]int, len(runes))
+	for i, r := range runes {
+		position[r] = i
+	}
+	limit := len(runes) - len(runes)%len(firsts)
+
+	return func(size int) (string, error) {
+		for {
+			id, err := generate(size)
+			if err != nil || id == "" {
+				return id, err
+			}
+			r, width := utf8.DecodeRuneInString(id)
+			if pos := position[r]; pos < limit {
+				return string(firsts[pos%len(firsts)]) + id[width:], nil
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package idgen
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	const size = 7
+	ids := make(map[string]string)
+	for i := 0; i < 10_000; i++ {
+		target := fmt.Sprintf("https://example.com/%d", i)
+		id := Hash(target, 0, DefaultAlphabet, size)
+		if again := Hash(target, 0, DefaultAlphabet, size); again != id {
+			t.Fatalf("%s hashed to %s and %s", target, id, again)
+		}
+		if other, ok := ids[id]; ok {
+			t.Fatalf("%s and %s hashed to the same id %s", other, target, id)
+		}
+		ids[id] = target
+		if !Valid(id, DefaultAlphabet, size, size) {
+			t.Fatalf("hashed id %q isn't %d characters of the alphabet", id, size)
+		}
+	}
+
+	// rehashes give other ids, the same ones each time
+	first := Hash("https://example.com", 0, DefaultAlphabet, size)
+	second := Hash("https://example.com", 1, DefaultAlphabet, size)
+	if first == second || second != Hash("https://example.com", 1, DefaultAlphabet, size) {
+		t.Errorf("got %s and %s for attempts 0 and 1, want different stable ids", first, second)
+	}
+
+	// past what a digest fills, ids are padded with the first character
+	long := Hash("https://example.com", 0, "ab", 300)
+	if len(long) != 300 || long[299] != 'a' {
+		t.Errorf("got %d characters ending in %q, want 300 padded with a", len(long), long[len(long)-1])
+	}
+}
+
+func TestPartitionedNeverOverlap(t *testing.T) {
+	// short ids, so generators of one alphabet repeat each other often
+	const size, draws = 2, 5_000
+	for _, count := range []int{2, 3, 7} {
+		owner := make(map[string]int)
+		for index := 0; index < count; index++ {
+			first, err := Partition(DefaultAlphabet, index, count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			generate, err := For(DefaultAlphabet, FastRNG)
+			if err != nil {
+				t.Fatal(err)
+			}
+			generate = Partitioned(generate, DefaultAlphabet, first)
+
+			for draw := 0; draw < draws; draw++ {
+				id, err := generate(size)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.ContainsRune(first, []rune(id)[0]) {
+					t.Fatalf("%d partitions: id %s of partition %d doesn't start with one of %s", count, id, index, first)
+				}
+				if other, ok := owner[id]; ok && other != index {
+					t.Fatalf("%d partitions: id %s generated by partitions %d and %d", count, id, other, index)
+				}
+				owner[id] = index
+			}
+		}
+	}
+}
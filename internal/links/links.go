@@ -1,17 +1,175 @@
 package links
 
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
 // Link model and constructor
 
 type Link struct {
+	// IDs are unique per domain, the default domain is empty
+	Domain string `json:"domain" redis:"domain"`
 	ID     string `json:"id" redis:"id"`
 	Target string `json:"target" redis:"target"`
 	Tag    string `json:"tag" redis:"tag"`
+	// all tags of the link, Tag is the first of them
+	Tags   []string `json:"tags" redis:"-"`
+	Clicks int64    `json:"clicks" redis:"clicks"`
+	// optional expiry, by time and by number of clicks
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" redis:"expiresAt"`
+	MaxClicks int64      `json:"maxClicks,omitempty" redis:"maxClicks"`
+	// protected links redirect only with a token issued for the password
+	Protected    bool   `json:"protected" redis:"-"`
+	PasswordHash string `json:"-" redis:"passwordHash"`
+	// preview of the target page, fetched after the link is created
+	Title string `json:"title,omitempty" redis:"title"`
+	Image string `json:"image,omitempty" redis:"image"`
+	// targets by ISO country code of visitors, others go to Target
+	GeoRules map[string]string `json:"geoRules,omitempty" redis:"-"`
+	// targets visitors are split between by weight instead of Target
+	Variants []Variant `json:"variants,omitempty" redis:"-"`
+	// status of redirects, 0 for the configured one
+	RedirectCode int `json:"redirectCode,omitempty" redis:"redirectCode"`
+	// ID of the API key that created the link, empty without keys
+	Owner string `json:"owner,omitempty" redis:"owner"`
+	// signed links only resolve with the signature of their ID in the path
+	Signed bool `json:"signed,omitempty" redis:"signed"`
+}
+
+// A target of an A/B split with its share of visitors, weights of a link
+// add up to 1.
+type Variant struct {
+	Target string  `json:"target"`
+	Weight float64 `json:"weight"`
+}
+
+// Target of the rule for visitors from country, if there is one.
+func (l Link) GeoTarget(country string) (string, bool) {
+	target, ok := l.GeoRules[country]
+
+	return target, ok
+}
+
+// Index of the variant for r in [0, 1), each variant taking its weight of
+// the range.
+func (l Link) PickVariant(r float64) int {
+	for i, variant := range l.Variants {
+		if r < variant.Weight {
+			return i
+		}
+		r -= variant.Weight
+	}
+
+	// rounding left r past the last weight
+	return len(l.Variants) - 1
+}
+
+// Partial update of a link, fields left out are not changed. ID is only read
+// to reject attempts to change it.
+type Patch struct {
+	ID     *string   `json:"id"`
+	Target *string   `json:"target"`
+	Tag    *string   `json:"tag"`
+	Tags   *[]string `json:"tags"`
+	// 0 resets it to the configured code
+	RedirectCode *int `json:"redirectCode"`
+}
+
+// Whether code is a redirect status links can respond with.
+func ValidRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+
+	return false
+}
+
+// Whether code is a redirect status that browsers keep.
+func PermanentRedirect(code int) bool {
+	return code == http.StatusMovedPermanently || code == http.StatusPermanentRedirect
+}
+
+// Visit statistics of a link.
+type Stats struct {
+	ID        string    `json:"id"`
+	Clicks    int64     `json:"clicks"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Number of clicks on a link for a key of an analytics dimension.
+type Count struct {
+	Key    string `json:"key"`
+	Clicks int64  `json:"clicks"`
 }
 
-func New(id, target, tag string) *Link {
-	return &Link{
+func New(domain, id, target, tag string) *Link {
+	link := &Link{
+		Domain: domain,
 		ID:     id,
 		Target: target,
 		Tag:    tag,
 	}
+	link.NormalizeTags()
+
+	return link
+}
+
+// Key of link id on domain, unique across domains. Links of the default
+// domain are keyed by their ID alone.
+func Key(domain, id string) string {
+	if domain == "" {
+		return id
+	}
+
+	return domain + "/" + id
+}
+
+// SplitKey is the inverse of Key, IDs never contain a slash.
+func SplitKey(key string) (domain, id string) {
+	if i := strings.LastIndexByte(key, '/'); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+
+	return "", key
+}
+
+// Key of the link, see Key.
+func (l *Link) Key() string {
+	return Key(l.Domain, l.ID)
+}
+
+// NormalizeTags merges Tag into Tags, dropping empty and repeated tags, and
+// sets Tag to the first one.
+func (l *Link) NormalizeTags() {
+	tags := make([]string, 0, len(l.Tags)+1)
+	seen := make(map[string]bool, len(l.Tags)+1)
+
+	for _, tag := range append([]string{l.Tag}, l.Tags...) {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	l.Tags = tags
+	l.Tag = ""
+	if len(tags) > 0 {
+		l.Tag = tags[0]
+	}
+}
+
+// Expired reports whether link stopped working at now, given the clicks
+// counted so far.
+func (l *Link) Expired(now time.Time, clicks int64) bool {
+	if l.ExpiresAt != nil && !now.Before(*l.ExpiresAt) {
+		return true
+	}
+
+	return l.MaxClicks > 0 && clicks >= l.MaxClicks
 }
@@ -0,0 +1,35 @@
+package links
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+
+	tests := []struct {
+		name      string
+		expiresAt *time.Time
+		maxClicks int64
+		clicks    int64
+		expired   bool
+	}{
+		{"no limits", nil, 0, 1000, false},
+		{"before expiry", &future, 0, 0, false},
+		{"at expiry", &now, 0, 0, true},
+		{"past expiry", &past, 0, 0, true},
+		{"below max clicks", nil, 3, 2, false},
+		{"at max clicks", nil, 3, 3, true},
+		{"past max clicks", nil, 3, 4, true},
+		{"clicks left past expiry", &past, 3, 0, true},
+		{"out of clicks before expiry", &future, 3, 3, true},
+	}
+	for _, test := range tests {
+		link := Link{ExpiresAt: test.expiresAt, MaxClicks: test.maxClicks}
+		if got := link.Expired(now, test.clicks); got != test.expired {
+			t.Errorf("%s: expired is %t, want %t", test.name, got, test.expired)
+		}
+	}
+}
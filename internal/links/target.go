@@ -0,0 +1,125 @@
+package links
+
+import (
+	"errors"
+	"math"
+	"net/url"
+	"strings"
+)
+
+var (
+	ErrInvalidTarget  = errors.New("links: invalid target")
+	ErrTargetTooLong  = errors.New("links: target is too long")
+	ErrInvalidCountry = errors.New("links: invalid country code")
+	ErrInvalidWeight  = errors.New("links: invalid variant weight")
+)
+
+const (
+	// Most countries a link can have rules for.
+	MaxGeoRules = 250
+	// Most targets a link can be split between.
+	MaxVariants = 16
+)
+
+// NormalizeTarget checks that target is an absolute URL with one of the
+// allowed schemes, adding https when the scheme is missing and addScheme is
+// set. The host is lowercased so equal targets compare equal. Targets longer
+// than maxLength bytes, before or after normalizing, are rejected with
+// ErrTargetTooLong unless it is 0.
+func NormalizeTarget(target string, schemes []string, addScheme bool, maxLength int) (string, error) {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return "", ErrInvalidTarget
+	}
+	// rejected before parsing a huge value
+	if maxLength > 0 && len(target) > maxLength {
+		return "", ErrTargetTooLong
+	}
+
+	u, err := url.Parse(target)
+	if err == nil && u.Scheme == "" && addScheme && !strings.HasPrefix(target, "/") {
+		u, err = url.Parse("https://" + target)
+	}
+	if err != nil || u.Host == "" || !allowed(u.Scheme, schemes) {
+		return "", ErrInvalidTarget
+	}
+
+	u.Host = strings.ToLower(u.Host)
+	normalized := u.String()
+	if maxLength > 0 && len(normalized) > maxLength {
+		return "", ErrTargetTooLong
+	}
+
+	return normalized, nil
+}
+
+// NormalizeGeoRules checks that rules map two letter country codes to
+// targets, uppercasing the codes and normalizing targets like
+// NormalizeTarget.
+func NormalizeGeoRules(rules map[string]string, schemes []string, addScheme bool, maxLength int) (map[string]string, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	if len(rules) > MaxGeoRules {
+		return nil, ErrInvalidCountry
+	}
+
+	normalized := make(map[string]string, len(rules))
+	for country, target := range rules {
+		if len(country) != 2 || !isLetter(country[0]) || !isLetter(country[1]) {
+			return nil, ErrInvalidCountry
+		}
+		target, err := NormalizeTarget(target, schemes, addScheme, maxLength)
+		if err != nil {
+			return nil, err
+		}
+		normalized[strings.ToUpper(country)] = target
+	}
+
+	return normalized, nil
+}
+
+// NormalizeVariants checks that there are at least two variants with
+// positive weights, normalizing targets like NormalizeTarget and weights to
+// add up to 1.
+func NormalizeVariants(variants []Variant, schemes []string, addScheme bool, maxLength int) ([]Variant, error) {
+	if len(variants) == 0 {
+		return nil, nil
+	}
+	if len(variants) < 2 || len(variants) > MaxVariants {
+		return nil, ErrInvalidWeight
+	}
+
+	total := 0.0
+	for _, variant := range variants {
+		if !(variant.Weight > 0) || math.IsInf(variant.Weight, 0) {
+			return nil, ErrInvalidWeight
+		}
+		total += variant.Weight
+	}
+
+	normalized := make([]Variant, len(variants))
+	for i, variant := range variants {
+		target, err := NormalizeTarget(variant.Target, schemes, addScheme, maxLength)
+		if err != nil {
+			return nil, err
+		}
+		normalized[i] = Variant{target, variant.Weight / total}
+	}
+
+	return normalized, nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func allowed(scheme string, schemes []string) bool {
+	for _, s := range schemes {
+		if strings.EqualFold(scheme, s) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+package links
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTarget(t *testing.T) {
+	schemes := []string{"http", "https"}
+	tests := []struct {
+		name      string
+		target    string
+		addScheme bool
+		want      string
+		err       error
+	}{
+		{"valid", "https://example.com/path?q=1", false, "https://example.com/path?q=1", nil},
+		{"host is lowercased", " https://EXAMPLE.com/Path ", false, "https://example.com/Path", nil},
+		{"scheme is case insensitive", "HTTP://example.com", false, "http://example.com", nil},
+		{"missing scheme", "example.com/path", false, "", ErrInvalidTarget},
+		{"missing scheme added", "example.com/path", true, "https://example.com/path", nil},
+		{"relative path", "/path", true, "", ErrInvalidTarget},
+		{"disallowed scheme", "javascript:alert(1)", false, "", ErrInvalidTarget},
+		{"disallowed scheme with host", "ftp://example.com/file", true, "", ErrInvalidTarget},
+		{"malformed", "https://exa mple.com/%zz", false, "", ErrInvalidTarget},
+		{"malformed port", "http://example.com:port", false, "", ErrInvalidTarget},
+		{"no host", "https://", false, "", ErrInvalidTarget},
+		{"empty", "  ", false, "", ErrInvalidTarget},
+	}
+	for _, test := range tests {
+		got, err := NormalizeTarget(test.target, schemes, test.addScheme, 0)
+		if got != test.want || err != test.err {
+			t.Errorf("%s: got %q, %v, want %q, %v", test.name, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestNormalizeTargetLength(t *testing.T) {
+	schemes := []string{"https"}
+	atLimit := "https://example.com/" + strings.Repeat("a", 80)
+	tests := []struct {
+		name      string
+		target    string
+		addScheme bool
+		err       error
+	}{
+		{"at the limit", atLimit, false, nil},
+		{"over the limit", atLimit + "a", false, ErrTargetTooLong},
+		{"at the limit with spaces", "  " + atLimit + "  ", false, nil},
+		{"over the limit once normalized", strings.TrimPrefix(atLimit, "https://") + "a", true, ErrTargetTooLong},
+		{"at the limit once normalized", strings.TrimPrefix(atLimit, "https://"), true, nil},
+	}
+	for _, test := range tests {
+		_, err := NormalizeTarget(test.target, schemes, test.addScheme, len(atLimit))
+		if err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+	if _, err := NormalizeTarget(atLimit+"a", schemes, false, 0); err != nil {
+		t.Errorf("got %v without a limit, want none", err)
+	}
+}
@@ -0,0 +1,42 @@
+package links
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Longest TTL of a link, longer ones are more likely mistakes than intents.
+const MaxTTL = time.Hour * 24 * 365 * 10
+
+var ErrInvalidTTL = errors.New("links: invalid ttl")
+
+// ParseTTL parses a duration like time.ParseDuration, with days as a leading
+// d unit, e.g. 7d or 1d12h. TTLs must be positive and at most MaxTTL.
+func ParseTTL(s string) (time.Duration, error) {
+	var ttl time.Duration
+	if days, rest, ok := strings.Cut(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		// written so NaN is rejected too
+		if err != nil || !(n >= 0 && n <= MaxTTL.Hours()/24) {
+			return 0, ErrInvalidTTL
+		}
+		ttl = time.Duration(n * float64(time.Hour*24))
+		s = rest
+	}
+
+	if s != "" {
+		rest, err := time.ParseDuration(s)
+		if err != nil || rest < 0 {
+			return 0, ErrInvalidTTL
+		}
+		ttl += rest
+	}
+
+	if ttl <= 0 || ttl > MaxTTL {
+		return 0, ErrInvalidTTL
+	}
+
+	return ttl, nil
+}
@@ -0,0 +1,45 @@
+package links
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTTL(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		ttl  string
+		want time.Duration
+		err  error
+	}{
+		{"12h", 12 * time.Hour, nil},
+		{"90s", 90 * time.Second, nil},
+		{"7d", 7 * day, nil},
+		{"1d12h", day + 12*time.Hour, nil},
+		{"1.5d", day + 12*time.Hour, nil},
+		{"0d30m", 30 * time.Minute, nil},
+		{"3650d", MaxTTL, nil},
+		{"", 0, ErrInvalidTTL},
+		{"d", 0, ErrInvalidTTL},
+		{"7", 0, ErrInvalidTTL},
+		{"week", 0, ErrInvalidTTL},
+		{"0d", 0, ErrInvalidTTL},
+		{"0s", 0, ErrInvalidTTL},
+		{"-1d", 0, ErrInvalidTTL},
+		{"-12h", 0, ErrInvalidTTL},
+		{"1d-1h", 0, ErrInvalidTTL},
+		{"1d1d", 0, ErrInvalidTTL},
+		{"h1d", 0, ErrInvalidTTL},
+		{"NaNd", 0, ErrInvalidTTL},
+		{"Infd", 0, ErrInvalidTTL},
+		{"3651d", 0, ErrInvalidTTL},
+		{"3650d1s", 0, ErrInvalidTTL},
+		{"100000h", 0, ErrInvalidTTL},
+	}
+	for _, test := range tests {
+		got, err := ParseTTL(test.ttl)
+		if got != test.want || err != test.err {
+			t.Errorf("%q: got %s, %v, want %s, %v", test.ttl, got, err, test.want, test.err)
+		}
+	}
+}
@@ -1,7 +1,14 @@
 package memstore
 
 import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"unicode/utf8"
 
 	"github.com/dustin/go-humanize"
 	"github.com/rs/zerolog/log"
@@ -11,19 +18,93 @@ type Bucket struct {
 	sync.RWMutex
 	Capacity int
 	Data     []string
+	// set when the bucket could not be filled because of too many collisions.
+	Exhausted bool
+	// IDs generated so far while the bucket is being filled.
+	filling atomic.Pointer[Filling]
 }
 
 func (b *Bucket) Pop() []string {
-	data := make([]string, b.Capacity)
+	// part of the IDs may have been taken while filling
+	data := make([]string, len(b.Data))
 	copy(data, b.Data)
 	b.Data = nil
 	return data
 }
 
+// IDs of a bucket being filled. The IDs generated so far can be taken
+// without waiting for the bucket to fill, the rest are never handed out.
+type Filling struct {
+	ids []string
+	// IDs added so far, only written by the filler.
+	added atomic.Int64
+	// IDs handed out so far, -1 once finished.
+	taken atomic.Int64
+}
+
+// Add the next generated ID, making it available to TakeFilled.
+func (f *Filling) Add(id string) {
+	n := f.added.Load()
+	f.ids[n] = id
+	f.added.Store(n + 1)
+}
+
+// Start filling the bucket, called with the bucket locked.
+func (b *Bucket) StartFilling() *Filling {
+	filling := &Filling{ids: make([]string, b.Capacity)}
+	b.filling.Store(filling)
+	return filling
+}
+
+// Stop filling the bucket, returning the IDs added that weren't taken yet.
+// Called with the bucket locked.
+func (b *Bucket) FinishFilling(filling *Filling) []string {
+	b.filling.Store(nil)
+	taken := filling.taken.Swap(-1)
+	return filling.ids[taken:filling.added.Load()]
+}
+
+// Take the IDs added to a bucket being filled that weren't taken yet, nil
+// if there are none.
+func (b *Bucket) TakeFilled() []string {
+	filling := b.filling.Load()
+	if filling == nil {
+		return nil
+	}
+	for {
+		taken := filling.taken.Load()
+		added := filling.added.Load()
+		if taken < 0 || added <= taken {
+			return nil
+		}
+		if filling.taken.CompareAndSwap(taken, added) {
+			data := make([]string, added-taken)
+			copy(data, filling.ids[taken:added])
+			return data
+		}
+	}
+}
+
 // An in memory store with buckets
 type MemStore struct {
 	Buckets []*Bucket
 	Empty   chan int
+	// closed and replaced every time a bucket is filled.
+	filled      chan struct{}
+	filledMutex sync.Mutex
+	// closed when the store is replaced, its buckets are no longer refilled.
+	retired    chan struct{}
+	retireOnce sync.Once
+}
+
+// Number of buckets in each state.
+type Status struct {
+	Full      int `json:"full"`
+	Busy      int `json:"busy"`
+	Empty     int `json:"empty"`
+	Exhausted int `json:"exhausted"`
+	// IDs in full buckets
+	IDs int `json:"ids"`
 }
 
 // Create a new memory store for given bucket size and capacity.
@@ -31,6 +112,8 @@ func New(size, capacity int) *MemStore {
 	memStore := &MemStore{
 		Buckets: make([]*Bucket, size),
 		Empty:   make(chan int, size),
+		filled:  make(chan struct{}),
+		retired: make(chan struct{}),
 	}
 	for i := range memStore.Buckets {
 		memStore.Buckets[i] = &Bucket{Capacity: capacity}
@@ -42,21 +125,221 @@ func New(size, capacity int) *MemStore {
 	return memStore
 }
 
-// Pop first bucket that is full.
-func (s *MemStore) Pop() []string {
+// Filled returns a channel that is closed when the next bucket is filled.
+func (s *MemStore) Filled() <-chan struct{} {
+	s.filledMutex.Lock()
+	defer s.filledMutex.Unlock()
+	return s.filled
+}
+
+// NotifyFilled wakes up everyone waiting on Filled.
+func (s *MemStore) NotifyFilled() {
+	s.filledMutex.Lock()
+	defer s.filledMutex.Unlock()
+	close(s.filled)
+	s.filled = make(chan struct{})
+}
+
+// Retire marks the store as replaced, buckets left in it are only popped.
+func (s *MemStore) Retire() {
+	s.retireOnce.Do(func() { close(s.retired) })
+}
+
+// Retired returns a channel that is closed when the store is retired.
+func (s *MemStore) Retired() <-chan struct{} {
+	return s.retired
+}
+
+func (s *MemStore) IsRetired() bool {
+	select {
+	case <-s.retired:
+		return true
+	default:
+		return false
+	}
+}
+
+// Adopt moves full buckets of from into empty buckets of s, as many as fit,
+// keeping their IDs. Buckets being filled are left in from. Buckets of s keep
+// their capacity, they are refilled to it once popped.
+func (s *MemStore) Adopt(from *MemStore) int {
+	moved := 0
+	for _, bucket := range s.Buckets {
+		bucket.Lock()
+		if bucket.Data != nil {
+			bucket.Unlock()
+			continue
+		}
+		for _, old := range from.Buckets {
+			if isAvailable := old.TryLock(); isAvailable {
+				if old.Data != nil {
+					bucket.Data, old.Data = old.Data, nil
+				}
+				old.Unlock()
+			}
+			if bucket.Data != nil {
+				moved++
+				break
+			}
+		}
+		bucket.Unlock()
+	}
+	return moved
+}
+
+// Pop up to n buckets that are full in a single pass, concatenating their
+// IDs. nil if none is full.
+func (s *MemStore) Pop(n int) []string {
+	popped := s.PopN(n)
+	if len(popped) == 1 {
+		return popped[0]
+	}
+	var ids []string
+	for _, data := range popped {
+		ids = append(ids, data...)
+	}
+	return ids
+}
+
+// Pop up to n buckets that are full, each is queued to be refilled once
+// popped.
+func (s *MemStore) PopN(n int) [][]string {
+	var popped [][]string
 	for id, bucket := range s.Buckets {
+		if len(popped) == n {
+			break
+		}
 		if isAvailable := bucket.TryLock(); isAvailable {
 			if bucket.Data != nil {
 				data := bucket.Pop()
 				bucket.Unlock()
 				s.Empty <- id
 				log.Info().Msgf("popped bucket %d", id)
-				return data
+				popped = append(popped, data)
 			} else {
 				bucket.Unlock()
 				continue
 			}
 		}
 	}
+	return popped
+}
+
+// Take the IDs generated so far from the first bucket being filled that has
+// any, for when no bucket is full. The bucket keeps being filled.
+func (s *MemStore) PopPartial() []string {
+	for id, bucket := range s.Buckets {
+		if data := bucket.TakeFilled(); data != nil {
+			log.Info().Msgf("popped %d ids of bucket %d being filled", len(data), id)
+			return data
+		}
+	}
 	return nil
 }
+
+// Exhausted reports whether any bucket ran out of unique IDs.
+func (s *MemStore) Exhausted() bool {
+	for _, bucket := range s.Buckets {
+		// busy buckets are still being filled
+		if isAvailable := bucket.TryRLock(); isAvailable {
+			exhausted := bucket.Exhausted
+			bucket.RUnlock()
+			if exhausted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Count buckets that are full, being filled or empty, and IDs of full ones.
+func (s *MemStore) Status() Status {
+	var status Status
+	for _, bucket := range s.Buckets {
+		if isAvailable := bucket.TryRLock(); !isAvailable {
+			status.Busy++
+			continue
+		}
+		if bucket.Data != nil {
+			status.Full++
+			status.IDs += len(bucket.Data)
+		} else if bucket.Exhausted {
+			status.Exhausted++
+		} else {
+			status.Empty++
+		}
+		bucket.RUnlock()
+	}
+	return status
+}
+
+// Dump writes IDs of full buckets to path.
+func (s *MemStore) Dump(path string) error {
+	var buckets [][]string
+	for _, bucket := range s.Buckets {
+		if isAvailable := bucket.TryRLock(); isAvailable {
+			if bucket.Data != nil {
+				buckets = append(buckets, bucket.Data)
+			}
+			bucket.RUnlock()
+		}
+	}
+
+	// written aside and renamed into place, a crash while writing leaves the
+	// previous snapshot
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = gob.NewEncoder(tmp).Encode(buckets)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Restore buckets dumped to path and mark them full. The snapshot is
+// discarded if any ID is not of idSize, and removed once restored so the same
+// IDs are never handed out twice.
+func (s *MemStore) Restore(path string, idSize int) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer os.Remove(path)
+	defer file.Close()
+
+	var buckets [][]string
+	if err := gob.NewDecoder(file).Decode(&buckets); err != nil {
+		return 0, err
+	}
+	for _, ids := range buckets {
+		for _, id := range ids {
+			if utf8.RuneCountInString(id) != idSize {
+				return 0, fmt.Errorf("memstore: id %q is not of size %d", id, idSize)
+			}
+		}
+	}
+
+	restored := 0
+	for _, bucket := range s.Buckets {
+		if restored == len(buckets) {
+			break
+		}
+		bucket.Lock()
+		if bucket.Data == nil {
+			bucket.Data = buckets[restored]
+			restored++
+		}
+		bucket.Unlock()
+	}
+	return restored, nil
+}
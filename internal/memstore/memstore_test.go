@@ -0,0 +1,58 @@
+package memstore
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDumpRestore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "buckets")
+
+	store := New(3, 2)
+	store.Buckets[0].Data = []string{"aaaa", "bbbb"}
+	store.Buckets[2].Data = []string{"cccc", "dddd"}
+	if err := store.Dump(path); err != nil {
+		t.Fatal(err)
+	}
+	// nothing is left aside of the snapshot
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("found %d files after dumping, want only the snapshot", len(entries))
+	}
+
+	restored := New(3, 2)
+	n, err := restored.Restore(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("restored %d buckets, want 2", n)
+	}
+	if !slices.Equal(restored.Buckets[0].Data, []string{"aaaa", "bbbb"}) ||
+		!slices.Equal(restored.Buckets[1].Data, []string{"cccc", "dddd"}) {
+		t.Errorf("restored buckets hold %v and %v", restored.Buckets[0].Data, restored.Buckets[1].Data)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("snapshot is kept after restoring, err %v", err)
+	}
+}
+
+func TestAdoptKeepsCapacity(t *testing.T) {
+	old := New(2, 2)
+	old.Buckets[0].Data = []string{"aaaa", "bbbb"}
+	old.Buckets[1].Data = []string{"cccc", "dddd"}
+
+	store := New(1, 10)
+	if moved := store.Adopt(old); moved != 1 {
+		t.Fatalf("moved %d buckets into 1, want 1", moved)
+	}
+	if bucket := store.Buckets[0]; len(bucket.Data) != 2 || bucket.Capacity != 10 {
+		t.Errorf("adopted bucket holds %d IDs with capacity %d, want 2 with 10", len(bucket.Data), bucket.Capacity)
+	}
+	// the bucket that didn't fit is left to be popped
+	if old.Buckets[0].Data != nil || !slices.Equal(old.Buckets[1].Data, []string{"cccc", "dddd"}) {
+		t.Errorf("old buckets hold %v and %v", old.Buckets[0].Data, old.Buckets[1].Data)
+	}
+}
@@ -0,0 +1,275 @@
+package preview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"wormholes/internal/cache"
+	"wormholes/internal/links"
+	"wormholes/store"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/html"
+)
+
+const (
+	// Sent with every request, robots.txt rules for it are respected.
+	UserAgent    = "wormholes-preview/1.0"
+	queueSize    = 1024
+	workers      = 2
+	maxRedirects = 3
+	// longer titles and image URLs are cut or dropped
+	maxTitle = 300
+	maxImage = 2048
+)
+
+var (
+	ErrNotHTML    = errors.New("preview: target is not an HTML page")
+	ErrDisallowed = errors.New("preview: target is disallowed by robots.txt")
+	ErrPrivate    = errors.New("preview: target resolves to a private address")
+
+	fetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wormholes_preview_fetches_total",
+		Help: "Number of link preview fetches by result.",
+	}, []string{"result"})
+)
+
+// Fetches the title and image of target pages of created links in the
+// background, storing them on the links.
+type Fetcher struct {
+	store    store.Store
+	cache    *cache.Cache
+	client   *http.Client
+	maxBytes int64
+	robots   *robots
+	queue    chan *links.Link
+}
+
+func New(backend store.Store, cache *cache.Cache, timeout time.Duration, maxBytes int64) *Fetcher {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		// targets are user input, never reach into the private network
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+				return ErrPrivate
+			}
+
+			return nil
+		},
+	}
+
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: timeout},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return http.ErrUseLastResponse
+			}
+
+			return nil
+		},
+	}
+
+	f := &Fetcher{
+		store:    backend,
+		cache:    cache,
+		client:   client,
+		maxBytes: maxBytes,
+		queue:    make(chan *links.Link, queueSize),
+	}
+	f.robots = newRobots(f.get)
+
+	return f
+}
+
+func (f *Fetcher) Start() *Fetcher {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for link := range f.queue {
+				f.enrich(link)
+			}
+		}()
+	}
+
+	return f
+}
+
+// Queue created links to be fetched. Links are skipped when the queue is
+// full, sending never blocks.
+func (f *Fetcher) Send(created []*links.Link) {
+	for _, link := range created {
+		// targets of protected links are not to be shared
+		if link.Protected {
+			continue
+		}
+
+		select {
+		case f.queue <- link:
+		default:
+			fetches.WithLabelValues("dropped").Inc()
+		}
+	}
+}
+
+func (f *Fetcher) enrich(link *links.Link) {
+	title, image, err := f.fetch(link.Target)
+	if err != nil {
+		fetches.WithLabelValues("failed").Inc()
+		log.Debug().Err(err).Msgf("preview: failed to fetch %s", link.Target)
+
+		return
+	}
+	if title == "" && image == "" {
+		fetches.WithLabelValues("empty").Inc()
+
+		return
+	}
+
+	if err := f.store.SetPreview(context.Background(), link.Domain, link.ID, title, image); err != nil {
+		fetches.WithLabelValues("failed").Inc()
+		log.Error().Err(err).Msg("preview: failed to store")
+
+		return
+	}
+	fetches.WithLabelValues("stored").Inc()
+
+	// read again with the preview on the next lookup
+	if err := f.cache.DeleteLink(link.Key()); err != nil {
+		log.Warn().Err(err).Msg("preview: failed to drop cached link")
+	}
+}
+
+// Title and image of the page at target, the image falling back to the icon.
+func (f *Fetcher) fetch(target string) (string, string, error) {
+	page, err := url.Parse(target)
+	if err != nil {
+		return "", "", err
+	}
+	if !f.robots.allowed(page) {
+		return "", "", ErrDisallowed
+	}
+
+	resp, err := f.get(target)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("preview: unexpected status %d", resp.StatusCode)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return "", "", ErrNotHTML
+	}
+
+	title, image := extract(io.LimitReader(resp.Body, f.maxBytes))
+
+	// relative to the page after redirects
+	if image != "" {
+		ref, err := resp.Request.URL.Parse(image)
+		if err != nil || (ref.Scheme != "http" && ref.Scheme != "https") || len(ref.String()) > maxImage {
+			image = ""
+		} else {
+			image = ref.String()
+		}
+	}
+
+	return title, image, nil
+}
+
+func (f *Fetcher) get(target string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	req.Header.Set("Accept", "text/html, application/xhtml+xml")
+
+	return f.client.Do(req)
+}
+
+// Title and og:image or icon of an HTML document, read until the end of its
+// head.
+func extract(r io.Reader) (string, string) {
+	var title, ogImage, icon string
+	inTitle := false
+
+	tokens := html.NewTokenizer(r)
+	for {
+		switch tokens.Next() {
+		case html.ErrorToken:
+			return finish(title), pick(ogImage, icon)
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = string(tokens.Text())
+			}
+		case html.EndTagToken:
+			name, _ := tokens.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				return finish(title), pick(ogImage, icon)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokens.TagName()
+			attrs := map[string]string{}
+			for hasAttr {
+				var key, value []byte
+				key, value, hasAttr = tokens.TagAttr()
+				attrs[string(key)] = string(value)
+			}
+
+			switch string(name) {
+			case "title":
+				inTitle = true
+			case "meta":
+				if attrs["property"] == "og:image" || attrs["name"] == "og:image" {
+					ogImage = attrs["content"]
+				}
+			case "link":
+				for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+					if rel == "icon" && icon == "" {
+						icon = attrs["href"]
+					}
+				}
+			case "body":
+				return finish(title), pick(ogImage, icon)
+			}
+		}
+	}
+}
+
+func finish(title string) string {
+	title = strings.Join(strings.Fields(html.UnescapeString(title)), " ")
+	if runes := []rune(title); len(runes) > maxTitle {
+		title = string(runes[:maxTitle])
+	}
+
+	return title
+}
+
+func pick(image, fallback string) string {
+	if image != "" {
+		return image
+	}
+
+	return fallback
+}
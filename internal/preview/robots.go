@@ -0,0 +1,133 @@
+package preview
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	robotsTTL = time.Hour
+	// robots.txt bigger than this is read only up to it
+	maxRobots = 512 * 1024
+	// cached hosts are dropped all at once past this
+	maxHosts = 10000
+)
+
+// Disallow rules of robots.txt per host, for the groups matching UserAgent
+// or any agent. Allow rules and wildcards are not supported, paths are
+// matched by prefix.
+type robots struct {
+	get   func(target string) (*http.Response, error)
+	mutex sync.Mutex
+	hosts map[string]*rules
+}
+
+type rules struct {
+	disallow []string
+	fetched  time.Time
+}
+
+func newRobots(get func(string) (*http.Response, error)) *robots {
+	return &robots{get: get, hosts: make(map[string]*rules)}
+}
+
+// Whether page may be fetched. Hosts without a readable robots.txt allow
+// everything.
+func (r *robots) allowed(page *url.URL) bool {
+	path := page.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	for _, prefix := range r.rules(page).disallow {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *robots) rules(page *url.URL) *rules {
+	host := page.Scheme + "://" + page.Host
+
+	r.mutex.Lock()
+	cached, ok := r.hosts[host]
+	r.mutex.Unlock()
+	if ok && time.Since(cached.fetched) < robotsTTL {
+		return cached
+	}
+
+	fetched := &rules{fetched: time.Now()}
+	if resp, err := r.get(host + "/robots.txt"); err == nil {
+		if resp.StatusCode == http.StatusOK {
+			fetched.disallow = parseRobots(io.LimitReader(resp.Body, maxRobots))
+		}
+		resp.Body.Close()
+	}
+
+	r.mutex.Lock()
+	if len(r.hosts) >= maxHosts {
+		r.hosts = make(map[string]*rules)
+	}
+	r.hosts[host] = fetched
+	r.mutex.Unlock()
+
+	return fetched
+}
+
+// Disallowed path prefixes of the groups for UserAgent, or for any agent if
+// there is no group for it.
+func parseRobots(body io.Reader) []string {
+	agent := strings.ToLower(strings.SplitN(UserAgent, "/", 2)[0])
+
+	var own, others []string
+	var hasOwn, matchesOwn, matchesAny, inRules bool
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			// agents listed after rules start a new group
+			if inRules {
+				matchesOwn, matchesAny, inRules = false, false, false
+			}
+			name := strings.ToLower(value)
+			matchesOwn = matchesOwn || name == agent
+			hasOwn = hasOwn || matchesOwn
+			matchesAny = matchesAny || name == "*"
+		case "disallow":
+			inRules = true
+			if value == "" {
+				continue
+			}
+			if matchesOwn {
+				own = append(own, value)
+			}
+			if matchesAny {
+				others = append(others, value)
+			}
+		default:
+			inRules = true
+		}
+	}
+
+	if hasOwn {
+		return own
+	}
+
+	return others
+}
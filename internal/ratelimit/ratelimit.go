@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+	"wormholes/internal/apikey"
+	"wormholes/internal/cache"
+	"wormholes/internal/clientip"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Sliding window rate limiter keyed by the API key of requests or their
+// client IP, counted in Redis so the limit holds across all processes.
+type Limiter struct {
+	cache  *cache.Cache
+	name   string
+	limit  int
+	window time.Duration
+	allow  []*net.IPNet
+}
+
+// ParseCIDRs parses a list of CIDRs, like 10.0.0.0/8.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// Create a middleware allowing limit requests per window from each client
+// IP, as resolved by clientip, IPs in allow are never limited. Limits are counted separately for each name.
+func New(cache *cache.Cache, name string, limit int, window time.Duration, allow []*net.IPNet) fiber.Handler {
+	l := &Limiter{
+		cache:  cache,
+		name:   name,
+		limit:  limit,
+		window: window,
+		allow:  allow,
+	}
+
+	return l.handle
+}
+
+func (l *Limiter) allowed(ip net.IP) bool {
+	for _, ipNet := range l.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *Limiter) handle(ctx *fiber.Ctx) error {
+	ip := clientip.Of(ctx)
+	if l.limit <= 0 || l.allowed(ip) {
+		return ctx.Next()
+	}
+
+	now := time.Now().UnixNano()
+	window := l.window.Nanoseconds()
+	idx := now / window
+	// authenticated requests share the limit of their key
+	client := ip.String()
+	if id, ok := ctx.Locals(apikey.Local).(string); ok {
+		client = "key:" + id
+	}
+
+	// hash tagged, so both windows are in the same Cluster slot
+	key := fmt.Sprintf("rate:{%s:%s}:", l.name, client)
+
+	current, previous, err := l.cache.IncrWindow(key+strconv.FormatInt(idx, 10),
+		key+strconv.FormatInt(idx-1, 10), 2*l.window)
+	if err != nil {
+		// a broken cache shouldn't take writes down with it
+		log.Warn().Err(err).Msg("rate-limit: failed to count request")
+
+		return ctx.Next()
+	}
+
+	// weigh the previous window by how much of it still overlaps
+	elapsed := float64(now-idx*window) / float64(window)
+	if float64(previous)*(1-elapsed)+float64(current) > float64(l.limit) {
+		retryAfter := math.Ceil(time.Duration(window - (now - idx*window)).Seconds())
+		ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(retryAfter)))
+
+		return fiber.ErrTooManyRequests
+	}
+
+	return ctx.Next()
+}
@@ -0,0 +1,85 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// HTTP header request IDs are taken from and returned in.
+	Header = "X-Request-ID"
+	// gRPC metadata key request IDs are sent to the generator in.
+	MetadataKey = "x-request-id"
+	// IDs sent by clients longer than this are replaced.
+	MaxLength = 128
+	// Field of log lines holding the request ID.
+	Field = "request_id"
+)
+
+type key struct{}
+
+// New random request ID.
+func New() string {
+	var id [16]byte
+	// never fails on supported platforms
+	rand.Read(id[:])
+
+	return hex.EncodeToString(id[:])
+}
+
+// Whether an ID sent by a client can be used as is, it must be printable
+// ASCII without spaces so it can't break log lines.
+func Valid(id string) bool {
+	if id == "" || len(id) > MaxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// With returns a copy of ctx carrying id and a logger adding it to each
+// line, found with zerolog.Ctx.
+func With(ctx context.Context, id string) context.Context {
+	logger := log.With().Str(Field, id).Logger()
+
+	return context.WithValue(logger.WithContext(ctx), key{}, id)
+}
+
+// From returns the request ID of ctx, empty if it has none.
+func From(ctx context.Context) string {
+	id, _ := ctx.Value(key{}).(string)
+
+	return id
+}
+
+// UnaryClientInterceptor sends the request ID of the context of each call
+// as metadata.
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if id := From(ctx); id != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, MetadataKey, id)
+	}
+
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// UnaryServerInterceptor continues the request ID in the metadata of each
+// call, logging with it through zerolog.Ctx.
+func UnaryServerInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(MetadataKey); len(ids) > 0 && Valid(ids[0]) {
+			ctx = With(ctx, ids[0])
+		}
+	}
+
+	return handler(ctx, req)
+}
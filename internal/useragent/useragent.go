@@ -0,0 +1,100 @@
+package useragent
+
+import "strings"
+
+// Values of fields that couldn't be told from a User-Agent.
+const Unknown = "unknown"
+
+// Device classes.
+const (
+	Desktop = "desktop"
+	Mobile  = "mobile"
+	Bot     = "bot"
+)
+
+// Browser, OS and device class of a client.
+type Agent struct {
+	Browser string
+	OS      string
+	Device  string
+	Bot     bool
+}
+
+type rule struct {
+	// any of these in the lowercased User-Agent
+	tokens []string
+	name   string
+}
+
+// Checked in order, browsers built on others name them as well, e.g. Edge
+// sends Chrome and Safari.
+var (
+	bots = []string{
+		"bot", "crawl", "spider", "slurp", "preview", "facebookexternalhit",
+		"headless", "curl/", "wget/", "python-requests", "python-urllib",
+		"go-http-client", "httpclient", "java/", "libwww", "scrapy",
+	}
+	browsers = []rule{
+		{[]string{"edg/", "edga/", "edgios/", "edge/"}, "Edge"},
+		{[]string{"opr/", "opera"}, "Opera"},
+		{[]string{"samsungbrowser/"}, "Samsung Internet"},
+		{[]string{"firefox/", "fxios/"}, "Firefox"},
+		{[]string{"chrome/", "crios/", "chromium/"}, "Chrome"},
+		{[]string{"safari/"}, "Safari"},
+		{[]string{"msie ", "trident/"}, "Internet Explorer"},
+	}
+	systems = []rule{
+		{[]string{"iphone", "ipad", "ipod"}, "iOS"},
+		{[]string{"android"}, "Android"},
+		{[]string{"windows"}, "Windows"},
+		{[]string{"cros "}, "ChromeOS"},
+		{[]string{"mac os x", "macintosh"}, "macOS"},
+		{[]string{"linux", "x11"}, "Linux"},
+	}
+	mobile = []string{"mobi", "iphone", "ipad", "ipod", "android"}
+)
+
+// Parse a User-Agent header. Anything that isn't recognized is Unknown,
+// parsing never fails.
+func Parse(header string) Agent {
+	agent := Agent{Browser: Unknown, OS: Unknown, Device: Unknown}
+	if header == "" {
+		return agent
+	}
+	ua := strings.ToLower(header)
+
+	agent.Browser = match(ua, browsers)
+	agent.OS = match(ua, systems)
+
+	switch {
+	case containsAny(ua, bots):
+		agent.Bot = true
+		agent.Device = Bot
+	case containsAny(ua, mobile):
+		agent.Device = Mobile
+	case agent.OS != Unknown:
+		agent.Device = Desktop
+	}
+
+	return agent
+}
+
+func match(ua string, rules []rule) string {
+	for _, r := range rules {
+		if containsAny(ua, r.tokens) {
+			return r.name
+		}
+	}
+
+	return Unknown
+}
+
+func containsAny(ua string, tokens []string) bool {
+	for _, token := range tokens {
+		if strings.Contains(ua, token) {
+			return true
+		}
+	}
+
+	return false
+}
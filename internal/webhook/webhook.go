@@ -0,0 +1,166 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"wormholes/internal/links"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Header carrying the signature of the body, sha256=<hex HMAC-SHA256>.
+	SignatureHeader = "X-Wormholes-Signature"
+	queueSize       = 1024
+	workers         = 4
+	// first retry is after this, doubling with each attempt.
+	backoff = time.Second
+)
+
+var deliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "wormholes_webhook_deliveries_total",
+	Help: "Number of webhook deliveries by result.",
+}, []string{"result"})
+
+// Payload sent when a link is created.
+type Event struct {
+	Domain    string    `json:"domain,omitempty"`
+	ID        string    `json:"id"`
+	Target    string    `json:"target"`
+	Tag       string    `json:"tag"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type delivery struct {
+	url  string
+	body []byte
+}
+
+// Posts events to webhook URLs in the background, retrying failed deliveries
+// and logging those that run out of retries as dead letters.
+type Sender struct {
+	urls    []string
+	secret  []byte
+	retries int
+	client  *http.Client
+	queue   chan delivery
+	// first wait before retrying a delivery
+	backOff time.Duration
+}
+
+func New(urls []string, secret string, retries int, timeout time.Duration) *Sender {
+	return &Sender{
+		urls:    urls,
+		secret:  []byte(secret),
+		retries: retries,
+		client:  &http.Client{Timeout: timeout},
+		queue:   make(chan delivery, queueSize),
+		backOff: backoff,
+	}
+}
+
+func (s *Sender) Start() *Sender {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for d := range s.queue {
+				s.deliver(d)
+			}
+		}()
+	}
+
+	return s
+}
+
+// Queue an event for each created link to every URL. Events are dropped as
+// dead letters when the queue is full, sending never blocks.
+func (s *Sender) Send(created []*links.Link) {
+	now := time.Now()
+	for _, link := range created {
+		body, err := json.Marshal(Event{
+			Domain:    link.Domain,
+			ID:        link.ID,
+			Target:    link.Target,
+			Tag:       link.Tag,
+			CreatedAt: now,
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("webhook: failed to encode event")
+
+			continue
+		}
+
+		for _, url := range s.urls {
+			select {
+			case s.queue <- delivery{url, body}:
+			default:
+				deliveries.WithLabelValues("dropped").Inc()
+				log.Error().Str("url", url).RawJSON("event", body).Msg("webhook: queue full, dead letter")
+			}
+		}
+	}
+}
+
+func (s *Sender) deliver(d delivery) {
+	wait := s.backOff
+	for attempt := 0; ; attempt++ {
+		err := s.post(d)
+		if err == nil {
+			deliveries.WithLabelValues("delivered").Inc()
+
+			return
+		}
+
+		if attempt >= s.retries {
+			deliveries.WithLabelValues("failed").Inc()
+			log.Error().Err(err).Str("url", d.url).RawJSON("event", d.body).Msg("webhook: out of retries, dead letter")
+
+			return
+		}
+
+		log.Warn().Err(err).Msgf("webhook: delivery to %s failed, retrying in %s", d.url, wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (s *Sender) post(d delivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(s.secret, d.body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Signature of body with secret, as sent in SignatureHeader.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the signature of body with secret.
+func Verify(secret, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
@@ -0,0 +1,109 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"wormholes/internal/links"
+)
+
+// Receiver failing the first failures deliveries with a 5xx, recording the
+// bodies and signatures of all of them.
+type receiver struct {
+	mutex      sync.Mutex
+	failures   int
+	bodies     [][]byte
+	signatures []string
+	delivered  chan struct{}
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.bodies = append(r.bodies, body)
+	r.signatures = append(r.signatures, req.Header.Get(SignatureHeader))
+	if len(r.bodies) <= r.failures {
+		w.WriteHeader(http.StatusBadGateway)
+
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	close(r.delivered)
+}
+
+// Sender to a stub receiver, retrying without waiting long.
+func testSender(t *testing.T, r *receiver, retries int) *Sender {
+	t.Helper()
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	s := New([]string{server.URL}, "webhook-secret", retries, time.Second)
+	s.backOff = time.Millisecond
+
+	return s.Start()
+}
+
+func TestDeliverySigned(t *testing.T) {
+	r := &receiver{failures: 2, delivered: make(chan struct{})}
+	s := testSender(t, r, 2)
+	s.Send([]*links.Link{links.New("example.org", "abc", "https://example.com", "tag")})
+
+	select {
+	case <-r.delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event wasn't delivered in time")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.bodies) != 3 {
+		t.Fatalf("got %d deliveries, want 2 failed and 1 retried", len(r.bodies))
+	}
+	for i, body := range r.bodies {
+		if r.signatures[i] != Sign([]byte("webhook-secret"), body) || !Verify([]byte("webhook-secret"), body, r.signatures[i]) {
+			t.Errorf("delivery %d has signature %q, want the HMAC of its body", i, r.signatures[i])
+		}
+		if Verify([]byte("other-secret"), body, r.signatures[i]) {
+			t.Errorf("delivery %d is verified with another secret", i)
+		}
+	}
+
+	var event Event
+	if err := json.Unmarshal(r.bodies[2], &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Domain != "example.org" || event.ID != "abc" || event.Target != "https://example.com" || event.Tag != "tag" {
+		t.Errorf("got event %+v, want the created link", event)
+	}
+}
+
+func TestDeliveryOutOfRetries(t *testing.T) {
+	r := &receiver{failures: 100, delivered: make(chan struct{})}
+	s := testSender(t, r, 2)
+	s.Send([]*links.Link{links.New("", "abc", "https://example.com", "")})
+
+	// the first try and two retries, then the event is a dead letter
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mutex.Lock()
+		tries := len(r.bodies)
+		r.mutex.Unlock()
+		if tries == 3 {
+			break
+		}
+		if tries > 3 || time.Now().After(deadline) {
+			t.Fatalf("got %d deliveries, want 3", tries)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.bodies) != 3 {
+		t.Errorf("got %d deliveries, want no retry past WEBHOOK_RETRIES", len(r.bodies))
+	}
+}
@@ -0,0 +1,110 @@
+package ipc
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/rs/zerolog/log"
+)
+
+// Result of generating IDs against a fresh bloom filter for a while.
+type BenchmarkResult struct {
+	Duration   time.Duration `json:"duration"`
+	Workers    int           `json:"workers"`
+	Generated  uint64        `json:"generated"`
+	Collisions uint64        `json:"collisions"`
+	// IDs generated per second, by all workers
+	Throughput float64 `json:"throughput"`
+	// share of attempts rejected as taken, by the blacklist or as false
+	// positives of the filter since it starts empty
+	CollisionRate float64 `json:"collisionRate"`
+	Keyspace      float64 `json:"keyspace"`
+	BloomLimit    uint    `json:"bloomLimit"`
+	// projected seconds until the keyspace is used up far enough that an ID
+	// takes MAX_RETRIES attempts on average
+	ExhaustionSeconds float64 `json:"exhaustionSeconds"`
+	// projected seconds until the filter holds BLOOM_MAX IDs, 0 if it grows
+	// or holds the whole keyspace
+	BloomFullSeconds float64 `json:"bloomFullSeconds"`
+}
+
+// Benchmark generates IDs as fast as possible for duration with the
+// configured alphabet, size, partition and bloom filter settings, without
+// loading IDs from the database. IDs are added to a fresh filter, the one of
+// the factory is left untouched, and are never handed out.
+func (f *Factory) Benchmark(duration time.Duration) BenchmarkResult {
+	limit := f.config.BloomMaxLimit
+	if f.config.BloomAutoSize {
+		limit = autoSize(0, f.config.BloomHeadroom)
+	}
+	filter := f.newBloom(limit)
+
+	workers := f.config.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	log.Info().Msgf("benchmark: generating IDs of size %d for %s with %d workers",
+		f.config.IDSize, duration, workers)
+
+	var stop atomic.Bool
+	var generated, collisions atomic.Uint64
+	var wg sync.WaitGroup
+	t := time.Now()
+	timer := time.AfterFunc(duration, func() { stop.Store(true) })
+	defer timer.Stop()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var added, taken uint64
+			for !stop.Load() {
+				id, err := f.newID(f.config.IDSize)
+				if err != nil || id == "" {
+					continue
+				}
+				if !f.blacklist.Match(id) && filter.AddIfAbsent(fasterByte(id)) {
+					added++
+				} else {
+					taken++
+				}
+			}
+			generated.Add(added)
+			collisions.Add(taken)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(t)
+
+	result := BenchmarkResult{
+		Duration:   elapsed,
+		Workers:    workers,
+		Generated:  generated.Load(),
+		Collisions: collisions.Load(),
+		Keyspace:   f.keyspace(),
+		BloomLimit: limit,
+	}
+	attempts := float64(result.Generated + result.Collisions)
+	if attempts == 0 {
+		return result
+	}
+	result.Throughput = float64(result.Generated) / elapsed.Seconds()
+	result.CollisionRate = float64(result.Collisions) / attempts
+
+	// taking n of N IDs at random takes about N ln(N / (N - n)) attempts, at
+	// the rate measured while the filter was nearly empty
+	perSecond := attempts / elapsed.Seconds()
+	result.ExhaustionSeconds = result.Keyspace * math.Log(float64(max(f.config.MaxRetries, 2))) / perSecond
+	if f.config.BloomGrowth == 0 && float64(limit) < result.Keyspace {
+		result.BloomFullSeconds = result.Keyspace * math.Log(result.Keyspace/(result.Keyspace-float64(limit))) / perSecond
+	}
+
+	log.Info().Msgf("benchmark: generated %s IDs, %s per second, with %s collisions",
+		humanize.Comma(int64(result.Generated)), humanize.Comma(int64(result.Throughput)),
+		humanize.Comma(int64(result.Collisions)))
+
+	return result
+}
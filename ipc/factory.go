@@ -2,153 +2,894 @@ package ipc
 
 import (
 	"context"
+	"crypto/subtle"
+	"math"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 	"unsafe"
+	"wormholes/internal/blacklist"
 	"wormholes/internal/bloom"
 	"wormholes/internal/config"
+	"wormholes/internal/idgen"
 	"wormholes/internal/memstore"
 	"wormholes/protos"
 
 	"github.com/dustin/go-humanize"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/noquark/nanoid"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/schollz/progressbar/v3"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
 const (
-	queryIDs      string = `SELECT id from links`
-	queryIDsCount string = `SELECT count(id) from links`
+	queryIDs      string = `SELECT id FROM links WHERE id > $1 AND ($3::text[] IS NULL OR left(id, 1) = any($3)) ORDER BY id LIMIT $2`
+	queryIDsCount string = `SELECT count(id) from links WHERE $1::text[] IS NULL OR left(id, 1) = any($1)`
 	maxBarWidth          = 64
+	maxChunkTries        = 3
+	MinIDSize            = 4
+	MaxIDSize            = 21
+	// most buckets and IDs in a bucket Resize allows, bounding the memory of
+	// a resized store.
+	MaxBuckets        = 4096
+	MaxBucketCapacity = 10_000_000
+	// auto sized bloom filters are rounded up to a multiple of this, so that
+	// a snapshot stays valid while the count grows a little.
+	autoSizeStep = 1_000_000
+	// initial capacity of the filter of a namespace, it grows as needed.
+	namespaceLimit = 100_000
 )
 
+var errShuttingDown = status.New(codes.Unavailable, "factory: shutting down").Err()
+
 type Factory struct {
 	protos.UnimplementedBucketServiceServer
-	db     *pgxpool.Pool
-	bloom  *bloom.Bloom
+	db    *pgxpool.Pool
+	bloom *bloom.Bloom
+	store *memstore.MemStore
+	// stores replaced by Resize, popped until they are empty.
+	draining   []*memstore.MemStore
+	storeMutex sync.RWMutex
+	config     *config.Config
+	newID      func(size int) (string, error)
+	// reads the chunk of existing IDs after an ID, from PostgreSQL
+	queryChunk func(after string) ([]string, error)
+	// first characters of IDs of the partition of this factory, nil if the
+	// keyspace isn't partitioned. Only those IDs are loaded and generated.
+	partition []string
+	// IDs matching it are never handed out.
+	blacklist *blacklist.Blacklist
+	// stores for ID sizes other than the configured one, created on demand.
+	sized      map[int]*memstore.MemStore
+	sizedMutex sync.Mutex
+	// buckets waiting to be populated by workers.
+	jobs   chan job
+	health *health.Server
+	// closed when shutting down.
+	done chan struct{}
+	// held for reading while a bucket is being populated.
+	populating sync.RWMutex
+	// set once the bloom filter is prepared.
+	ready atomic.Bool
+	// IDs registered in namespaces other than the default one, which may
+	// repeat across namespaces. Generated IDs are unique in all of them.
+	namespaces      map[string]*bloom.Bloom
+	namespacesMutex sync.RWMutex
+	// lifetime counts of IDs generated and rejected as taken, read without
+	// contending with populateBucket.
+	generated  atomic.Uint64
+	collisions atomic.Uint64
+}
+
+// A bucket to be populated.
+type job struct {
 	store  *memstore.MemStore
-	config *config.Config
+	idx    int
+	idSize int
+}
+
+// ID generation statistics over the lifetime of a factory.
+type GenerationStats struct {
+	Generated  uint64 `json:"generated"`
+	Collisions uint64 `json:"collisions"`
+	// share of generated IDs rejected as taken
+	CollisionRate float64 `json:"collisionRate"`
+	// number of possible IDs of the configured size
+	Keyspace float64 `json:"keyspace"`
+	// share of the keyspace taken by known IDs, generation slows down with
+	// collisions as it nears 1
+	Utilization float64 `json:"utilization"`
 }
 
 func NewFactory(config *config.Config, db *pgxpool.Pool) *Factory {
-	return &Factory{
-		db:     db,
-		bloom:  bloom.New(config.BloomMaxLimit, config.BloomErrorRate),
-		store:  memstore.New(config.BucketSize, config.BucketCapacity),
-		config: config,
+	// validated with the config
+	newID, _ := idgen.For(config.Alphabet, config.RNG)
+	var partition []string
+	if config.Partitions > 1 {
+		alphabet := config.Alphabet
+		if alphabet == "" {
+			alphabet = idgen.DefaultAlphabet
+		}
+		first, _ := idgen.Partition(alphabet, config.Partition, config.Partitions)
+		newID = idgen.Partitioned(newID, alphabet, first)
+		partition = strings.Split(first, "")
+		log.Info().Msgf("factory: generating IDs of partition %d of %d, starting with %q",
+			config.Partition, config.Partitions, first)
 	}
+
+	reserved, err := blacklist.New(config.Blacklist, config.BlacklistPatterns)
+	if err != nil {
+		log.Fatal().Err(err).Msg("factory: failed to load blacklist")
+	}
+
+	f := &Factory{
+		db:         db,
+		store:      memstore.New(config.BucketSize, config.BucketCapacity),
+		config:     config,
+		newID:      newID,
+		partition:  partition,
+		blacklist:  reserved,
+		sized:      make(map[int]*memstore.MemStore),
+		jobs:       make(chan job),
+		namespaces: make(map[string]*bloom.Bloom),
+		health:     health.NewServer(),
+		done:       make(chan struct{}),
+	}
+	f.queryChunk = f.selectChunk
+	f.setServing(healthpb.HealthCheckResponse_NOT_SERVING)
+
+	return f
+}
+
+// Health server reporting whether the factory is ready to serve buckets.
+func (f *Factory) Health() *health.Server {
+	return f.health
+}
+
+func (f *Factory) setServing(status healthpb.HealthCheckResponse_ServingStatus) {
+	f.health.SetServingStatus("", status)
+	f.health.SetServingStatus(protos.BucketService_ServiceDesc.ServiceName, status)
 }
 
 func (f *Factory) Prepare() *Factory {
 	var idCount uint64
 
-	err := f.db.QueryRow(context.Background(), queryIDsCount).Scan(&idCount)
-	if err != nil {
-		log.Warn().Err(err).Msg("factory: failed to get IDs count")
+	// links stored in memory are all generated by this factory
+	if f.db != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), f.config.PrepareTimeout)
+		err := f.db.QueryRow(ctx, queryIDsCount, f.partition).Scan(&idCount)
+		cancel()
+		if err != nil {
+			log.Warn().Err(err).Msg("factory: failed to get IDs count")
+		}
+	}
+
+	limit := f.config.BloomMaxLimit
+	if f.config.BloomAutoSize {
+		limit = autoSize(idCount, f.config.BloomHeadroom)
+		log.Info().Msgf("factory: auto sized bloom filter to %s IDs", humanize.Comma(int64(limit)))
+	}
+	f.bloom = f.newBloom(limit)
+
+	if f.config.BloomSnapshot != "" {
+		if snapshot, ok := f.bloom.Load(f.config.BloomSnapshot); ok {
+			if idCount <= snapshot.Count()+f.config.BloomDrift {
+				f.bloom = snapshot
+
+				return f
+			}
+			log.Warn().Msgf("factory: snapshot is behind by %s IDs, rebuilding",
+				humanize.Comma(int64(idCount-snapshot.Count())))
+		}
 	}
 
 	if idCount > 0 {
-		rows, err := f.db.Query(context.Background(), queryIDs)
+		f.load(idCount)
+	}
+
+	return f
+}
+
+// add idCount existing IDs to the bloom filter, read in chunks.
+func (f *Factory) load(idCount uint64) {
+	bar := progressbar.NewOptions(
+		int(idCount),
+		progressbar.OptionSetWidth(maxBarWidth),
+		progressbar.OptionClearOnFinish(),
+	)
+
+	workers := f.config.PrepareWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// chunks are read in order, each from the last ID of the previous
+	// one, and added to the sharded filter by workers in parallel
+	chunks := make(chan []string, workers)
+	var loaded atomic.Uint64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ids := range chunks {
+				for _, id := range ids {
+					f.bloom.Add(fasterByte(id))
+				}
+				bar.Add(len(ids))
+				loaded.Add(uint64(len(ids)))
+			}
+		}()
+	}
+
+	after := ""
+	for {
+		ids, err := f.loadChunk(after)
 		if err != nil {
-			log.Warn().Err(err).Msg("factory: failed to get IDs")
+			log.Error().Err(err).Msgf("factory: failed to get IDs after %q", after)
 
-			return f
+			break
 		}
-		defer rows.Close()
+		chunks <- ids
 
-		bar := progressbar.NewOptions(
-			int(idCount),
-			progressbar.OptionSetWidth(maxBarWidth),
-			progressbar.OptionClearOnFinish(),
-		)
-		for rows.Next() {
-			var id string
+		if len(ids) < f.config.PrepareChunk {
+			break
+		}
+		after = ids[len(ids)-1]
+	}
+	close(chunks)
+	wg.Wait()
+	bar.Finish()
+	log.Info().Msgf("factory: cached %s IDs with %d workers", humanize.Comma(int64(loaded.Load())), workers)
+}
 
-			err := rows.Scan(&id)
-			if err != nil {
-				log.Warn().Err(err).Msg("factory: failed to parse ID")
+func (f *Factory) newBloom(limit uint) *bloom.Bloom {
+	if f.config.BloomGrowth > 0 {
+		return bloom.NewScalableBloom(limit, f.config.BloomErrorRate, f.config.BloomGrowth)
+	}
 
-				continue
-			}
+	return bloom.New(limit, f.config.BloomErrorRate)
+}
 
-			bar.Add(1)
-			f.bloom.Add(fasterByte(id))
+// capacity for idCount IDs with given headroom, rounded up.
+func autoSize(idCount uint64, headroom float64) uint {
+	limit := uint64(math.Ceil(float64(idCount) * headroom))
+	steps := limit/autoSizeStep + 1
+
+	return uint(steps * autoSizeStep)
+}
+
+// load a chunk of IDs after given ID, retrying on failure.
+func (f *Factory) loadChunk(after string) (ids []string, err error) {
+	for try := 1; try <= maxChunkTries; try++ {
+		ids, err = f.queryChunk(after)
+		if err == nil {
+			return ids, nil
 		}
-		bar.Finish()
-		log.Info().Msgf("factory: cached %s IDs", humanize.Comma(int64(idCount)))
+		log.Warn().Err(err).Msgf("factory: failed to get IDs, try %d of %d", try, maxChunkTries)
 	}
 
-	return f
+	return nil, err
+}
+
+func (f *Factory) selectChunk(after string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.config.PrepareTimeout)
+	defer cancel()
+
+	rows, err := f.db.Query(ctx, queryIDs, after, f.config.PrepareChunk, f.partition)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
 }
 
 func (f *Factory) Run(conf *config.Config) *Factory {
-	for i := range f.store.Buckets {
-		go f.populateBucket(i)
+	f.ready.Store(true)
+
+	workers := conf.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	log.Info().Msgf("factory: populating with %d workers", workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range f.jobs {
+				if f.isShuttingDown() || j.store.IsRetired() {
+					continue
+				}
+				f.populating.RLock()
+				f.populateBucket(j.store, j.idx, j.idSize)
+				f.populating.RUnlock()
+			}
+		}()
 	}
+
+	filled := f.store.Filled()
 	go func() {
-		for idx := range f.store.Empty {
-			go f.populateBucket(idx)
-		}
+		<-filled
+		log.Info().Msg("factory: ready to serve")
+		f.setServing(healthpb.HealthCheckResponse_SERVING)
 	}()
 
+	if conf.BucketSnapshot != "" {
+		f.restoreBuckets(conf.BucketSnapshot)
+	}
+
+	f.fill(f.store, conf.IDSize)
+
 	return f
 }
 
+// restore buckets saved on last shutdown, making sure their IDs are known to
+// the bloom filter even if it was rebuilt from the database.
+func (f *Factory) restoreBuckets(path string) {
+	restored, err := f.store.Restore(path, f.config.IDSize)
+	if err != nil {
+		log.Warn().Err(err).Msg("factory: discarding bucket snapshot")
+
+		return
+	}
+	if restored == 0 {
+		return
+	}
+
+	for _, bucket := range f.store.Buckets {
+		bucket.RLock()
+		for _, id := range bucket.Data {
+			if !f.bloom.Exists(fasterByte(id)) {
+				f.bloom.Add(fasterByte(id))
+			}
+		}
+		bucket.RUnlock()
+	}
+
+	log.Info().Msgf("factory: restored %d buckets", restored)
+	f.store.NotifyFilled()
+}
+
+// queue all buckets of store and requeue them as they are emptied.
+func (f *Factory) fill(store *memstore.MemStore, idSize int) {
+	go func() {
+		for i := range store.Buckets {
+			f.jobs <- job{store, i, idSize}
+		}
+		for {
+			select {
+			case idx := <-store.Empty:
+				f.jobs <- job{store, idx, idSize}
+			case <-store.Retired():
+				return
+			}
+		}
+	}()
+}
+
+// get the store for IDs of given size, creating it if it doesn't exist yet.
+func (f *Factory) storeFor(idSize int) *memstore.MemStore {
+	if idSize == f.config.IDSize {
+		return f.defaultStore()
+	}
+
+	f.sizedMutex.Lock()
+	defer f.sizedMutex.Unlock()
+
+	store, ok := f.sized[idSize]
+	if !ok {
+		log.Info().Msgf("factory: creating buckets for size %d", idSize)
+		store = memstore.New(f.config.BucketSize, f.config.BucketCapacity)
+		f.sized[idSize] = store
+		f.fill(store, idSize)
+	}
+
+	return store
+}
+
 // populate bucket at given index until full.
-func (f *Factory) populateBucket(idx int) {
+func (f *Factory) populateBucket(store *memstore.MemStore, idx int, idSize int) {
 	t := time.Now()
 	fillCount := 0
-	bucket := f.store.Buckets[idx]
-	idSize := f.config.IDSize
-	if isAvailable := bucket.TryLock(); isAvailable {
-		log.Info().Msgf("filling bucket %d", idx)
-		bucket.Data = make([]string, bucket.Capacity)
-		for fillCount < bucket.Capacity {
-			id, err := nanoid.New(idSize)
-			if err == nil && id != "" {
-				if !f.bloom.Exists(fasterByte(id)) {
-					bucket.Data[fillCount] = id
-					f.bloom.Add(fasterByte(id))
-					fillCount++
-				}
+	bucket := store.Buckets[idx]
+	// waits for readers, BucketStatus polled often would otherwise keep the
+	// bucket from being filled
+	bucket.Lock()
+	if bucket.Data != nil {
+		// restored from a snapshot, or filled by a job queued before
+		bucket.Unlock()
+		return
+	}
+	log.Info().Msgf("filling bucket %d", idx)
+	// swapped in once full, the generated part may be taken before with
+	// partial buckets. An exhausted bucket keeps the IDs it got, they
+	// are already claimed.
+	filling := bucket.StartFilling()
+	// collisions and failures of the generator alike, neither gives an ID
+	failures := 0
+	for fillCount < bucket.Capacity && failures < f.config.MaxRetries {
+		id, err := f.newID(idSize)
+		if err != nil || id == "" {
+			failures++
+			continue
+		}
+		if !f.blacklist.Match(id) && f.claim(fasterByte(id)) {
+			filling.Add(id)
+			fillCount++
+			failures = 0
+			continue
+		}
+
+		idCollisions.Inc()
+		f.collisions.Add(1)
+		failures++
+	}
+	data := bucket.FinishFilling(filling)
+	if len(data) > 0 {
+		bucket.Data = data
+	}
+	exhausted := fillCount < bucket.Capacity
+	bucket.Exhausted = exhausted
+	bucket.Unlock()
+	if exhausted {
+		log.WithLevel(zerolog.FatalLevel).Msgf(
+			"keyspace exhausted, %d consecutive failures filling bucket %d, kept %d IDs", failures, idx, len(data))
+	} else if len(data) == 0 {
+		// all of it was taken while filling
+		store.Empty <- idx
+	}
+	store.NotifyFilled()
+	idsGenerated.Add(float64(fillCount))
+	f.generated.Add(uint64(fillCount))
+	bucketFillDuration.Observe(time.Since(t).Seconds())
+	log.Info().Msgf("filled bucket %d in %s", idx, time.Since(t).String())
+}
+
+// GenerationStats counts IDs generated and collisions since start, and how
+// much of the keyspace of the configured ID size is taken by known IDs.
+func (f *Factory) GenerationStats() GenerationStats {
+	stats := GenerationStats{
+		Generated:  f.generated.Load(),
+		Collisions: f.collisions.Load(),
+	}
+	if attempts := stats.Generated + stats.Collisions; attempts > 0 {
+		stats.CollisionRate = float64(stats.Collisions) / float64(attempts)
+	}
+
+	stats.Keyspace = f.keyspace()
+	// the bloom filter is only set once prepared
+	if stats.Keyspace > 0 && f.ready.Load() {
+		stats.Utilization = float64(f.bloom.Count()) / stats.Keyspace
+	}
+
+	return stats
+}
+
+// number of possible IDs of the configured size in the partition of the
+// factory.
+func (f *Factory) keyspace() float64 {
+	alphabet := f.config.Alphabet
+	if alphabet == "" {
+		alphabet = idgen.DefaultAlphabet
+	}
+	keyspace := idgen.Keyspace(utf8.RuneCountInString(alphabet), f.config.IDSize)
+	if f.partition != nil {
+		keyspace *= float64(len(f.partition)) / float64(utf8.RuneCountInString(alphabet))
+	}
+
+	return keyspace
+}
+
+// Shutdown stops refilling buckets and waits for buckets being populated,
+// up to the context deadline, before saving buckets and the bloom filter.
+// Full buckets can still be popped while shutting down.
+func (f *Factory) Shutdown(ctx context.Context) {
+	f.health.Shutdown()
+	close(f.done)
+
+	waited := make(chan struct{})
+	go func() {
+		f.populating.Lock()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-ctx.Done():
+		log.Warn().Msg("factory: timed out waiting for buckets to fill")
+	}
+
+	if f.config.BucketSnapshot != "" {
+		if err := f.defaultStore().Dump(f.config.BucketSnapshot); err != nil {
+			log.Error().Err(err).Msg("factory: failed to save buckets")
+		}
+	}
+
+	if f.config.BloomSnapshot != "" {
+		if err := f.bloom.Save(f.config.BloomSnapshot); err != nil {
+			log.Error().Err(err).Msg("factory: failed to save bloom snapshot")
+		} else {
+			log.Info().Msgf("factory: saved bloom snapshot to %s", f.config.BloomSnapshot)
+		}
+	}
+}
+
+func (f *Factory) isShuttingDown() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *Factory) GetBucket(ctx context.Context, empty *protos.Empty) (*protos.Bucket, error) {
+	return f.popBucket(ctx, f.config.IDSize)
+}
+
+func (f *Factory) GetSizedBucket(ctx context.Context, req *protos.SizedBucketRequest) (*protos.Bucket, error) {
+	size := int(req.GetSize())
+	if err := validateSize(size); err != nil {
+		return nil, err
+	}
+
+	return f.popBucket(ctx, size)
+}
+
+// Keep sending buckets as they are filled until the client goes away.
+func (f *Factory) StreamBuckets(req *protos.StreamRequest, stream protos.BucketService_StreamBucketsServer) error {
+	size := int(req.GetSize())
+	if size == 0 {
+		size = f.config.IDSize
+	}
+	if err := validateSize(size); err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	for {
+		// get the channel before popping so a fill in between isn't missed,
+		// a resize wakes it up to wait on the new store.
+		filled := f.storeFor(size).Filled()
+		if ids := f.pop(size); ids != nil {
+			bucketsPopped.Inc()
+			if err := stream.Send(&protos.Bucket{Ids: ids}); err != nil {
+				log.Warn().Err(err).Msg("factory: stream closed")
+
+				return err
 			}
+
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-f.done:
+			return errShuttingDown
+		case <-filled:
 		}
-		bucket.Unlock()
-		log.Info().Msgf("filled bucket %d in %s", idx, time.Since(t).String())
-	} else {
-		log.Warn().Msgf("bucket not available %d", idx)
 	}
 }
 
-func (f *Factory) Shutdown() {
-	close(f.store.Empty)
+func (f *Factory) Register(context context.Context, req *protos.RegisterRequest) (*protos.Empty, error) {
+	if !f.ready.Load() {
+		return nil, status.New(codes.Unavailable, "factory: not ready yet").Err()
+	}
+	if req.GetId() == "" {
+		return nil, status.New(codes.InvalidArgument, "factory: empty id").Err()
+	}
+
+	filter := f.bloom
+	if req.GetNamespace() != "" {
+		filter = f.namespace(req.GetNamespace())
+	}
+	if !filter.AddIfAbsent([]byte(req.GetId())) {
+		return nil, status.New(codes.AlreadyExists, "factory: id already exists").Err()
+	}
+	zerolog.Ctx(context).Info().Msgf("factory: registered id %s in namespace %q", req.GetId(), req.GetNamespace())
+
+	return &protos.Empty{}, nil
+}
+
+// get the filter of a namespace, creating it if it doesn't exist yet.
+func (f *Factory) namespace(name string) *bloom.Bloom {
+	f.namespacesMutex.Lock()
+	defer f.namespacesMutex.Unlock()
+
+	filter, ok := f.namespaces[name]
+	if !ok {
+		log.Info().Msgf("factory: creating filter for namespace %q", name)
+		filter = bloom.NewScalableBloom(namespaceLimit, f.config.BloomErrorRate, 2)
+		f.namespaces[name] = filter
+	}
+
+	return filter
+}
+
+// Claim a generated id, adding it to the default filter unless it is known
+// to it or registered in any namespace. Checking and adding at once keeps
+// two workers from both claiming an ID they generated at the same time.
+func (f *Factory) claim(id []byte) bool {
+	return !f.inNamespace(id) && f.bloom.AddIfAbsent(id)
+}
+
+// whether id is registered in any namespace.
+func (f *Factory) inNamespace(id []byte) bool {
+	f.namespacesMutex.RLock()
+	defer f.namespacesMutex.RUnlock()
+
+	for _, filter := range f.namespaces {
+		if filter.Exists(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validateSize(size int) error {
+	if size < MinIDSize || size > MaxIDSize {
+		return status.Newf(codes.InvalidArgument,
+			"factory: size must be between %d and %d", MinIDSize, MaxIDSize).Err()
+	}
+
+	return nil
+}
+
+func (f *Factory) GetBuckets(ctx context.Context, req *protos.BucketsRequest) (*protos.BucketsResponse, error) {
+	size := int(req.GetSize())
+	if size == 0 {
+		size = f.config.IDSize
+	}
+	if err := validateSize(size); err != nil {
+		return nil, err
+	}
+	requested := int(req.GetCount())
+	if requested <= 0 {
+		return nil, status.New(codes.InvalidArgument, "factory: count must be positive").Err()
+	}
+	// a single call can't take every bucket, the rest is short
+	count := min(requested, len(f.storeFor(size).Buckets))
+
+	timeout := time.NewTimer(f.config.Timeout)
+	defer timeout.Stop()
+	var popped [][]string
+	for {
+		// get the channel before popping so a fill in between isn't missed
+		filled := f.storeFor(size).Filled()
+		if popped = f.popN(size, count); len(popped) > 0 {
+			break
+		}
+		if f.isShuttingDown() {
+			return nil, errShuttingDown
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-f.done:
+			return nil, errShuttingDown
+		case <-timeout.C:
+			return &protos.BucketsResponse{Short: int32(requested)}, nil
+		case <-filled:
+		}
+	}
+	bucketsPopped.Add(float64(len(popped)))
+
+	resp := &protos.BucketsResponse{
+		Buckets: make([]*protos.Bucket, len(popped)),
+		Short:   int32(requested - len(popped)),
+	}
+	for i, ids := range popped {
+		resp.Buckets[i] = &protos.Bucket{Ids: ids}
+	}
+
+	return resp, nil
 }
-func (f *Factory) GetBucket(context context.Context, empty *protos.Empty) (*protos.Bucket, error) {
+
+// pop a full bucket of IDs of size, waiting up to the configured timeout
+// unless ctx is done or the factory shuts down first.
+func (f *Factory) popBucket(ctx context.Context, size int) (*protos.Bucket, error) {
 	t := time.Now()
-	ids := f.store.Pop()
+	ids := f.pop(size)
 	if ids != nil {
+		bucketsPopped.Inc()
 		log.Info().Msgf("get bucket in %s", time.Since(t).String())
 		p := &protos.Bucket{
 			Ids: ids,
 		}
 		log.Info().Msgf("serialized bucket in %s", time.Since(t).String())
 		return p, nil
+	} else if f.isShuttingDown() {
+		return nil, errShuttingDown
 	} else {
 		timer := time.NewTimer(f.config.Timeout)
-		for range timer.C {
-			if ids = f.store.Pop(); ids != nil {
-				return &protos.Bucket{
-					Ids: ids,
-				}, nil
-			}
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-f.done:
+			return nil, errShuttingDown
+		case <-timer.C:
+		}
+		if ids = f.pop(size); ids != nil {
+			bucketsPopped.Inc()
+			return &protos.Bucket{
+				Ids: ids,
+			}, nil
+		}
+		if f.storeFor(size).Exhausted() {
+			return nil, status.New(codes.ResourceExhausted, "factory: keyspace exhausted").Err()
 		}
 		log.Warn().Caller().Msgf("timed out, none of the buckets are filled")
 		return nil, status.New(codes.ResourceExhausted, "factory: it's empty here").Err()
 	}
 }
 
+// the store of the configured ID size.
+func (f *Factory) defaultStore() *memstore.MemStore {
+	f.storeMutex.RLock()
+	defer f.storeMutex.RUnlock()
+
+	return f.store
+}
+
+// pop a full bucket of IDs of size, nil if there is none. With partial
+// buckets, the IDs generated so far of a bucket being filled are popped
+// instead when none is full.
+func (f *Factory) pop(size int) []string {
+	if size != f.config.IDSize {
+		store := f.storeFor(size)
+		if ids := store.Pop(1); ids != nil || !f.config.PartialBuckets {
+			return ids
+		}
+
+		return store.PopPartial()
+	}
+	if popped := f.popDefault(1); len(popped) > 0 {
+		return popped[0]
+	}
+	if f.config.PartialBuckets {
+		return f.defaultStore().PopPartial()
+	}
+
+	return nil
+}
+
+// pop up to n full buckets of IDs of size.
+func (f *Factory) popN(size, n int) [][]string {
+	if size != f.config.IDSize {
+		return f.storeFor(size).PopN(n)
+	}
+
+	return f.popDefault(n)
+}
+
+// pop up to n full buckets of the configured ID size, from stores replaced
+// by Resize first.
+func (f *Factory) popDefault(n int) [][]string {
+	f.storeMutex.RLock()
+	store, draining := f.store, len(f.draining) > 0
+	f.storeMutex.RUnlock()
+	if !draining {
+		return store.PopN(n)
+	}
+
+	f.storeMutex.Lock()
+	var popped [][]string
+	kept := f.draining[:0]
+	for _, old := range f.draining {
+		popped = append(popped, old.PopN(n-len(popped))...)
+		// buckets being filled become full later
+		if status := old.Status(); status.Full > 0 || status.Busy > 0 {
+			kept = append(kept, old)
+		} else {
+			log.Info().Msg("factory: drained resized buckets")
+		}
+	}
+	f.draining = kept
+	f.storeMutex.Unlock()
+
+	if len(popped) < n {
+		popped = append(popped, store.PopN(n-len(popped))...)
+	}
+
+	return popped
+}
+
+// Replace the buckets of the configured ID size with ones of a new size and
+// capacity. Full buckets are moved to the new ones as long as they fit, the
+// others are handed out before new buckets.
+func (f *Factory) Resize(ctx context.Context, req *protos.ResizeRequest) (*protos.ResizeResponse, error) {
+	if err := f.authorize(ctx); err != nil {
+		return nil, err
+	}
+	size, capacity := int(req.GetSize()), int(req.GetCapacity())
+	if size <= 0 || capacity <= 0 || size > MaxBuckets || capacity > MaxBucketCapacity {
+		return nil, status.Newf(codes.InvalidArgument,
+			"factory: size must be between 1 and %d and capacity between 1 and %d", MaxBuckets, MaxBucketCapacity).Err()
+	}
+	if !f.ready.Load() || f.isShuttingDown() {
+		return nil, status.New(codes.Unavailable, "factory: not serving").Err()
+	}
+
+	store := memstore.New(size, capacity)
+
+	f.storeMutex.Lock()
+	old := f.store
+	moved := store.Adopt(old)
+	old.Retire()
+	f.draining = append(f.draining, old)
+	f.store = store
+	f.storeMutex.Unlock()
+
+	// waiters on the old store wait on the new one
+	old.NotifyFilled()
+	if moved > 0 {
+		store.NotifyFilled()
+	}
+	f.fill(store, f.config.IDSize)
+	log.Info().Msgf("factory: resized to %d buckets of %s IDs, moved %d", size, humanize.Comma(int64(capacity)), moved)
+
+	return &protos.ResizeResponse{
+		Size:     int32(size),
+		Capacity: int32(capacity),
+		Moved:    int32(moved),
+	}, nil
+}
+
+// Count buckets of the configured ID size in each state. Full and busy
+// buckets of stores replaced by Resize are counted too, they are handed out
+// first, but their empty ones are never refilled.
+func (f *Factory) BucketStatus(ctx context.Context, empty *protos.Empty) (*protos.StatusResponse, error) {
+	f.storeMutex.RLock()
+	total := f.store.Status()
+	for _, old := range f.draining {
+		status := old.Status()
+		total.Full += status.Full
+		total.Busy += status.Busy
+		total.IDs += status.IDs
+	}
+	f.storeMutex.RUnlock()
+
+	return &protos.StatusResponse{
+		Full:      int32(total.Full),
+		Busy:      int32(total.Busy),
+		Empty:     int32(total.Empty),
+		Exhausted: int32(total.Exhausted),
+		Ids:       int64(total.IDs),
+	}, nil
+}
+
+// check the admin token sent as a bearer authorization.
+func (f *Factory) authorize(ctx context.Context) error {
+	if f.config.AdminToken == "" {
+		return status.New(codes.PermissionDenied, "factory: admin token is not set").Err()
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	expected := []byte("Bearer " + f.config.AdminToken)
+	for _, value := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(value), expected) == 1 {
+			return nil
+		}
+	}
+
+	return status.New(codes.Unauthenticated, "factory: invalid admin token").Err()
+}
+
+// Bytes of s without copying, through unsafe.StringData rather than the
+// deprecated reflect.StringHeader. The bytes share the immutable memory of
+// s, so they must never be modified. The bloom filter only hashes them and
+// keeps no reference, which keeps this safe under any GC.
 func fasterByte(s string) []byte {
 	return unsafe.Slice(unsafe.StringData(s), len(s))
 }
@@ -0,0 +1,650 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"wormholes/internal/bloom"
+	"wormholes/internal/config"
+	"wormholes/internal/idgen"
+	"wormholes/protos"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Generator config with small buckets and no snapshots.
+func testConfig() *config.Config {
+	return &config.Config{
+		IDSize:         7,
+		RNG:            idgen.SecureRNG,
+		Partitions:     1,
+		BucketSize:     8,
+		BucketCapacity: 100,
+		MaxRetries:     100,
+		Workers:        2,
+		BloomMaxLimit:  100_000,
+		BloomErrorRate: 0.0000001,
+		Timeout:        100 * time.Millisecond,
+	}
+}
+
+// Prepared factory without a database, shut down when the test ends. It is
+// started with Run so that newID can be replaced first.
+func testFactory(t *testing.T, conf *config.Config) *Factory {
+	t.Helper()
+	f := NewFactory(conf, nil).Prepare()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		f.Shutdown(ctx)
+	})
+
+	return f
+}
+
+// wait until all buckets of the default store are full.
+func waitFull(t *testing.T, f *Factory) {
+	t.Helper()
+	deadline := time.After(10 * time.Second)
+	for {
+		filled := f.defaultStore().Filled()
+		if status := f.defaultStore().Status(); status.Full == len(f.defaultStore().Buckets) {
+			return
+		}
+		select {
+		case <-filled:
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("buckets not filled in time, %+v", f.defaultStore().Status())
+		}
+	}
+}
+
+// wait until n buckets of the default store are exhausted.
+func waitExhausted(t *testing.T, f *Factory, n int) {
+	t.Helper()
+	deadline := time.After(10 * time.Second)
+	for f.defaultStore().Status().Exhausted < n {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("buckets not exhausted in time, %+v", f.defaultStore().Status())
+		}
+	}
+}
+
+func TestPopulateWorkerLimit(t *testing.T) {
+	conf := testConfig()
+	f := testFactory(t, conf)
+
+	// IDs are only generated while a bucket is populated, so the callers of
+	// newID at once are the buckets populated at once
+	var active, peak atomic.Int64
+	newID := f.newID
+	f.newID = func(size int) (string, error) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			seen := peak.Load()
+			if n <= seen || peak.CompareAndSwap(seen, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Microsecond)
+
+		return newID(size)
+	}
+	f.Run(conf)
+
+	for round := 0; round < 3; round++ {
+		waitFull(t, f)
+		if popped := f.popDefault(conf.BucketSize); len(popped) != conf.BucketSize {
+			t.Fatalf("popped %d buckets, want all %d", len(popped), conf.BucketSize)
+		}
+	}
+	waitFull(t, f)
+
+	if got := peak.Load(); got > int64(conf.Workers) {
+		t.Errorf("%d buckets were populated at once, want at most %d", got, conf.Workers)
+	}
+}
+
+func TestDrainRefillConcurrently(t *testing.T) {
+	conf := testConfig()
+	conf.BucketSize = 4
+	conf.BucketCapacity = 50
+	conf.PartialBuckets = true
+	f := testFactory(t, conf)
+	f.Run(conf)
+
+	// buckets are drained while being refilled, partial ones included, and
+	// no ID may be handed out twice
+	const poppers, rounds = 8, 50
+	popped := make([][]string, poppers)
+	var wg sync.WaitGroup
+	for p := 0; p < poppers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			deadline := time.Now().Add(10 * time.Second)
+			for round := 0; round < rounds; {
+				var ids []string
+				if p%2 == 0 {
+					ids = f.pop(conf.IDSize)
+				} else if buckets := f.popDefault(2); len(buckets) > 0 {
+					ids = slices.Concat(buckets...)
+				}
+				if len(ids) == 0 {
+					if time.Now().After(deadline) {
+						t.Errorf("popper %d got %d of %d buckets in time", p, round, rounds)
+						return
+					}
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				popped[p] = append(popped[p], ids...)
+				round++
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, ids := range popped {
+		for _, id := range ids {
+			if len(id) != conf.IDSize {
+				t.Fatalf("popped id %q of size %d, want %d", id, len(id), conf.IDSize)
+			}
+			if seen[id] {
+				t.Fatalf("id %s was handed out twice", id)
+			}
+			seen[id] = true
+		}
+	}
+	waitFull(t, f)
+}
+
+func TestFillWhilePolled(t *testing.T) {
+	conf := testConfig()
+	f := testFactory(t, conf)
+	f.Run(conf)
+
+	// readers of the status hold bucket locks often, buckets are still filled
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					f.BucketStatus(context.Background(), &protos.Empty{})
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	for round := 0; round < 5; round++ {
+		waitFull(t, f)
+		// pops skip buckets being read as well
+		popped := 0
+		for deadline := time.Now().Add(time.Second); popped < conf.BucketSize; {
+			popped += len(f.popDefault(conf.BucketSize - popped))
+			if time.Now().After(deadline) {
+				t.Fatalf("popped %d buckets, want all %d", popped, conf.BucketSize)
+			}
+		}
+	}
+	waitFull(t, f)
+}
+
+// query over sorted ids, recording the ID each chunk is read after.
+func keysetQuery(ids []string, size int, afters *[]string) func(string) ([]string, error) {
+	return func(after string) ([]string, error) {
+		*afters = append(*afters, after)
+		i, _ := slices.BinarySearch(ids, after)
+		if i < len(ids) && ids[i] == after {
+			i++
+		}
+
+		return ids[i:min(i+size, len(ids))], nil
+	}
+}
+
+func TestLoadKeysetChunks(t *testing.T) {
+	conf := testConfig()
+	conf.PrepareChunk = 3
+	conf.PrepareWorkers = 2
+	f := NewFactory(conf, nil)
+	f.bloom = f.newBloom(1000)
+
+	ids := make([]string, 10)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("id%02d", i)
+	}
+	var afters []string
+	f.queryChunk = keysetQuery(ids, conf.PrepareChunk, &afters)
+	f.load(uint64(len(ids)))
+
+	// each chunk starts after the last ID of the previous one, and a short
+	// chunk ends loading
+	if want := []string{"", "id02", "id05", "id08"}; !slices.Equal(afters, want) {
+		t.Errorf("read chunks after %q, want %q", afters, want)
+	}
+	for _, id := range ids {
+		if !f.bloom.Exists([]byte(id)) {
+			t.Errorf("id %s wasn't loaded", id)
+		}
+	}
+	if count := f.bloom.Count(); count != uint64(len(ids)) {
+		t.Errorf("loaded %d IDs, want %d", count, len(ids))
+	}
+}
+
+func TestLoadRetriesChunks(t *testing.T) {
+	conf := testConfig()
+	conf.PrepareChunk = 2
+	f := NewFactory(conf, nil)
+	f.bloom = f.newBloom(1000)
+
+	ids := []string{"aaaa", "bbbb", "cccc"}
+	var afters []string
+	query := keysetQuery(ids, conf.PrepareChunk, &afters)
+	calls := 0
+	f.queryChunk = func(after string) ([]string, error) {
+		// every chunk fails once before it is read
+		if calls++; calls%2 == 1 {
+			return nil, errors.New("connection reset")
+		}
+
+		return query(after)
+	}
+	f.load(uint64(len(ids)))
+	if count := f.bloom.Count(); count != uint64(len(ids)) {
+		t.Errorf("loaded %d IDs with retries, want %d", count, len(ids))
+	}
+
+	// a chunk failing every try ends loading
+	f = NewFactory(conf, nil)
+	f.bloom = f.newBloom(1000)
+	calls = 0
+	f.queryChunk = func(string) ([]string, error) {
+		calls++
+
+		return nil, errors.New("connection refused")
+	}
+	f.load(uint64(len(ids)))
+	if calls != maxChunkTries {
+		t.Errorf("tried a failing chunk %d times, want %d", calls, maxChunkTries)
+	}
+}
+
+func TestExhaustionKeepsClaimedIDs(t *testing.T) {
+	conf := testConfig()
+	// 16 possible IDs for 2 buckets of 10
+	conf.Alphabet = "ab"
+	conf.IDSize = 4
+	conf.BucketSize = 2
+	conf.BucketCapacity = 10
+	conf.MaxRetries = 200
+	conf.Workers = 1
+	f := testFactory(t, conf)
+	f.Run(conf)
+
+	// every ID of the keyspace is handed out once, the bucket that ran out
+	// keeps the ones it got
+	seen := make(map[string]bool)
+	deadline := time.After(10 * time.Second)
+	for len(seen) < 16 {
+		for _, ids := range f.popDefault(conf.BucketSize) {
+			for _, id := range ids {
+				if seen[id] {
+					t.Fatalf("id %s was handed out twice", id)
+				}
+				seen[id] = true
+			}
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("got %d of 16 IDs", len(seen))
+		}
+	}
+
+	// refilled buckets find no ID left
+	waitExhausted(t, f, conf.BucketSize)
+	_, err := f.GetBucket(context.Background(), &protos.Empty{})
+	if status.Code(err) != codes.ResourceExhausted || status.Convert(err).Message() != "factory: keyspace exhausted" {
+		t.Errorf("got %v for an exhausted keyspace, want keyspace exhausted", err)
+	}
+}
+
+func TestGeneratorFailuresExhaustBuckets(t *testing.T) {
+	conf := testConfig()
+	conf.BucketSize = 2
+	conf.MaxRetries = 50
+	f := testFactory(t, conf)
+
+	var calls atomic.Int64
+	f.newID = func(int) (string, error) {
+		// empty IDs count as failures as well
+		if calls.Add(1)%2 == 0 {
+			return "", nil
+		}
+
+		return "", errors.New("no entropy")
+	}
+	f.Run(conf)
+
+	waitExhausted(t, f, conf.BucketSize)
+	if got := calls.Load(); got != int64(conf.BucketSize*conf.MaxRetries) {
+		t.Errorf("generated %d times, want %d tries for each bucket", got, conf.BucketSize*conf.MaxRetries)
+	}
+}
+
+func TestEmptyIsNotExhausted(t *testing.T) {
+	conf := testConfig()
+	f := testFactory(t, conf)
+	// never run, no bucket is filled
+	f.ready.Store(true)
+
+	_, err := f.GetBucket(context.Background(), &protos.Empty{})
+	if status.Code(err) != codes.ResourceExhausted || status.Convert(err).Message() != "factory: it's empty here" {
+		t.Errorf("got %v for empty buckets, want it's empty here", err)
+	}
+}
+
+func TestBlacklistedIDsAreSkipped(t *testing.T) {
+	conf := testConfig()
+	conf.Blacklist = []string{"admin"}
+	conf.BlacklistPatterns = []string{"bad"}
+	conf.BucketSize = 2
+	conf.BucketCapacity = 50
+	f := testFactory(t, conf)
+
+	// every other ID is reserved
+	var n atomic.Int64
+	f.newID = func(int) (string, error) {
+		i := n.Add(1)
+		switch i % 4 {
+		case 0:
+			return "ADMIN", nil
+		case 2:
+			return fmt.Sprintf("bad%04d", i), nil
+		}
+
+		return fmt.Sprintf("id%05d", i), nil
+	}
+	f.Run(conf)
+	waitFull(t, f)
+
+	for _, ids := range f.popDefault(conf.BucketSize) {
+		if len(ids) != conf.BucketCapacity {
+			t.Errorf("bucket holds %d IDs, want %d", len(ids), conf.BucketCapacity)
+		}
+		for _, id := range ids {
+			if f.blacklist.Match(id) {
+				t.Errorf("blacklisted id %s was put in a bucket", id)
+			}
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	conf := testConfig()
+	conf.AdminToken = "admin-token"
+	f := testFactory(t, conf)
+	f.Run(conf)
+	waitFull(t, f)
+
+	admin := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer admin-token"))
+	if _, err := f.Resize(context.Background(), &protos.ResizeRequest{Size: 4, Capacity: 10}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("got %v without a token, want unauthenticated", err)
+	}
+	for _, req := range []*protos.ResizeRequest{
+		{Size: 0, Capacity: 10},
+		{Size: 4, Capacity: -1},
+		{Size: MaxBuckets + 1, Capacity: 10},
+		{Size: 4, Capacity: MaxBucketCapacity + 1},
+	} {
+		if _, err := f.Resize(admin, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("got %v resizing to %d buckets of %d, want invalid argument", err, req.Size, req.Capacity)
+		}
+	}
+
+	resp, err := f.Resize(admin, &protos.ResizeRequest{Size: 4, Capacity: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Size != 4 || resp.Capacity != 10 || resp.Moved != 4 {
+		t.Errorf("got %+v, want 4 buckets of 10 with 4 moved", resp)
+	}
+	// moved buckets keep their IDs and are refilled to the new capacity
+	for _, bucket := range f.defaultStore().Buckets {
+		if bucket.Capacity != 10 {
+			t.Errorf("bucket has capacity %d, want 10", bucket.Capacity)
+		}
+	}
+	// the 4 moved buckets, then the 4 left in the old store, then refilled
+	// ones
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		waitFull(t, f)
+		for _, ids := range f.popDefault(4) {
+			want := conf.BucketCapacity
+			if i == 2 {
+				want = 10
+			}
+			if len(ids) != want {
+				t.Errorf("popped %d IDs in round %d, want %d", len(ids), i, want)
+			}
+			for _, id := range ids {
+				if seen[id] {
+					t.Fatalf("id %s was handed out twice", id)
+				}
+				seen[id] = true
+			}
+		}
+	}
+}
+
+func TestGetBucketsShort(t *testing.T) {
+	conf := testConfig()
+	f := testFactory(t, conf)
+	f.Run(conf)
+	waitFull(t, f)
+
+	// more than there are buckets, the rest is short
+	resp, err := f.GetBuckets(context.Background(), &protos.BucketsRequest{Count: int32(conf.BucketSize + 3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Buckets) != conf.BucketSize || resp.Short != 3 {
+		t.Errorf("got %d buckets, %d short, want %d and 3", len(resp.Buckets), resp.Short, conf.BucketSize)
+	}
+}
+
+func TestGetBucketStopsWaiting(t *testing.T) {
+	conf := testConfig()
+	conf.Timeout = time.Minute
+	// shut down by the test
+	f := NewFactory(conf, nil).Prepare()
+	// never run, no bucket is filled
+	f.ready.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := f.GetBucket(ctx, &protos.Empty{}); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("got %v for a request past its deadline, want %s", err, codes.DeadlineExceeded)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := f.GetBucket(context.Background(), &protos.Empty{})
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	shutdown, cancelShutdown := context.WithTimeout(context.Background(), time.Second)
+	defer cancelShutdown()
+	f.Shutdown(shutdown)
+	if err := <-errs; err != errShuttingDown {
+		t.Errorf("got %v waiting while shutting down, want %v", err, errShuttingDown)
+	}
+	if waited := time.Since(start); waited > 10*time.Second {
+		t.Errorf("waited %s, want the requests to stop before the timeout", waited)
+	}
+}
+
+func TestFasterByteUnderGC(t *testing.T) {
+	const n = 50_000
+	filter := bloom.New(n, 0.01)
+	ids := make([]string, n)
+	for i := range ids {
+		// built at runtime so each id lives on the heap
+		ids[i] = "id-" + strconv.Itoa(i)
+		filter.Add(fasterByte(ids[i]))
+		if i%5000 == 0 {
+			runtime.GC()
+		}
+	}
+
+	// drop the ids and churn the heap before looking them up again
+	ids = nil
+	for i := 0; i < 10; i++ {
+		garbage := make([][]byte, 1000)
+		for j := range garbage {
+			garbage[j] = make([]byte, 64)
+		}
+		runtime.GC()
+	}
+	for i := 0; i < n; i++ {
+		if !filter.Exists(fasterByte("id-" + strconv.Itoa(i))) {
+			t.Fatalf("id %d was added but doesn't exist", i)
+		}
+	}
+}
+
+func TestPopWhileRefilling(t *testing.T) {
+	conf := testConfig()
+	conf.BucketSize = 4
+	conf.BucketCapacity = 20
+	conf.PartialBuckets = true
+	// filled by the test rather than Run
+	f := testFactory(t, conf)
+	f.ready.Store(true)
+	store := f.defaultStore()
+
+	// each bucket is queued twice, like a restored one queued again, and
+	// both jobs run at once
+	populate := func(idx int) {
+		var wg sync.WaitGroup
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f.populateBucket(store, idx, conf.IDSize)
+			}()
+		}
+		wg.Wait()
+	}
+	stop := make(chan struct{})
+	var fillers sync.WaitGroup
+	for idx := range store.Buckets {
+		fillers.Add(1)
+		go func() {
+			defer fillers.Done()
+			populate(idx)
+			for {
+				select {
+				case idx := <-store.Empty:
+					populate(idx)
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	const poppers, rounds = 8, 30
+	popped := make([][]string, poppers)
+	var wg sync.WaitGroup
+	for p := 0; p < poppers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deadline := time.Now().Add(10 * time.Second)
+			for round := 0; round < rounds; {
+				var ids []string
+				if p%2 == 0 {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+					if bucket, err := f.popBucket(ctx, conf.IDSize); err == nil {
+						ids = bucket.Ids
+					}
+					cancel()
+				} else {
+					ids = slices.Concat(store.PopN(2)...)
+				}
+				if len(ids) == 0 {
+					if time.Now().After(deadline) {
+						t.Errorf("popper %d got %d of %d buckets in time", p, round, rounds)
+						return
+					}
+					continue
+				}
+				popped[p] = append(popped[p], ids...)
+				round++
+			}
+		}()
+	}
+	wg.Wait()
+
+	// buckets emptied while stopping aren't refilled
+	close(stop)
+	stopped := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-store.Empty:
+			case <-stopped:
+				return
+			}
+		}
+	}()
+	fillers.Wait()
+	close(stopped)
+
+	// a bucket filled over IDs not popped yet would lose them
+	var left []string
+	for _, bucket := range store.Buckets {
+		left = append(left, bucket.Data...)
+	}
+	seen := make(map[string]bool)
+	for _, ids := range append(popped, left) {
+		for _, id := range ids {
+			if seen[id] {
+				t.Fatalf("id %s was handed out twice", id)
+			}
+			seen[id] = true
+		}
+	}
+	if generated := f.generated.Load(); generated != uint64(len(seen)) {
+		t.Errorf("generated %d IDs, %d of them popped or left in buckets, want all", generated, len(seen))
+	}
+}
@@ -0,0 +1,116 @@
+package ipc
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	idsGenerated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wormholes_ids_generated_total",
+		Help: "Number of unique IDs generated.",
+	})
+	idCollisions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wormholes_id_collisions_total",
+		Help: "Number of generated IDs rejected by the bloom filter.",
+	})
+	bucketsPopped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wormholes_buckets_popped_total",
+		Help: "Number of buckets handed out.",
+	})
+	bucketFillDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "wormholes_bucket_fill_duration_seconds",
+		Help:    "Time taken to fill a bucket.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	bucketsDesc = prometheus.NewDesc(
+		"wormholes_buckets",
+		"Number of buckets by state.",
+		[]string{"state"}, nil,
+	)
+	utilizationDesc = prometheus.NewDesc(
+		"wormholes_keyspace_utilization",
+		"Share of the keyspace of the configured ID size taken by known IDs.",
+		nil, nil,
+	)
+	collisionRateDesc = prometheus.NewDesc(
+		"wormholes_id_collision_rate",
+		"Share of IDs generated since start rejected as taken.",
+		nil, nil,
+	)
+	bloomIDsDesc = prometheus.NewDesc(
+		"wormholes_bloom_ids",
+		"Number of IDs added to the bloom filter.",
+		nil, nil,
+	)
+	bloomCapacityDesc = prometheus.NewDesc(
+		"wormholes_bloom_capacity",
+		"Number of IDs the bloom filter holds at its error rate, over all stages.",
+		nil, nil,
+	)
+	bloomFillRatioDesc = prometheus.NewDesc(
+		"wormholes_bloom_fill_ratio",
+		"Estimated share of bits set in the bloom filter.",
+		nil, nil,
+	)
+	bloomFalsePositiveDesc = prometheus.NewDesc(
+		"wormholes_bloom_false_positive_rate",
+		"Estimated false positive rate of the bloom filter.",
+		nil, nil,
+	)
+)
+
+// Reports bucket states of the factory's default store, generation and bloom
+// filter statistics when scraped.
+type bucketCollector struct {
+	factory *Factory
+}
+
+func (c bucketCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bucketsDesc
+	ch <- utilizationDesc
+	ch <- collisionRateDesc
+	ch <- bloomIDsDesc
+	ch <- bloomCapacityDesc
+	ch <- bloomFillRatioDesc
+	ch <- bloomFalsePositiveDesc
+}
+
+func (c bucketCollector) Collect(ch chan<- prometheus.Metric) {
+	status := c.factory.defaultStore().Status()
+	ch <- prometheus.MustNewConstMetric(bucketsDesc, prometheus.GaugeValue, float64(status.Full), "full")
+	ch <- prometheus.MustNewConstMetric(bucketsDesc, prometheus.GaugeValue, float64(status.Busy), "busy")
+	ch <- prometheus.MustNewConstMetric(bucketsDesc, prometheus.GaugeValue, float64(status.Empty), "empty")
+	ch <- prometheus.MustNewConstMetric(bucketsDesc, prometheus.GaugeValue, float64(status.Exhausted), "exhausted")
+
+	generation := c.factory.GenerationStats()
+	ch <- prometheus.MustNewConstMetric(utilizationDesc, prometheus.GaugeValue, generation.Utilization)
+	ch <- prometheus.MustNewConstMetric(collisionRateDesc, prometheus.GaugeValue, generation.CollisionRate)
+
+	// the bloom filter is only set once prepared
+	if !c.factory.ready.Load() {
+		return
+	}
+	filter := c.factory.bloom.Stats()
+	ch <- prometheus.MustNewConstMetric(bloomIDsDesc, prometheus.GaugeValue, float64(filter.Count))
+	ch <- prometheus.MustNewConstMetric(bloomCapacityDesc, prometheus.GaugeValue, float64(filter.Capacity))
+	ch <- prometheus.MustNewConstMetric(bloomFillRatioDesc, prometheus.GaugeValue, filter.FillRatio)
+	ch <- prometheus.MustNewConstMetric(bloomFalsePositiveDesc, prometheus.GaugeValue, filter.FalsePositiveRate)
+}
+
+// Serve prometheus metrics on given address.
+func (f *Factory) ServeMetrics(addr string) {
+	prometheus.MustRegister(bucketCollector{f})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Info().Msgf("factory: serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error().Err(err).Msg("factory: failed to serve metrics")
+	}
+}
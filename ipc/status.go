@@ -12,6 +12,11 @@ func (r *Status) SetBusy() {
 	atomic.StoreInt32((*int32)(r), 1)
 }
 
+// TrySetBusy sets r busy, reporting false if it already was.
+func (r *Status) TrySetBusy() bool {
+	return atomic.CompareAndSwapInt32((*int32)(r), 0, 1)
+}
+
 func (r *Status) SetIdle() {
 	atomic.StoreInt32((*int32)(r), 0)
 }
@@ -3,74 +3,178 @@ package ipc
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
 	"sync"
 	"time"
+	"wormholes/internal/requestid"
 	"wormholes/protos"
 
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 var (
 	// backOff time is 500ms by default.
 	backOffTime = time.Millisecond * 250
-	ErrNoIds    = errors.New("reserve: there are no IDs ready yet")
+	// first wait between failed fetches, doubled on each retry.
+	fetchBackOff  = time.Millisecond * 50
+	fetchTimeout  = time.Second * 2
+	maxFetchTries = 5
+	// longest wait between attempts to reconnect to the generator.
+	maxReconnectDelay = time.Second * 5
+	ErrNoIds          = errors.New("reserve: there are no IDs ready yet")
+	ErrIDTaken        = errors.New("reserve: ID is already taken")
 )
 
+// Holds IDs fetched from the generator, fetching more in background when
+// fewer than lowWatermark are left.
 type Store struct {
-	mutex  sync.RWMutex
-	status *Status
-	bucket *protos.Bucket
-	conn   *grpc.ClientConn
-	client protos.BucketServiceClient
+	mutex        sync.Mutex
+	status       *Status
+	bucket       *protos.Bucket
+	refilled     chan struct{}
+	lastErr      error
+	lowWatermark int
+	conn         *grpc.ClientConn
+	client       protos.BucketServiceClient
 }
 
-func NewStore(port string) *Store {
+func NewStore(port string, lowWatermark int, creds credentials.TransportCredentials) *Store {
 
-	conn, err := grpc.Dial(port, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	// reconnects in background, so a restarted generator is picked up
+	reconnect := backoff.DefaultConfig
+	reconnect.MaxDelay = maxReconnectDelay
+
+	conn, err := grpc.Dial(port,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithConnectParams(grpc.ConnectParams{Backoff: reconnect}),
+		// carries the trace of a request to the generator
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+		// so the generator logs the request it serves
+		grpc.WithUnaryInterceptor(requestid.UnaryClientInterceptor),
+	)
 	if err != nil {
 		log.Error().Err(err).Msg("grpc-reserve: grpc failed to connect")
 	}
 
 	client := protos.NewBucketServiceClient(conn)
 
-	return &Store{
-		mutex:  sync.RWMutex{},
-		status: NewStatus(),
-		bucket: &protos.Bucket{},
-		conn:   conn,
-		client: client,
+	s := &Store{
+		mutex:        sync.Mutex{},
+		status:       NewStatus(),
+		bucket:       &protos.Bucket{},
+		lowWatermark: lowWatermark,
+		conn:         conn,
+		client:       client,
 	}
-}
 
-func (s *Store) isEmpty() bool {
-	return len(s.bucket.Ids) == 0
+	// prime it so the first requests don't wait
+	s.mutex.Lock()
+	s.refill()
+	s.mutex.Unlock()
+
+	return s
 }
 
-func (s *Store) fetch() {
-	if s.status.IsBusy() {
+// Start fetching a bucket in background unless a fetch is running, must be
+// called with the lock held.
+func (s *Store) refill() {
+	if !s.status.TrySetBusy() {
 		return
 	}
 
-	s.status.SetBusy()
+	s.refilled = make(chan struct{})
+	go s.fetch(s.refilled)
+}
+
+// Fetch a bucket, retrying with jittered backoff while the generator is
+// unavailable or out of IDs.
+func (s *Store) fetch(done chan struct{}) {
+	defer close(done)
 	defer s.status.SetIdle()
 
-	bucket, err := s.client.GetBucket(context.Background(), &protos.Empty{})
-	if err != nil {
-		log.Error().Err(err).Msg("grpc-reserve: grpc failed to fetch bucket")
-	}
+	wait := fetchBackOff
+	for try := 1; ; try++ {
+		// waits for a reconnect instead of failing fast
+		ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+		bucket, err := s.client.GetBucket(ctx, &protos.Empty{}, grpc.WaitForReady(true))
+		cancel()
+
+		if err == nil && len(bucket.GetIds()) > 0 {
+			s.mutex.Lock()
+			s.bucket.Ids = append(s.bucket.Ids, bucket.Ids...)
+			s.lastErr = nil
+			s.mutex.Unlock()
+
+			return
+		}
+		if err == nil {
+			err = status.Error(codes.Unavailable, "empty bucket")
+		}
 
-	if len(bucket.Ids) > 0 {
 		s.mutex.Lock()
-		s.bucket.Ids = bucket.Ids
+		s.lastErr = err
 		s.mutex.Unlock()
+
+		log.Error().Err(err).Msgf("grpc-reserve: grpc failed to fetch bucket, try %d", try)
+		if try == maxFetchTries || !retryable(err) {
+			return
+		}
+		// waiting only helps while buckets are being filled or can be
+		if status.Code(err) == codes.ResourceExhausted {
+			gen, err := s.GeneratorStatus()
+			if err == nil && gen.GetFull() == 0 && gen.GetBusy() == 0 && gen.GetEmpty() == 0 {
+				log.Error().Msg("grpc-reserve: all buckets of the generator are exhausted")
+
+				return
+			}
+		}
+
+		time.Sleep(wait/2 + rand.N(wait/2))
+		wait *= 2
 	}
 }
 
-func (s *Store) pop() string {
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// Buckets of the generator in each state and the IDs it has ready.
+func (s *Store) GeneratorStatus() (*protos.StatusResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	return s.client.BucketStatus(ctx, &protos.Empty{})
+}
+
+// State of the connection to the generator.
+func (s *Store) State() connectivity.State {
+	return s.conn.GetState()
+}
+
+// Number of IDs held.
+func (s *Store) Available() int {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+
+	return len(s.bucket.Ids)
+}
+
+// pop an ID, must be called with the lock held.
+func (s *Store) pop() string {
 	id := s.bucket.Ids[0]
 	s.bucket.Ids = s.bucket.Ids[1:]
 
@@ -78,17 +182,96 @@ func (s *Store) pop() string {
 }
 
 func (s *Store) GetID() (string, error) {
-	if s.isEmpty() {
-		s.fetch()
-		// this delays some request instead of failing them
-		time.Sleep(backOffTime)
-	} else {
+	s.mutex.Lock()
+	if len(s.bucket.Ids) <= s.lowWatermark {
+		s.refill()
+	}
+	if len(s.bucket.Ids) > 0 {
+		defer s.mutex.Unlock()
+
 		return s.pop(), nil
 	}
+	refilled := s.refilled
+	s.mutex.Unlock()
+
+	// this delays some request instead of failing them
+	select {
+	case <-refilled:
+	case <-time.After(backOffTime):
+	}
 
-	if !s.isEmpty() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.bucket.Ids) > 0 {
 		return s.pop(), nil
 	}
+	if s.lastErr != nil {
+		return "", fmt.Errorf("%w: %w", ErrNoIds, s.lastErr)
+	}
 
 	return "", ErrNoIds
 }
+
+// GetIDs pops n IDs under a single lock, waiting for refills while there are
+// too few. If the generator can't provide enough, the IDs popped so far are
+// returned along with an error.
+func (s *Store) GetIDs(n int) ([]string, error) {
+	ids := make([]string, 0, n)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for {
+		take := min(n-len(ids), len(s.bucket.Ids))
+		ids = append(ids, s.bucket.Ids[:take]...)
+		s.bucket.Ids = s.bucket.Ids[take:]
+
+		if len(s.bucket.Ids) <= s.lowWatermark {
+			s.refill()
+		}
+		if len(ids) == n {
+			return ids, nil
+		}
+
+		refilled := s.refilled
+		s.mutex.Unlock()
+		timedOut := false
+		select {
+		case <-refilled:
+		case <-time.After(backOffTime):
+			timedOut = true
+		}
+		s.mutex.Lock()
+
+		// a refill taken by other callers is fetched again, only a failed
+		// or slow one gives up
+		if len(s.bucket.Ids) > 0 {
+			continue
+		}
+		if s.lastErr != nil {
+			return ids, fmt.Errorf("%w: %w", ErrNoIds, s.lastErr)
+		}
+		if timedOut {
+			return ids, ErrNoIds
+		}
+	}
+}
+
+// Recycle IDs that were taken but never used for a link, they are handed
+// out again before any other.
+func (s *Store) Recycle(ids ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.bucket.Ids = append(slices.Clip(ids), s.bucket.Ids...)
+}
+
+// Register a custom ID in a namespace with the generator so it is never
+// generated. The default namespace is empty.
+func (s *Store) Register(ctx context.Context, namespace, id string) error {
+	_, err := s.client.Register(ctx, &protos.RegisterRequest{Id: id, Namespace: namespace})
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrIDTaken
+	}
+
+	return err
+}
@@ -0,0 +1,169 @@
+package ipc
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"wormholes/protos"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Store fetching from f over gRPC, both stopped when the test ends.
+func testStore(t *testing.T, f *Factory, lowWatermark int) *Store {
+	t.Helper()
+	lis := listen(t, "127.0.0.1:0")
+	serve(t, f, lis)
+
+	s := NewStore(lis.Addr().String(), lowWatermark, insecure.NewCredentials())
+	t.Cleanup(func() { s.conn.Close() })
+
+	return s
+}
+
+func TestGetIDsConcurrently(t *testing.T) {
+	conf := testConfig()
+	conf.BucketCapacity = 50
+	f := testFactory(t, conf)
+	f.Run(conf)
+	s := testStore(t, f, 10)
+
+	const (
+		callers = 16
+		calls   = 20
+	)
+	got := make([][]string, callers)
+	var wg sync.WaitGroup
+	for i := range got {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for call := 0; call < calls; call++ {
+				// sizes past a bucket take several fetches
+				ids, err := s.GetIDs(1 + (i+call)%70)
+				if err != nil {
+					t.Errorf("caller %d: %v", i, err)
+
+					return
+				}
+				got[i] = append(got[i], ids...)
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, ids := range got {
+		for _, id := range ids {
+			if seen[id] {
+				t.Fatalf("id %s was handed out twice", id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+// wait until s holds IDs.
+func waitAvailable(t *testing.T, s *Store) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Available() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("reserve wasn't primed in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSteadyDrawsNeverEmpty(t *testing.T) {
+	conf := testConfig()
+	f := testFactory(t, conf)
+	f.Run(conf)
+	waitFull(t, f)
+	// refilled when half of a bucket is left
+	s := testStore(t, f, conf.BucketCapacity/2)
+	waitAvailable(t, s)
+
+	seen := make(map[string]bool)
+	for draw := 0; draw < 5*conf.BucketCapacity; draw++ {
+		if s.Available() == 0 {
+			t.Fatalf("reserve was empty at draw %d", draw)
+		}
+		id, err := s.GetID()
+		if err != nil {
+			t.Fatalf("draw %d: %v", draw, err)
+		}
+		if seen[id] {
+			t.Fatalf("id %s was drawn twice", id)
+		}
+		seen[id] = true
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func listen(t *testing.T, addr string) net.Listener {
+	t.Helper()
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return lis
+}
+
+// Serve f over gRPC on lis, stopped when the test ends.
+func serve(t *testing.T, f *Factory, lis net.Listener, opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(opts...)
+	protos.RegisterBucketServiceServer(server, f)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	return server
+}
+
+func TestGeneratorRestart(t *testing.T) {
+	conf := testConfig()
+	f := testFactory(t, conf)
+	f.Run(conf)
+	lis := listen(t, "127.0.0.1:0")
+	addr := lis.Addr().String()
+
+	server := serve(t, f, lis)
+	s := NewStore(addr, 10, insecure.NewCredentials())
+	t.Cleanup(func() { s.conn.Close() })
+	waitAvailable(t, s)
+
+	// the generator goes down, IDs held are still handed out
+	server.Stop()
+	for {
+		if _, err := s.GetID(); err != nil {
+			break
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.State() == connectivity.Ready {
+		if time.Now().After(deadline) {
+			t.Fatal("connection is still ready with the generator down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// and comes back up at the same address
+	serve(t, f, listen(t, addr))
+	deadline = time.Now().Add(15 * time.Second)
+	for {
+		if _, err := s.GetID(); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no ID after the generator came back, connection %s", s.State())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if state := s.State(); state != connectivity.Ready {
+		t.Errorf("connection is %s after recovering, want %s", state, connectivity.Ready)
+	}
+}
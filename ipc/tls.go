@@ -0,0 +1,90 @@
+package ipc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"wormholes/internal/config"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+var ErrNoCerts = errors.New("ipc: no certificates found in CA file")
+
+// Credentials the generator serves with, TLS when GEN_TLS_CERT is set and
+// mutual TLS when GEN_TLS_CLIENT_CA is also set. Plaintext otherwise.
+func ServerCredentials(conf *config.Config) (credentials.TransportCredentials, error) {
+	if conf.GenTLSCert == "" {
+		return insecure.NewCredentials(), nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.GenTLSCert, conf.GenTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("ipc: failed to load server certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if conf.GenTLSClientCA != "" {
+		pool, err := loadCA(conf.GenTLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// Credentials the creator connects to the generator with, TLS when the
+// generator serves it or GEN_TLS_CA is set, presenting a client certificate
+// when GEN_TLS_CLIENT_CERT is set. Plaintext otherwise.
+func ClientCredentials(conf *config.Config) (credentials.TransportCredentials, error) {
+	if conf.GenTLSCert == "" && conf.GenTLSCA == "" {
+		return insecure.NewCredentials(), nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: conf.GenTLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	// system roots are used without a CA
+	if conf.GenTLSCA != "" {
+		pool, err := loadCA(conf.GenTLSCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if conf.GenTLSClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.GenTLSClientCert, conf.GenTLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("ipc: failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+func loadCA(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ipc: failed to read CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%w: %s", ErrNoCerts, path)
+	}
+
+	return pool, nil
+}
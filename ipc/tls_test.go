@@ -0,0 +1,123 @@
+package ipc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"wormholes/internal/config"
+
+	"google.golang.org/grpc"
+)
+
+// Certificate and key signed by parent, or self-signed without one, written
+// as PEM to name.crt and name.key in dir.
+func issue(t *testing.T, dir, name string, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(path, kind string, data []byte) {
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: data}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(dir, name+".crt"), "CERTIFICATE", der)
+	write(filepath.Join(dir, name+".key"), "EC PRIVATE KEY", keyDER)
+
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := issue(t, dir, "ca", &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	issue(t, dir, "server", &x509.Certificate{
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	issue(t, dir, "client", &x509.Certificate{
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	conf := testConfig()
+	conf.GenTLSCert = filepath.Join(dir, "server.crt")
+	conf.GenTLSKey = filepath.Join(dir, "server.key")
+	conf.GenTLSClientCA = filepath.Join(dir, "ca.crt")
+	conf.GenTLSCA = filepath.Join(dir, "ca.crt")
+	conf.GenTLSServerName = "localhost"
+	f := testFactory(t, conf)
+	f.Run(conf)
+	waitFull(t, f)
+
+	serverCreds, err := ServerCredentials(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := listen(t, "127.0.0.1:0")
+	serve(t, f, lis, grpc.Creds(serverCreds))
+
+	connect := func(conf config.Config) *Store {
+		creds, err := ClientCredentials(&conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewStore(lis.Addr().String(), 10, creds)
+		t.Cleanup(func() { s.conn.Close() })
+
+		return s
+	}
+
+	// presenting a certificate signed by the client CA
+	withCert := *conf
+	withCert.GenTLSClientCert = filepath.Join(dir, "client.crt")
+	withCert.GenTLSClientKey = filepath.Join(dir, "client.key")
+	s := connect(withCert)
+	if _, err := s.GetID(); err != nil {
+		t.Errorf("got %v with a client certificate, want an ID", err)
+	}
+
+	// the handshake fails without one
+	s = connect(*conf)
+	if _, err := s.GeneratorStatus(); err == nil {
+		t.Error("got the status of the generator without a client certificate, want the handshake to fail")
+	}
+	if available := s.Available(); available != 0 {
+		t.Errorf("got %d IDs without a client certificate, want none", available)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"wormholes/internal/config"
+	"wormholes/internal/links"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// JSON of v padded with spaces to size bytes.
+func padded(t *testing.T, v any, size int) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > size {
+		t.Fatalf("body is %d bytes, more than %d", len(data), size)
+	}
+
+	return string(data) + strings.Repeat(" ", size-len(data))
+}
+
+// Status of a request sent without a content length, chunked.
+func (s *testServer) chunked(t *testing.T, method, path, body string) int {
+	t.Helper()
+	// a reader of unknown length
+	req := httptest.NewRequest(method, path, io.MultiReader(strings.NewReader(body)))
+	req.TransferEncoding = []string{"chunked"}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	resp, err := s.app.Test(req, 10_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestBodyLimits(t *testing.T) {
+	const writeLimit, bodyLimit = 256, 1024
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.WriteBodyLimit = writeLimit
+		conf.BodyLimit = bodyLimit
+	})
+
+	// single link writes up to WRITE_BODY_LIMIT
+	create := LinkCreateRequest{Target: "https://example.com"}
+	decode(t, s.do(t, fiber.MethodPut, "/api/", padded(t, create, writeLimit)), fiber.StatusOK, nil)
+	var body struct {
+		Error APIError `json:"error"`
+	}
+	decode(t, s.do(t, fiber.MethodPut, "/api/", padded(t, create, writeLimit+1)), fiber.StatusRequestEntityTooLarge, &body)
+	if body.Error.Code != errBodyTooLarge.Code {
+		t.Errorf("got code %s for a body over the limit, want %s", body.Error.Code, errBodyTooLarge.Code)
+	}
+	if status := s.chunked(t, fiber.MethodPut, "/api/", padded(t, create, writeLimit)); status != fiber.StatusOK {
+		t.Errorf("got status %d for a chunked body at the limit, want %d", status, fiber.StatusOK)
+	}
+	if status := s.chunked(t, fiber.MethodPut, "/api/", padded(t, create, writeLimit+1)); status != fiber.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d for a chunked body over the limit, want %d", status, fiber.StatusRequestEntityTooLarge)
+	}
+
+	// batches up to BODY_LIMIT
+	batch := []LinkCreateRequest{create, create}
+	decode(t, s.do(t, fiber.MethodPost, "/api/batch", padded(t, batch, bodyLimit)), fiber.StatusOK, nil)
+	decode(t, s.do(t, fiber.MethodPost, "/api/batch", padded(t, batch, bodyLimit+1)), fiber.StatusRequestEntityTooLarge, nil)
+}
+
+func TestTargetLimit(t *testing.T) {
+	const maxLength = 100
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.MaxTargetLength = maxLength
+	})
+
+	prefix := "https://example.com/"
+	atLimit := prefix + strings.Repeat("a", maxLength-len(prefix))
+	id := s.create(t, LinkCreateRequest{Target: atLimit})
+	if link := s.get(t, id); link.Target != atLimit {
+		t.Errorf("got target %s, want the one at the limit", link.Target)
+	}
+
+	var body struct {
+		Error APIError `json:"error"`
+	}
+	tooLong := atLimit + "a"
+	decode(t, s.do(t, fiber.MethodPut, "/api/", LinkCreateRequest{Target: tooLong}), fiber.StatusBadRequest, &body)
+	if body.Error.Code != errTargetTooLong.Code {
+		t.Errorf("got code %s creating a target over the limit, want %s", body.Error.Code, errTargetTooLong.Code)
+	}
+	body.Error = APIError{}
+	decode(t, s.do(t, fiber.MethodPost, "/api/"+id, map[string]string{"target": tooLong}), fiber.StatusBadRequest, &body)
+	if body.Error.Code != errTargetTooLong.Code {
+		t.Errorf("got code %s updating to a target over the limit, want %s", body.Error.Code, errTargetTooLong.Code)
+	}
+	body.Error = APIError{}
+	variants := []links.Variant{{Target: atLimit, Weight: 1}, {Target: tooLong, Weight: 1}}
+	decode(t, s.do(t, fiber.MethodPut, "/api/", LinkCreateRequest{Target: atLimit, Variants: variants}), fiber.StatusBadRequest, &body)
+	if body.Error.Code != errTargetTooLong.Code {
+		t.Errorf("got code %s for a variant over the limit, want %s", body.Error.Code, errTargetTooLong.Code)
+	}
+}
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 	"wormholes/ingestor"
-	"wormholes/internal/cache"
+	"wormholes/internal/blacklist"
 	"wormholes/internal/config"
 	"wormholes/internal/db"
+	"wormholes/internal/geoip"
 	"wormholes/internal/header"
+	"wormholes/internal/links"
+	"wormholes/internal/preview"
+	"wormholes/internal/requestid"
+	"wormholes/internal/tracing"
+	"wormholes/internal/webhook"
 	"wormholes/ipc"
 	"wormholes/protos"
 	"wormholes/store"
@@ -16,15 +27,28 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/etag"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	conf := config.DefaultConfig()
+	if conf.LogFormat == "json" {
+		log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+	}
+	// lines logged with a context without a request ID
+	zerolog.DefaultContextLogger = &log.Logger
+	if len(os.Args) > 1 && os.Args[1] == "benchmark" {
+		benchmark(conf, os.Args[2:])
+
+		return
+	}
 	if !fiber.IsChild() {
 		header.Show()
 
@@ -32,23 +56,91 @@ func main() {
 	}
 	dbconf := db.Load()
 
-	postgres := dbconf.Postgres.Connect()
-	cache := cache.New(dbconf.REDIS_URI)
-	db.InitPg(postgres)
+	flushSpans := func(context.Context) error { return nil }
+	if conf.TraceEndpoint != "" {
+		var err error
+		flushSpans, err = tracing.Setup(conf.TraceEndpoint, conf.TraceInsecure, conf.TraceRatio)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to set up tracing")
+		}
+	}
+
+	cache := dbconf.Redis.Connect()
+
+	// without PostgreSQL, clicks aren't recorded for analytics and expired
+	// or deleted links aren't swept
+	var postgres *pgxpool.Pool
+	var backend store.Store
+	if conf.Store == config.StoreMemory {
+		backend = store.WithMetrics(store.WithMemory())
+	} else {
+		postgres = dbconf.Postgres.Connect()
+		db.InitPg(postgres)
+		backend = store.WithMetrics(store.WithPg(postgres, conf.QueryTimeout))
+	}
+	pipe := ingestor.New(backend, conf.BatchSize, conf.IngestInterval, conf.DeadLetter)
+	if len(conf.Webhooks) > 0 {
+		hooks := webhook.New(conf.Webhooks, conf.WebhookSecret, conf.WebhookRetries, conf.WebhookTimeout).Start()
+		pipe.Notify(hooks.Send)
+	}
+	if conf.Preview {
+		previews := preview.New(backend, cache, conf.PreviewTimeout, conf.PreviewMaxBytes).Start()
+		pipe.Notify(previews.Send)
+	}
+	// links cached before they were ingested must not shadow the stored one
+	pipe.OnConflict(func(link *links.Link) {
+		if err := cache.DeleteLink(link.Key()); err != nil {
+			log.Warn().Err(err).Msg("ingest: failed to invalidate cache of conflicting link")
+		}
+	})
+
+	// shared by analytics and geo rules of links
+	geo := openGeoIP(conf)
 
-	backend := store.WithPg(postgres)
-	pipe := ingestor.New(postgres, conf.BatchSize).Start()
+	var clicks *ingestor.Pipe
+	if conf.Analytics && postgres != nil {
+		clicks = ingestor.NewPipe(postgres, geo, conf.ClickStreams, conf.ClickBatch, conf.ReferrerDetail).Start()
+	}
 
+	var factory *ipc.Factory
 	if !fiber.IsChild() {
+		ingestor.NewClickFlusher(backend, cache, conf.ClicksFlush).Start()
+		if conf.WarmLinks > 0 {
+			go warmCache(backend, cache, conf.WarmLinks)
+		}
+		if conf.SweepInterval > 0 && postgres != nil {
+			ingestor.NewSweeper(postgres, conf.SweepInterval, conf.DeleteRetention).Start()
+		}
+
+		// shut down once the server stops, after links are written
+		factory = ipc.NewFactory(conf, postgres)
+		if conf.MetricsAddr != "" {
+			go factory.ServeMetrics(conf.MetricsAddr)
+		}
+
 		go func() {
-			factory := ipc.NewFactory(conf, postgres).Prepare().Run(conf)
 			lis, err := net.Listen("tcp", fmt.Sprintf(":%d", conf.GenPort))
 			if err != nil {
 				log.Fatal().Err(err).Msg("factory: failed to start")
 			}
 
-			grpcServer := grpc.NewServer()
+			creds, err := ipc.ServerCredentials(conf)
+			if err != nil {
+				log.Fatal().Err(err).Msg("factory: failed to set up TLS")
+			}
+
+			grpcServer := grpc.NewServer(
+				grpc.Creds(creds),
+				grpc.StatsHandler(otelgrpc.NewServerHandler()),
+				grpc.UnaryInterceptor(requestid.UnaryServerInterceptor),
+			)
 			protos.RegisterBucketServiceServer(grpcServer, factory)
+			healthpb.RegisterHealthServer(grpcServer, factory.Health())
+
+			// serve health checks while IDs are being loaded
+			go func() {
+				factory.Prepare().Run(conf)
+			}()
 
 			if err := grpcServer.Serve(lis); err != nil {
 				log.Fatal().Err(err).Msg("factory: failed to start")
@@ -56,22 +148,172 @@ func main() {
 		}()
 	}
 
-	ipcStore := ipc.NewStore(fmt.Sprintf(":%d", conf.GenPort))
-	handler := NewHandler(backend, pipe, cache, ipcStore)
+	creds, err := ipc.ClientCredentials(conf)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to set up generator TLS")
+	}
+	ipcStore := ipc.NewStore(fmt.Sprintf(":%d", conf.GenPort), conf.LowWatermark, creds)
+	// links whose ID turns out to be taken are written under a new one
+	pipe.Reassign(ipcStore.GetID).Start()
+	reserved, err := blacklist.New(conf.Blacklist, conf.BlacklistPatterns)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load blacklist")
+	}
+	handler := NewHandler(backend, pipe, clicks, cache, ipcStore, conf, reserved, geo)
 
+	// links in memory can't be shared by processes
+	prefork := conf.Store != config.StoreMemory
 	app := fiber.New(fiber.Config{
 		DisableStartupMessage:   true,
 		EnableTrustedProxyCheck: true,
-		Prefork:                 true,
+		ErrorHandler:            errorHandler,
+		Prefork:                 prefork,
 		ServerHeader:            "wormholes",
+		// imports are streamed, see limitBody
+		StreamRequestBody: true,
+		Concurrency:       conf.MaxConns,
+		ReadTimeout:       conf.ReadTimeout,
+		WriteTimeout:      conf.WriteTimeout,
+		IdleTimeout:       conf.IdleTimeout,
+		DisableKeepalive:  !conf.KeepAlive,
 	})
 
-	app.Use(etag.New())
+	app.Use(etag.New(etag.Config{
+		// an ETag needs the whole body, exports are streamed
+		Next: func(c *fiber.Ctx) bool { return c.Path() == ExportPath },
+	}))
 	app.Use(recover.New())
 
 	handler.Setup(app)
 
+	// children of a prefork parent serve the requests, they get the signals
+	// of the parent to drain as well, and its Listen returns once they exit
+	var forked sync.Map
+	app.Hooks().OnFork(func(pid int) error {
+		forked.Store(pid, true)
+
+		return nil
+	})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		received := <-sig
+		forked.Range(func(pid, _ any) bool {
+			if child, err := os.FindProcess(pid.(int)); err == nil {
+				child.Signal(received)
+			}
+
+			return true
+		})
+		if err := app.ShutdownWithTimeout(conf.ShutdownTimeout); err != nil {
+			log.Error().Err(err).Msg("failed to shutdown server")
+		}
+	}()
+
 	if err := app.Listen(fmt.Sprintf(":%d", conf.Port)); err != nil {
 		log.Error().Err(err).Msg("failed to start server")
 	}
+
+	// links already created are written before exiting
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	if err := pipe.Shutdown(ctx); err != nil {
+		log.Error().Err(err).Msg("failed to write pending links")
+	}
+	if err := flushSpans(ctx); err != nil {
+		log.Error().Err(err).Msg("failed to export pending spans")
+	}
+	if factory != nil {
+		factory.Shutdown(ctx)
+	}
+	cancel()
+
+	if clicks != nil {
+		clicks.Close()
+	}
+}
+
+// Open GeoIP databases for the click pipe, downloading them first if enabled.
+// They are reloaded on SIGHUP and every GEOIP_RELOAD, keeping the open ones
+// if the new files fail to open.
+func openGeoIP(conf *config.Config) geoip.Reader {
+	downloadGeoIP(conf)
+
+	geo, err := geoip.NewReloader(func() (geoip.Reader, error) {
+		return loadGeoIP(conf)
+	})
+	if err != nil && conf.GeoIPRequired {
+		log.Fatal().Err(err).Msg("geoip: failed to open databases")
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("geoip: locations of clicks and visitors will be unknown")
+	}
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		var tick <-chan time.Time
+		if conf.GeoIPReload > 0 {
+			ticker := time.NewTicker(conf.GeoIPReload)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-hup:
+			case <-tick:
+				downloadGeoIP(conf)
+			}
+			if err := geo.Reload(); err != nil {
+				log.Error().Err(err).Msg("geoip: failed to reload, keeping the open databases")
+
+				continue
+			}
+			log.Info().Msg("geoip: reloaded databases")
+		}
+	}()
+
+	return geo
+}
+
+// Download GeoIP databases missing or older than GEOIP_REFRESH, from the
+// parent process only.
+func downloadGeoIP(conf *config.Config) {
+	if !conf.GeoIPDownload || fiber.IsChild() {
+		return
+	}
+
+	for _, edition := range []string{"GeoLite2-City", "GeoLite2-ASN"} {
+		err := geoip.Download(conf.GeoIPDir, edition, conf.GeoIPLicenseKey, conf.GeoIPRefresh)
+		if err != nil {
+			log.Error().Err(err).Msgf("geoip: failed to download %s", edition)
+		}
+	}
+}
+
+// Open the City or Country database at GEOIP_PATH, or found in GEOIP_DIR,
+// and the ASN database of GEOIP_DIR if there is one. Without a location
+// database, the reader is returned with ErrNoDB and only finds ASNs.
+func loadGeoIP(conf *config.Config) (geoip.Reader, error) {
+	var geo geoip.Reader
+	var err error
+	if conf.GeoIPPath != "" {
+		geo, err = geoip.OpenFile(conf.GeoIPPath)
+	} else {
+		geo, err = geoip.Open(conf.GeoIPDir)
+	}
+	if err != nil && err != geoip.ErrNoDB {
+		return geo, err
+	}
+
+	asn, asnErr := geoip.OpenASN(conf.GeoIPDir)
+	if asnErr != nil {
+		if asnErr != geoip.ErrNoDB {
+			log.Warn().Err(asnErr).Msg("geoip: failed to open ASN database")
+		}
+
+		return geo, err
+	}
+
+	return geoip.WithASN(geo, asn), err
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wormholes_cache_requests_total",
+		Help: "Number of link cache lookups by result, one of hit, miss or error.",
+	}, []string{"result"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wormholes_http_request_duration_seconds",
+		Help:    "Time taken to handle a request.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"method", "route", "status"})
+	rejectedIDs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wormholes_rejected_ids_total",
+		Help: "Number of lookups of IDs no link can have, answered without the cache or database.",
+	})
+	localIDs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wormholes_local_ids_total",
+		Help: "Number of IDs generated by the creator while the generator was unavailable.",
+	})
+	exportDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "wormholes_export_duration_seconds",
+		Help:    "Time taken to stream a CSV export of links.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+	})
+)
+
+// Record duration and status of each request by route.
+func requestMetrics(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+
+	// errors are written after the middleware returns
+	status := c.Response().StatusCode()
+	if err != nil {
+		status = toAPIError(err).Status
+	}
+
+	requestDuration.
+		WithLabelValues(c.Method(), c.Route().Path, strconv.Itoa(status)).
+		Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+// Serve metrics of the process handling the scrape.
+var metricsHandler = adaptor.HTTPHandler(promhttp.Handler())
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"wormholes/internal/config"
+	"wormholes/internal/links"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	ownerKey = "owner-secret-0123456789"
+	otherKey = "other-secret-0123456789"
+)
+
+func protectedServer(t *testing.T) *testServer {
+	return newTestServer(t, func(conf *config.Config) {
+		conf.Secret = "unlock-secret"
+		conf.APIKeys = []string{"owner:" + ownerKey, "other:" + otherKey}
+	})
+}
+
+func TestUnlockPassword(t *testing.T) {
+	s := protectedServer(t)
+	id := s.create(t, LinkCreateRequest{Target: "https://example.com/secret", Password: "hunter2"}, APIKeyHeader, ownerKey)
+
+	decode(t, s.do(t, fiber.MethodGet, "/"+id, nil), fiber.StatusUnauthorized, nil)
+	decode(t, s.do(t, fiber.MethodPost, "/"+id+"/unlock", LinkUnlockRequest{"wrong"}), fiber.StatusUnauthorized, nil)
+	decode(t, s.do(t, fiber.MethodPost, "/"+id+"/unlock", LinkUnlockRequest{""}), fiber.StatusUnauthorized, nil)
+	decode(t, s.do(t, fiber.MethodGet, "/"+id+"?token=forged.token", nil), fiber.StatusUnauthorized, nil)
+
+	var unlocked struct {
+		Token string `json:"token"`
+	}
+	decode(t, s.do(t, fiber.MethodPost, "/"+id+"/unlock", LinkUnlockRequest{"hunter2"}), fiber.StatusOK, &unlocked)
+	resp := s.do(t, fiber.MethodGet, "/"+id+"?token="+url.QueryEscape(unlocked.Token), nil)
+	if resp.StatusCode != fiber.StatusFound || resp.Header.Get(fiber.HeaderLocation) != "https://example.com/secret" {
+		t.Errorf("got %d to %q with a token, want a redirect to the target", resp.StatusCode, resp.Header.Get(fiber.HeaderLocation))
+	}
+
+	// a token is only valid for the link it was issued for
+	other := s.create(t, LinkCreateRequest{Target: "https://example.com/other", Password: "hunter2"}, APIKeyHeader, ownerKey)
+	decode(t, s.do(t, fiber.MethodGet, "/"+other+"?token="+url.QueryEscape(unlocked.Token), nil), fiber.StatusUnauthorized, nil)
+}
+
+func TestProtectedTargetsHidden(t *testing.T) {
+	s := protectedServer(t)
+	id := s.create(t, LinkCreateRequest{
+		Target:   "https://example.com/secret",
+		Password: "hunter2",
+		GeoRules: map[string]string{"DE": "https://example.de/secret"},
+	}, APIKeyHeader, ownerKey)
+	split := s.create(t, LinkCreateRequest{
+		Target:   "https://example.com/fallback",
+		Password: "hunter2",
+		Variants: []links.Variant{{Target: "https://example.com/a", Weight: 1}, {Target: "https://example.com/b", Weight: 1}},
+	}, APIKeyHeader, ownerKey)
+
+	var unlocked struct {
+		Token string `json:"token"`
+	}
+	decode(t, s.do(t, fiber.MethodPost, "/"+id+"/unlock", LinkUnlockRequest{"hunter2"}), fiber.StatusOK, &unlocked)
+
+	tests := []struct {
+		name    string
+		path    string
+		headers []string
+		shown   bool
+	}{
+		{"without a key", "/api/" + id, nil, false},
+		{"with another key", "/api/" + id, []string{APIKeyHeader, otherKey}, false},
+		{"with a forged token", "/api/" + id + "?token=forged.token", nil, false},
+		{"with the owner key", "/api/" + id, []string{APIKeyHeader, ownerKey}, true},
+		{"with a token", "/api/" + id + "?token=" + url.QueryEscape(unlocked.Token), nil, true},
+		{"variants without a key", "/api/" + split, nil, false},
+		{"variants with the owner key", "/api/" + split, []string{fiber.HeaderAuthorization, "Bearer " + ownerKey}, true},
+	}
+	for _, test := range tests {
+		resp := s.do(t, fiber.MethodGet, test.path, nil, test.headers...)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("%s: got status %d with %s", test.name, resp.StatusCode, body)
+		}
+		// the hash is never returned
+		if strings.Contains(string(body), "$2a$") || strings.Contains(strings.ToLower(string(body)), "hash") {
+			t.Errorf("%s: password hash leaked in %s", test.name, body)
+		}
+		if shown := strings.Contains(string(body), "https://example"); shown != test.shown {
+			t.Errorf("%s: targets shown is %t in %s, want %t", test.name, shown, body, test.shown)
+		}
+		if !strings.Contains(string(body), `"protected":true`) {
+			t.Errorf("%s: link isn't reported as protected in %s", test.name, body)
+		}
+	}
+}
@@ -23,6 +23,17 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type BucketServiceClient interface {
 	GetBucket(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Bucket, error)
+	GetSizedBucket(ctx context.Context, in *SizedBucketRequest, opts ...grpc.CallOption) (*Bucket, error)
+	GetBuckets(ctx context.Context, in *BucketsRequest, opts ...grpc.CallOption) (*BucketsResponse, error)
+	StreamBuckets(ctx context.Context, in *StreamRequest, opts ...grpc.CallOption) (BucketService_StreamBucketsClient, error)
+	// Register an externally chosen ID so it is never generated.
+	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*Empty, error)
+	// Change the number and capacity of buckets of the configured ID size,
+	// requires the admin token as a bearer authorization.
+	Resize(ctx context.Context, in *ResizeRequest, opts ...grpc.CallOption) (*ResizeResponse, error)
+	// Count buckets of the configured ID size in each state and the IDs ready
+	// to be handed out, cheap enough to be polled.
+	BucketStatus(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*StatusResponse, error)
 }
 
 type bucketServiceClient struct {
@@ -42,11 +53,99 @@ func (c *bucketServiceClient) GetBucket(ctx context.Context, in *Empty, opts ...
 	return out, nil
 }
 
+func (c *bucketServiceClient) GetSizedBucket(ctx context.Context, in *SizedBucketRequest, opts ...grpc.CallOption) (*Bucket, error) {
+	out := new(Bucket)
+	err := c.cc.Invoke(ctx, "/protos.BucketService/GetSizedBucket", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bucketServiceClient) GetBuckets(ctx context.Context, in *BucketsRequest, opts ...grpc.CallOption) (*BucketsResponse, error) {
+	out := new(BucketsResponse)
+	err := c.cc.Invoke(ctx, "/protos.BucketService/GetBuckets", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bucketServiceClient) StreamBuckets(ctx context.Context, in *StreamRequest, opts ...grpc.CallOption) (BucketService_StreamBucketsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &BucketService_ServiceDesc.Streams[0], "/protos.BucketService/StreamBuckets", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &bucketServiceStreamBucketsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type BucketService_StreamBucketsClient interface {
+	Recv() (*Bucket, error)
+	grpc.ClientStream
+}
+
+type bucketServiceStreamBucketsClient struct {
+	grpc.ClientStream
+}
+
+func (x *bucketServiceStreamBucketsClient) Recv() (*Bucket, error) {
+	m := new(Bucket)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *bucketServiceClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/protos.BucketService/Register", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bucketServiceClient) Resize(ctx context.Context, in *ResizeRequest, opts ...grpc.CallOption) (*ResizeResponse, error) {
+	out := new(ResizeResponse)
+	err := c.cc.Invoke(ctx, "/protos.BucketService/Resize", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bucketServiceClient) BucketStatus(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*StatusResponse, error) {
+	out := new(StatusResponse)
+	err := c.cc.Invoke(ctx, "/protos.BucketService/BucketStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // BucketServiceServer is the server API for BucketService service.
 // All implementations must embed UnimplementedBucketServiceServer
 // for forward compatibility
 type BucketServiceServer interface {
 	GetBucket(context.Context, *Empty) (*Bucket, error)
+	GetSizedBucket(context.Context, *SizedBucketRequest) (*Bucket, error)
+	GetBuckets(context.Context, *BucketsRequest) (*BucketsResponse, error)
+	StreamBuckets(*StreamRequest, BucketService_StreamBucketsServer) error
+	// Register an externally chosen ID so it is never generated.
+	Register(context.Context, *RegisterRequest) (*Empty, error)
+	// Change the number and capacity of buckets of the configured ID size,
+	// requires the admin token as a bearer authorization.
+	Resize(context.Context, *ResizeRequest) (*ResizeResponse, error)
+	// Count buckets of the configured ID size in each state and the IDs ready
+	// to be handed out, cheap enough to be polled.
+	BucketStatus(context.Context, *Empty) (*StatusResponse, error)
 	mustEmbedUnimplementedBucketServiceServer()
 }
 
@@ -57,6 +156,24 @@ type UnimplementedBucketServiceServer struct {
 func (UnimplementedBucketServiceServer) GetBucket(context.Context, *Empty) (*Bucket, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBucket not implemented")
 }
+func (UnimplementedBucketServiceServer) GetSizedBucket(context.Context, *SizedBucketRequest) (*Bucket, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSizedBucket not implemented")
+}
+func (UnimplementedBucketServiceServer) GetBuckets(context.Context, *BucketsRequest) (*BucketsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBuckets not implemented")
+}
+func (UnimplementedBucketServiceServer) StreamBuckets(*StreamRequest, BucketService_StreamBucketsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamBuckets not implemented")
+}
+func (UnimplementedBucketServiceServer) Register(context.Context, *RegisterRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
+func (UnimplementedBucketServiceServer) Resize(context.Context, *ResizeRequest) (*ResizeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Resize not implemented")
+}
+func (UnimplementedBucketServiceServer) BucketStatus(context.Context, *Empty) (*StatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BucketStatus not implemented")
+}
 func (UnimplementedBucketServiceServer) mustEmbedUnimplementedBucketServiceServer() {}
 
 // UnsafeBucketServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -88,6 +205,117 @@ func _BucketService_GetBucket_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _BucketService_GetSizedBucket_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SizedBucketRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BucketServiceServer).GetSizedBucket(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protos.BucketService/GetSizedBucket",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BucketServiceServer).GetSizedBucket(ctx, req.(*SizedBucketRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BucketService_GetBuckets_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BucketsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BucketServiceServer).GetBuckets(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protos.BucketService/GetBuckets",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BucketServiceServer).GetBuckets(ctx, req.(*BucketsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BucketService_StreamBuckets_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BucketServiceServer).StreamBuckets(m, &bucketServiceStreamBucketsServer{stream})
+}
+
+type BucketService_StreamBucketsServer interface {
+	Send(*Bucket) error
+	grpc.ServerStream
+}
+
+type bucketServiceStreamBucketsServer struct {
+	grpc.ServerStream
+}
+
+func (x *bucketServiceStreamBucketsServer) Send(m *Bucket) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _BucketService_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BucketServiceServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protos.BucketService/Register",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BucketServiceServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BucketService_Resize_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResizeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BucketServiceServer).Resize(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protos.BucketService/Resize",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BucketServiceServer).Resize(ctx, req.(*ResizeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BucketService_BucketStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BucketServiceServer).BucketStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protos.BucketService/BucketStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BucketServiceServer).BucketStatus(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // BucketService_ServiceDesc is the grpc.ServiceDesc for BucketService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -99,7 +327,33 @@ var BucketService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetBucket",
 			Handler:    _BucketService_GetBucket_Handler,
 		},
+		{
+			MethodName: "GetSizedBucket",
+			Handler:    _BucketService_GetSizedBucket_Handler,
+		},
+		{
+			MethodName: "GetBuckets",
+			Handler:    _BucketService_GetBuckets_Handler,
+		},
+		{
+			MethodName: "Register",
+			Handler:    _BucketService_Register_Handler,
+		},
+		{
+			MethodName: "Resize",
+			Handler:    _BucketService_Resize_Handler,
+		},
+		{
+			MethodName: "BucketStatus",
+			Handler:    _BucketService_BucketStatus_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamBuckets",
+			Handler:       _BucketService_StreamBuckets_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "bucket.proto",
 }
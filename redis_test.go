@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In memory Redis speaking enough RESP for the commands of internal/cache.
+type fakeRedis struct {
+	addr    string
+	mutex   sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	expires map[string]time.Time
+	// commands served
+	commands int
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{
+		addr:    lis.Addr().String(),
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		expires: make(map[string]time.Time),
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+
+	return r
+}
+
+// Whether key holds a string or a hash.
+func (r *fakeRedis) Exists(key string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.exists(key)
+}
+
+// Number of commands served.
+func (r *fakeRedis) Commands() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.commands
+}
+
+// Time left before key expires, 0 if it doesn't.
+func (r *fakeRedis) TTL(key string) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if at, ok := r.expires[key]; ok && r.exists(key) {
+		return time.Until(at)
+	}
+
+	return 0
+}
+
+func (r *fakeRedis) exists(key string) bool {
+	if at, ok := r.expires[key]; ok && !time.Now().Before(at) {
+		r.del(key)
+	}
+	_, isString := r.strings[key]
+	_, isHash := r.hashes[key]
+
+	return isString || isHash
+}
+
+func (r *fakeRedis) del(key string) bool {
+	_, isString := r.strings[key]
+	_, isHash := r.hashes[key]
+	delete(r.strings, key)
+	delete(r.hashes, key)
+	delete(r.expires, key)
+
+	return isString || isHash
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		r.mutex.Lock()
+		r.commands++
+		reply := r.do(strings.ToUpper(args[0]), args[1:])
+		r.mutex.Unlock()
+		writeReply(writer, reply)
+		if writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("fake redis: expected an array")
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 1 {
+		return nil, errors.New("fake redis: invalid array")
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+
+	return args, nil
+}
+
+// replies are strings for bulk strings, nil for null, int64 for integers,
+// []any for arrays, status for simple strings and error for errors.
+type status string
+
+func writeReply(w *bufio.Writer, reply any) {
+	switch reply := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case status:
+		fmt.Fprintf(w, "+%s\r\n", reply)
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", reply)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", reply)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(reply), reply)
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(reply))
+		for _, item := range reply {
+			writeReply(w, item)
+		}
+	}
+}
+
+func (r *fakeRedis) do(cmd string, args []string) any {
+	for _, key := range args[:min(1, len(args))] {
+		r.exists(key)
+	}
+
+	switch cmd {
+	case "PING":
+		return status("PONG")
+	case "GET":
+		if value, ok := r.strings[args[0]]; ok {
+			return value
+		}
+		return nil
+	case "GETDEL":
+		value, ok := r.strings[args[0]]
+		r.del(args[0])
+		if ok {
+			return value
+		}
+		return nil
+	case "SET":
+		return r.set(args)
+	case "DEL":
+		var deleted int64
+		for _, key := range args {
+			if r.exists(key) && r.del(key) {
+				deleted++
+			}
+		}
+		return deleted
+	case "INCR", "INCRBY":
+		by := int64(1)
+		if cmd == "INCRBY" {
+			by, _ = strconv.ParseInt(args[1], 10, 64)
+		}
+		value, _ := strconv.ParseInt(r.strings[args[0]], 10, 64)
+		value += by
+		r.strings[args[0]] = strconv.FormatInt(value, 10)
+		return value
+	case "PEXPIRE":
+		if !r.exists(args[0]) {
+			return int64(0)
+		}
+		ms, _ := strconv.ParseInt(args[1], 10, 64)
+		r.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return int64(1)
+	case "HSET":
+		hash, ok := r.hashes[args[0]]
+		if !ok {
+			hash = make(map[string]string)
+			r.hashes[args[0]] = hash
+		}
+		var added int64
+		for i := 1; i+1 < len(args); i += 2 {
+			if _, ok := hash[args[i]]; !ok {
+				added++
+			}
+			hash[args[i]] = args[i+1]
+		}
+		return added
+	case "HGETALL":
+		var reply []any
+		for field, value := range r.hashes[args[0]] {
+			reply = append(reply, field, value)
+		}
+		return reply
+	case "SCAN":
+		return r.scan(args)
+	default:
+		return fmt.Errorf("ERR unknown command '%s'", cmd)
+	}
+}
+
+func (r *fakeRedis) set(args []string) any {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			if r.exists(key) {
+				return nil
+			}
+		case "PX":
+			i++
+			ms, _ := strconv.ParseInt(args[i], 10, 64)
+			ttl = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	r.del(key)
+	r.strings[key] = value
+	if ttl > 0 {
+		r.expires[key] = time.Now().Add(ttl)
+	}
+
+	return status("OK")
+}
+
+// every matching key in a single pass.
+func (r *fakeRedis) scan(args []string) any {
+	pattern := "*"
+	for i := 1; i+1 < len(args); i += 2 {
+		if strings.ToUpper(args[i]) == "MATCH" {
+			pattern = args[i+1]
+		}
+	}
+
+	keys := []any{}
+	var names []string
+	for key := range r.strings {
+		names = append(names, key)
+	}
+	for key := range r.hashes {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	for _, key := range names {
+		if ok, _ := path.Match(pattern, key); ok && r.exists(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return []any{"0", keys}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"wormholes/internal/requestid"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// Give each request an ID, the one in its requestid.Header if it is valid,
+// and return it in the same header. Handlers log with requestLog so each
+// line carries it.
+func requestIDs(c *fiber.Ctx) error {
+	id := c.Get(requestid.Header)
+	if !requestid.Valid(id) {
+		id = requestid.New()
+	}
+	c.Set(requestid.Header, id)
+	c.SetUserContext(requestid.With(c.UserContext(), id))
+
+	return c.Next()
+}
+
+// Logger of a request, adding its ID to each line.
+func requestLog(c *fiber.Ctx) *zerolog.Logger {
+	return zerolog.Ctx(c.UserContext())
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+	"wormholes/ingestor"
+	"wormholes/internal/blacklist"
+	"wormholes/internal/cache"
+	"wormholes/internal/config"
+	"wormholes/internal/geoip"
+	"wormholes/ipc"
+	"wormholes/protos"
+	"wormholes/store"
+
+	"github.com/gofiber/fiber/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Handler served with a memory store, a fake Redis and a generator of its
+// own, none of them shared between tests.
+type testServer struct {
+	app     *fiber.App
+	handler *Handler
+	backend *store.MemStore
+	redis   *fakeRedis
+	conf    *config.Config
+}
+
+// Config of a test server, without snapshots, rate limits or a database.
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	conf := config.DefaultConfig()
+	conf.Store = config.StoreMemory
+	conf.BucketSize = 2
+	conf.BucketCapacity = 1000
+	conf.BloomMaxLimit = 1_000_000
+	conf.BloomSnapshot = ""
+	conf.BucketSnapshot = ""
+	conf.MetricsAddr = ""
+	conf.LowWatermark = 10
+	conf.IngestInterval = 10 * time.Millisecond
+	conf.DeadLetter = filepath.Join(t.TempDir(), "dead.jsonl")
+	conf.RateLimit = 0
+	conf.RateLimitRead = 0
+
+	return conf
+}
+
+// Start a test server with conf from testConfig, changed by configure if it
+// isn't nil.
+func newTestServer(t *testing.T, configure func(*config.Config)) *testServer {
+	t.Helper()
+	conf := testConfig(t)
+	if configure != nil {
+		configure(conf)
+	}
+
+	redis := startFakeRedis(t)
+
+	factory := ipc.NewFactory(conf, nil)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	protos.RegisterBucketServiceServer(grpcServer, factory)
+	go grpcServer.Serve(lis)
+	factory.Prepare().Run(conf)
+	t.Cleanup(func() {
+		grpcServer.Stop()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		factory.Shutdown(ctx)
+	})
+
+	backend := store.WithMemory()
+	pipe := ingestor.New(backend, conf.BatchSize, conf.IngestInterval, conf.DeadLetter).Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		pipe.Shutdown(ctx)
+	})
+
+	reserved, err := blacklist.New(conf.Blacklist, conf.BlacklistPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no database in the test directory, every location is unknown
+	geo, _ := geoip.Open(t.TempDir())
+	ipcStore := ipc.NewStore(lis.Addr().String(), conf.LowWatermark, insecure.NewCredentials())
+	handler := NewHandler(backend, pipe, nil, cache.New(redis.addr), ipcStore, conf, reserved, geo)
+
+	app := fiber.New(fiber.Config{
+		ErrorHandler:      errorHandler,
+		StreamRequestBody: true,
+	})
+	handler.Setup(app)
+
+	return &testServer{app, handler, backend, redis, conf}
+}
+
+// Send a request with body encoded as JSON unless it is a string or nil,
+// and headers as pairs of name and value.
+func (s *testServer) do(t *testing.T, method, path string, body any, headers ...string) *http.Response {
+	t.Helper()
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		reader = bytes.NewBufferString(body)
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	if reader != nil {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := s.app.Test(req, 10_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+// Decode the JSON body of resp into v, failing unless it has status code.
+func decode(t *testing.T, resp *http.Response, code int, v any) {
+	t.Helper()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != code {
+		t.Fatalf("got status %d with %s, want %d", resp.StatusCode, data, code)
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("failed to decode %s: %v", data, err)
+	}
+}
+
+// Create a link from req, returning its ID once it is ingested.
+func (s *testServer) create(t *testing.T, req any, headers ...string) string {
+	t.Helper()
+	var created struct {
+		ID string `json:"id"`
+	}
+	decode(t, s.do(t, fiber.MethodPut, "/api/", req, headers...), fiber.StatusOK, &created)
+	s.waitIngested(t, "", created.ID)
+
+	return created.ID
+}
+
+// Wait until the link id on domain is in the store.
+func (s *testServer) waitIngested(t *testing.T, domain, id string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := s.backend.Get(context.Background(), domain, id); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("link %s wasn't ingested in time", id)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"time"
+	"wormholes/internal/links"
+	"wormholes/internal/token"
+	"wormholes/ipc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Split a signed path, {id}-{sig}, into the ID and its signature. IDs may
+// contain '-' themselves, signatures have a fixed length.
+func splitSigned(path string) (id, sig string, ok bool) {
+	i := len(path) - token.IDSignatureLength - 1
+	if i <= 0 || path[i] != '-' {
+		return "", "", false
+	}
+
+	return path[:i], path[i+1:], true
+}
+
+// Whether sig is the signature of the link with key, by SIGN_SECRET or by
+// SIGN_SECRET_PREVIOUS until SIGN_PREVIOUS_UNTIL, while links signed before
+// a rotation are replaced.
+func (h *Handler) validSignature(key, sig string) bool {
+	if token.VerifyID(h.config.SignSecret, key, sig) {
+		return true
+	}
+	if h.config.SignPrevious == "" {
+		return false
+	}
+	until := h.config.SignPreviousUntil
+
+	return (until.IsZero() || time.Now().Before(until)) && token.VerifyID(h.config.SignPrevious, key, sig)
+}
+
+// ID of link in its short URL, followed by the signature of the ID when it
+// is signed.
+func (h *Handler) publicID(link links.Link) string {
+	if h.config.SignSecret == "" || !(link.Signed || h.config.SignedLinks) {
+		return link.ID
+	}
+
+	return link.ID + "-" + token.SignID(h.config.SignSecret, link.Key())
+}
+
+// ID in the path of a public request on domain and whether it was signed.
+// With SIGNED_LINKS, paths without a valid signature are rejected before
+// any lookup. Otherwise they may still be the ID of an unsigned link.
+func (h *Handler) unsign(ctx *fiber.Ctx, domain string) (string, bool, error) {
+	path := ctx.Params("id")
+	if h.config.SignSecret == "" {
+		return h.foldID(path), false, nil
+	}
+
+	// signatures are case sensitive, only the ID is folded
+	if id, sig, ok := splitSigned(path); ok {
+		id = h.foldID(id)
+		if h.validSignature(links.Key(domain, id), sig) {
+			return id, true, nil
+		}
+	}
+	if h.config.SignedLinks {
+		return "", false, errNotFound
+	}
+
+	return h.foldID(path), false, nil
+}
+
+// Resolve the link in the path of a public request on domain, like resolve.
+// Signed links are not found without their signature, so their IDs can't be
+// guessed.
+func (h *Handler) resolvePath(ctx *fiber.Ctx, domain, op string) (links.Link, error) {
+	shortID, signed, err := h.unsign(ctx, domain)
+	if err != nil {
+		return links.Link{}, err
+	}
+	// shed IDs that can never exist before touching cache
+	if len(shortID) < ipc.MinIDSize || len(shortID) > ipc.MaxIDSize {
+		rejectedIDs.Inc()
+
+		return links.Link{}, errNotFound
+	}
+
+	link, err := h.resolve(ctx.UserContext(), domain, shortID, op)
+	if link.Signed && !signed {
+		return links.Link{}, errNotFound
+	}
+
+	return link, err
+}
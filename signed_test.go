@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"wormholes/internal/config"
+	"wormholes/internal/links"
+	"wormholes/internal/token"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSplitSigned(t *testing.T) {
+	sig := token.SignID("secret", "abc-def")
+	tests := []struct {
+		path string
+		id   string
+		ok   bool
+	}{
+		{"abc-" + sig, "abc", true},
+		{"abc-def-" + sig, "abc-def", true},
+		{"abc" + sig, "", false},
+		{"-" + sig, "", false},
+		{sig, "", false},
+		{"abc-" + sig[1:], "", false},
+		{"abc", "", false},
+	}
+	for _, test := range tests {
+		id, _, ok := splitSigned(test.path)
+		if id != test.id || ok != test.ok {
+			t.Errorf("%s: got %q, %t, want %q, %t", test.path, id, ok, test.id, test.ok)
+		}
+	}
+}
+
+// Status of redirecting path.
+func (s *testServer) redirect(t *testing.T, path string) int {
+	t.Helper()
+	resp := s.do(t, fiber.MethodGet, path, nil)
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestSignedLinks(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.SignSecret = "sign-secret"
+	})
+	id := s.create(t, LinkCreateRequest{Target: "https://example.com", Signed: true})
+	sig := token.SignID("sign-secret", links.Key("", id))
+
+	if status := s.redirect(t, "/"+id+"-"+sig); status != fiber.StatusMovedPermanently {
+		t.Errorf("got status %d with a valid signature, want a redirect", status)
+	}
+	forged := []string{
+		"/" + id,
+		"/" + id + "-" + token.SignID("other-secret", links.Key("", id)),
+		"/" + id + "-" + token.SignID("sign-secret", links.Key("", "other")),
+		"/" + id + "-" + sig[:len(sig)-1] + "A",
+		"/" + id + "-" + sig[:len(sig)-1],
+	}
+	if sig[len(sig)-1] == 'A' {
+		forged[3] = "/" + id + "-" + sig[:len(sig)-1] + "B"
+	}
+	for _, path := range forged {
+		if status := s.redirect(t, path); status != fiber.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, status, fiber.StatusNotFound)
+		}
+	}
+
+	// unsigned links resolve by ID unless all links are signed
+	unsigned := s.create(t, LinkCreateRequest{Target: "https://example.com/unsigned"})
+	if status := s.redirect(t, "/"+unsigned); status != fiber.StatusMovedPermanently {
+		t.Errorf("got status %d for an unsigned link, want a redirect", status)
+	}
+	s.handler.config.SignedLinks = true
+	if status := s.redirect(t, "/"+unsigned); status != fiber.StatusNotFound {
+		t.Errorf("got status %d for an unsigned path with SIGNED_LINKS, want %d", status, fiber.StatusNotFound)
+	}
+}
+
+func TestSignSecretRotation(t *testing.T) {
+	s := newTestServer(t, func(conf *config.Config) {
+		conf.SignSecret = "old-secret"
+	})
+	id := s.create(t, LinkCreateRequest{Target: "https://example.com", Signed: true})
+	oldPath := "/" + id + "-" + token.SignID("old-secret", links.Key("", id))
+	newPath := "/" + id + "-" + token.SignID("new-secret", links.Key("", id))
+
+	// rotated without a previous secret, old signatures are invalid at once
+	s.handler.config.SignSecret = "new-secret"
+	if status := s.redirect(t, oldPath); status != fiber.StatusNotFound {
+		t.Errorf("got status %d with the replaced secret, want %d", status, fiber.StatusNotFound)
+	}
+
+	// the previous secret is accepted until SIGN_PREVIOUS_UNTIL
+	s.handler.config.SignPrevious = "old-secret"
+	s.handler.config.SignPreviousUntil = time.Now().Add(time.Hour)
+	for _, path := range []string{oldPath, newPath} {
+		if status := s.redirect(t, path); status != fiber.StatusMovedPermanently {
+			t.Errorf("%s: got status %d during the rotation, want a redirect", path, status)
+		}
+	}
+
+	s.handler.config.SignPreviousUntil = time.Now().Add(-time.Second)
+	if status := s.redirect(t, oldPath); status != fiber.StatusNotFound {
+		t.Errorf("got status %d with the previous secret after the rotation, want %d", status, fiber.StatusNotFound)
+	}
+	if status := s.redirect(t, newPath); status != fiber.StatusMovedPermanently {
+		t.Errorf("got status %d with the new secret after the rotation, want a redirect", status)
+	}
+}
@@ -0,0 +1,374 @@
+package store
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+	"wormholes/internal/links"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// A stored link with what PostgreSQL keeps in columns of its own.
+type memLink struct {
+	link      links.Link
+	createdAt time.Time
+	deletedAt *time.Time
+}
+
+// In-memory implementation of link store, for development and single process
+// deployments. Links are kept in a map guarded by a mutex and are lost on
+// exit. Click counts are kept but single clicks aren't, so analytics count
+// none of them.
+type MemStore struct {
+	mutex sync.RWMutex
+	// by link key
+	links map[string]*memLink
+}
+
+func WithMemory() *MemStore {
+	return &MemStore{links: make(map[string]*memLink)}
+}
+
+// Copy of link sharing none of its tags, rules or variants.
+func clone(link links.Link) links.Link {
+	link.Tags = slices.Clone(link.Tags)
+	link.GeoRules = maps.Clone(link.GeoRules)
+	link.Variants = slices.Clone(link.Variants)
+	if link.ExpiresAt != nil {
+		expiresAt := *link.ExpiresAt
+		link.ExpiresAt = &expiresAt
+	}
+	link.Protected = link.PasswordHash != ""
+
+	return link
+}
+
+// live link of domain with id, visible to owner.
+func (m *MemStore) live(domain, id, owner string) (*memLink, bool) {
+	stored, ok := m.links[links.Key(domain, id)]
+	if !ok || stored.deletedAt != nil || (owner != "" && stored.link.Owner != owner) {
+		return nil, false
+	}
+
+	return stored, true
+}
+
+// Links of domain visible to owner that keep is true for, ordered by id.
+func (m *MemStore) sorted(domain, owner string, keep func(*memLink) bool) []*memLink {
+	var result []*memLink
+	for _, stored := range m.links {
+		if stored.link.Domain == domain && (owner == "" || stored.link.Owner == owner) && keep(stored) {
+			result = append(result, stored)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].link.ID < result[j].link.ID
+	})
+
+	return result
+}
+
+func hasTag(link links.Link, tag string) bool {
+	return tag == "" || link.Tag == tag || slices.Contains(link.Tags, tag)
+}
+
+// Insert links, all of them or none, returning those that weren't inserted
+// as their ID is taken, even by a deleted link.
+func (m *MemStore) Create(ctx context.Context, batch []*links.Link) (map[*links.Link]bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var conflicts map[*links.Link]bool
+	now := time.Now()
+	for _, link := range batch {
+		key := link.Key()
+		if _, ok := m.links[key]; ok {
+			if conflicts == nil {
+				conflicts = make(map[*links.Link]bool)
+			}
+			conflicts[link] = true
+
+			continue
+		}
+		m.links[key] = &memLink{link: clone(*link), createdAt: now}
+	}
+
+	return conflicts, nil
+}
+
+func (m *MemStore) Get(ctx context.Context, domain, id string) (links.Link, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	stored, ok := m.live(domain, id, "")
+	if !ok {
+		return links.Link{}, pgx.ErrNoRows
+	}
+
+	return clone(stored.link), nil
+}
+
+// Update the fields set in patch, pgx.ErrNoRows if there is no such link.
+func (m *MemStore) Update(ctx context.Context, domain, id, owner string, patch links.Patch) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored, ok := m.live(domain, id, owner)
+	if !ok {
+		return pgx.ErrNoRows
+	}
+	if patch.Target != nil {
+		stored.link.Target = *patch.Target
+	}
+	if patch.Tag != nil {
+		stored.link.Tag = *patch.Tag
+	}
+	if patch.Tags != nil {
+		stored.link.Tags = slices.Clone(*patch.Tags)
+	}
+	if patch.RedirectCode != nil {
+		stored.link.RedirectCode = *patch.RedirectCode
+	}
+
+	return nil
+}
+
+// Delete a link, pgx.ErrNoRows if there is none.
+func (m *MemStore) Delete(ctx context.Context, domain, id, owner string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := links.Key(domain, id)
+	stored, ok := m.links[key]
+	if !ok || (owner != "" && stored.link.Owner != owner) {
+		return pgx.ErrNoRows
+	}
+	delete(m.links, key)
+
+	return nil
+}
+
+// Mark link as deleted, keeping it to be restored. pgx.ErrNoRows if there is
+// no such link.
+func (m *MemStore) SoftDelete(ctx context.Context, domain, id, owner string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored, ok := m.live(domain, id, owner)
+	if !ok {
+		return pgx.ErrNoRows
+	}
+	now := time.Now()
+	stored.deletedAt = &now
+
+	return nil
+}
+
+// Delete links of domain with ids, returning the ids of those that were
+// deleted.
+func (m *MemStore) DeleteBatch(ctx context.Context, domain string, ids []string, owner string) ([]string, error) {
+	return m.deleteBatch(ctx, m.Delete, domain, ids, owner)
+}
+
+// Mark links of domain with ids as deleted, returning the ids of those that
+// were.
+func (m *MemStore) SoftDeleteBatch(ctx context.Context, domain string, ids []string, owner string) ([]string, error) {
+	return m.deleteBatch(ctx, m.SoftDelete, domain, ids, owner)
+}
+
+func (m *MemStore) deleteBatch(ctx context.Context, remove func(context.Context, string, string, string) error, domain string, ids []string, owner string) ([]string, error) {
+	var deleted []string
+	for _, id := range ids {
+		if remove(ctx, domain, id, owner) == nil {
+			deleted = append(deleted, id)
+		}
+	}
+
+	return deleted, nil
+}
+
+// Restore a soft deleted link, pgx.ErrNoRows if there is none.
+func (m *MemStore) Restore(ctx context.Context, domain, id, owner string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored, ok := m.links[links.Key(domain, id)]
+	if !ok || stored.deletedAt == nil || (owner != "" && stored.link.Owner != owner) {
+		return pgx.ErrNoRows
+	}
+	stored.deletedAt = nil
+
+	return nil
+}
+
+// Change the id of a link to newID, leaving a link from id to redirect unless
+// it is empty. pgx.ErrNoRows if there is no such link, and ErrIDTaken if
+// newID belongs to another link, even a deleted one.
+func (m *MemStore) Rename(ctx context.Context, domain, id, newID, owner, redirect string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored, ok := m.live(domain, id, owner)
+	if !ok {
+		return pgx.ErrNoRows
+	}
+	newKey := links.Key(domain, newID)
+	if _, ok := m.links[newKey]; ok {
+		return ErrIDTaken
+	}
+
+	delete(m.links, stored.link.Key())
+	stored.link.ID = newID
+	m.links[newKey] = stored
+
+	if redirect != "" {
+		left := links.Link{
+			Domain: domain,
+			ID:     id,
+			Target: redirect,
+			Tag:    stored.link.Tag,
+			Tags:   slices.Clone(stored.link.Tags),
+			Owner:  stored.link.Owner,
+			Signed: stored.link.Signed,
+		}
+		m.links[left.Key()] = &memLink{link: left, createdAt: time.Now()}
+	}
+
+	return nil
+}
+
+// Store the title and image of the target page of a link.
+func (m *MemStore) SetPreview(ctx context.Context, domain, id, title, image string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if stored, ok := m.links[links.Key(domain, id)]; ok {
+		stored.link.Title = title
+		stored.link.Image = image
+	}
+
+	return nil
+}
+
+// Add clicks, counted by link key, to their links.
+func (m *MemStore) AddClicks(ctx context.Context, clicks map[string]int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key, count := range clicks {
+		if stored, ok := m.links[key]; ok {
+			stored.link.Clicks += count
+		}
+	}
+
+	return nil
+}
+
+func (m *MemStore) Stats(ctx context.Context, domain, id, owner string) (links.Stats, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	stored, ok := m.live(domain, id, owner)
+	if !ok {
+		return links.Stats{}, pgx.ErrNoRows
+	}
+
+	return links.Stats{ID: stored.link.ID, Clicks: stored.link.Clicks, CreatedAt: stored.createdAt}, nil
+}
+
+// List up to limit links of domain after cursor ordered by id, optionally
+// with tag. Like PostgreSQL lists, password hashes are left out.
+func (m *MemStore) List(ctx context.Context, domain, owner, cursor string, limit int, tag string) ([]links.Link, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	listed := m.sorted(domain, owner, func(stored *memLink) bool {
+		return stored.deletedAt == nil && stored.link.ID > cursor && hasTag(stored.link, tag)
+	})
+
+	result := make([]links.Link, 0, min(limit, len(listed)))
+	for _, stored := range listed[:min(limit, len(listed))] {
+		link := clone(stored.link)
+		link.PasswordHash = ""
+		result = append(result, link)
+	}
+
+	return result, nil
+}
+
+// Top returns up to limit links with the most clicks that haven't expired,
+// of all domains.
+func (m *MemStore) Top(ctx context.Context, limit int) ([]links.Link, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	now := time.Now()
+	var result []links.Link
+	for _, stored := range m.links {
+		if stored.deletedAt == nil && !stored.link.Expired(now, stored.link.Clicks) {
+			result = append(result, clone(stored.link))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Clicks > result[j].Clicks
+	})
+
+	return result[:min(limit, len(result))], nil
+}
+
+// Single clicks aren't recorded in memory, every count is zero. Days are still
+// listed like PostgreSQL does.
+func (m *MemStore) Analytics(ctx context.Context, domain, id string, from, to time.Time, by string, bots bool) ([]links.Count, error) {
+	if _, ok := dimensions[by]; !ok {
+		return nil, ErrDimension
+	}
+	if by == ByDay {
+		return fillDays(nil, from, to), nil
+	}
+
+	return []links.Count{}, nil
+}
+
+// Export calls each with links of domain created in [from, to), optionally
+// with tag, ordered by id, stopping at the first error. Links are copied
+// first, so each runs without holding the lock.
+func (m *MemStore) Export(ctx context.Context, domain, owner, tag string, from, to time.Time, each func(links.Link, time.Time) error) error {
+	m.mutex.RLock()
+	exported := m.sorted(domain, owner, func(stored *memLink) bool {
+		return stored.deletedAt == nil && hasTag(stored.link, tag) &&
+			!stored.createdAt.Before(from) && stored.createdAt.Before(to)
+	})
+	rows := make([]memLink, len(exported))
+	for i, stored := range exported {
+		rows[i] = memLink{
+			link: links.Link{
+				Domain: domain,
+				ID:     stored.link.ID,
+				Target: stored.link.Target,
+				Tag:    stored.link.Tag,
+				Clicks: stored.link.Clicks,
+			},
+			createdAt: stored.createdAt,
+		}
+	}
+	m.mutex.RUnlock()
+
+	for _, row := range rows {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := each(row.link, row.createdAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *MemStore) Ping(ctx context.Context) error {
+	return nil
+}
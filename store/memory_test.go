@@ -0,0 +1,396 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+	"wormholes/internal/links"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Memory store with links, created in order.
+func withLinks(t *testing.T, batch ...*links.Link) *MemStore {
+	t.Helper()
+	m := WithMemory()
+	if conflicts, err := m.Create(context.Background(), batch); err != nil || len(conflicts) > 0 {
+		t.Fatalf("got %v, %v creating links", conflicts, err)
+	}
+
+	return m
+}
+
+func owned(id, owner string) *links.Link {
+	link := links.New("", id, "https://example.com/"+id, "")
+	link.Owner = owner
+
+	return link
+}
+
+// IDs of listed.
+func ids(listed []links.Link) []string {
+	result := make([]string, len(listed))
+	for i, link := range listed {
+		result[i] = link.ID
+	}
+
+	return result
+}
+
+func TestMemCreateConflicts(t *testing.T) {
+	ctx := context.Background()
+	m := withLinks(t, links.New("", "taken", "https://example.com", ""), links.New("", "deleted", "https://example.com", ""))
+	if err := m.SoftDelete(ctx, "", "deleted", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// IDs of deleted links stay taken, other domains have IDs of their own
+	taken, deleted := links.New("", "taken", "https://example.com/new", ""), links.New("", "deleted", "https://example.com/new", "")
+	fresh, elsewhere := links.New("", "fresh", "https://example.com", ""), links.New("example.org", "taken", "https://example.org", "")
+	conflicts, err := m.Create(ctx, []*links.Link{taken, fresh, deleted, elsewhere})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 2 || !conflicts[taken] || !conflicts[deleted] {
+		t.Errorf("got conflicts %v, want the taken and deleted IDs", conflicts)
+	}
+	if link, err := m.Get(ctx, "", "taken"); err != nil || link.Target != "https://example.com" {
+		t.Errorf("got %s, %v, want the link created first kept", link.Target, err)
+	}
+	for _, link := range []*links.Link{fresh, elsewhere} {
+		if _, err := m.Get(ctx, link.Domain, link.ID); err != nil {
+			t.Errorf("link %s wasn't created, %v", link.Key(), err)
+		}
+	}
+}
+
+func TestMemGetCopies(t *testing.T) {
+	ctx := context.Background()
+	link := links.New("", "copied", "https://example.com", "")
+	link.Tags = []string{"a", "b"}
+	link.PasswordHash = "$2a$10$hash"
+	m := withLinks(t, link)
+
+	// neither the created link nor the one returned is shared
+	link.Tags[0] = "changed"
+	got, err := m.Get(ctx, "", "copied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Tags[1] = "changed"
+	if got, _ := m.Get(ctx, "", "copied"); !slices.Equal(got.Tags, []string{"a", "b"}) || !got.Protected {
+		t.Errorf("got tags %v protected %t, want the stored ones", got.Tags, got.Protected)
+	}
+
+	if _, err := m.Get(ctx, "", "missing"); err != pgx.ErrNoRows {
+		t.Errorf("got %v for a missing link, want %v", err, pgx.ErrNoRows)
+	}
+}
+
+func TestMemUpdate(t *testing.T) {
+	ctx := context.Background()
+	m := withLinks(t, owned("link", "owner"))
+
+	target, tags := "https://example.com/new", []string{"new"}
+	if err := m.Update(ctx, "", "link", "other", links.Patch{Target: &target}); err != pgx.ErrNoRows {
+		t.Errorf("got %v updating a link of another owner, want %v", err, pgx.ErrNoRows)
+	}
+	if err := m.Update(ctx, "", "link", "owner", links.Patch{Target: &target}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update(ctx, "", "link", "", links.Patch{Tags: &tags}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update(ctx, "", "missing", "", links.Patch{Target: &target}); err != pgx.ErrNoRows {
+		t.Errorf("got %v updating a missing link, want %v", err, pgx.ErrNoRows)
+	}
+
+	link, _ := m.Get(ctx, "", "link")
+	if link.Target != target || !slices.Equal(link.Tags, tags) {
+		t.Errorf("got %s tagged %v, want both patches applied", link.Target, link.Tags)
+	}
+}
+
+func TestMemDeleteRestore(t *testing.T) {
+	ctx := context.Background()
+	m := withLinks(t, owned("hard", "owner"), owned("soft", "owner"))
+
+	for _, remove := range []func(context.Context, string, string, string) error{m.Delete, m.SoftDelete} {
+		if err := remove(ctx, "", "soft", "other"); err != pgx.ErrNoRows {
+			t.Errorf("got %v deleting a link of another owner, want %v", err, pgx.ErrNoRows)
+		}
+	}
+	if err := m.Delete(ctx, "", "hard", "owner"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SoftDelete(ctx, "", "soft", "owner"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SoftDelete(ctx, "", "soft", ""); err != pgx.ErrNoRows {
+		t.Errorf("got %v deleting a deleted link, want %v", err, pgx.ErrNoRows)
+	}
+	for _, id := range []string{"hard", "soft"} {
+		if _, err := m.Get(ctx, "", id); err != pgx.ErrNoRows {
+			t.Errorf("got %v for deleted link %s, want %v", err, id, pgx.ErrNoRows)
+		}
+	}
+
+	// only soft deleted links are restored, by their owner
+	if err := m.Restore(ctx, "", "hard", ""); err != pgx.ErrNoRows {
+		t.Errorf("got %v restoring a deleted link, want %v", err, pgx.ErrNoRows)
+	}
+	if err := m.Restore(ctx, "", "soft", "other"); err != pgx.ErrNoRows {
+		t.Errorf("got %v restoring a link of another owner, want %v", err, pgx.ErrNoRows)
+	}
+	if err := m.Restore(ctx, "", "soft", "owner"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(ctx, "", "soft"); err != nil {
+		t.Errorf("restored link wasn't found, %v", err)
+	}
+	if err := m.Restore(ctx, "", "soft", ""); err != pgx.ErrNoRows {
+		t.Errorf("got %v restoring a live link, want %v", err, pgx.ErrNoRows)
+	}
+}
+
+func TestMemDeleteBatch(t *testing.T) {
+	ctx := context.Background()
+	m := withLinks(t, owned("a", "owner"), owned("b", "owner"), owned("c", "other"), owned("d", "owner"))
+
+	deleted, err := m.DeleteBatch(ctx, "", []string{"a", "c", "missing", "a"}, "owner")
+	if err != nil || !slices.Equal(deleted, []string{"a"}) {
+		t.Errorf("got %v, %v, want only a deleted", deleted, err)
+	}
+	deleted, err = m.SoftDeleteBatch(ctx, "", []string{"b", "c", "d"}, "")
+	if err != nil || !slices.Equal(deleted, []string{"b", "c", "d"}) {
+		t.Errorf("got %v, %v, want all of them soft deleted", deleted, err)
+	}
+	if err := m.Restore(ctx, "", "b", ""); err != nil {
+		t.Errorf("soft deleted link can't be restored, %v", err)
+	}
+}
+
+func TestMemRename(t *testing.T) {
+	ctx := context.Background()
+	link := owned("old", "owner")
+	link.Tag, link.Signed = "tag", true
+	m := withLinks(t, link, owned("taken", "owner"), owned("gone", "owner"))
+	if err := m.SoftDelete(ctx, "", "gone", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, newID := range []string{"taken", "gone"} {
+		if err := m.Rename(ctx, "", "old", newID, "", ""); err != ErrIDTaken {
+			t.Errorf("got %v renaming to %s, want %v", err, newID, ErrIDTaken)
+		}
+	}
+	if err := m.Rename(ctx, "", "old", "new", "other", ""); err != pgx.ErrNoRows {
+		t.Errorf("got %v renaming a link of another owner, want %v", err, pgx.ErrNoRows)
+	}
+	if err := m.Rename(ctx, "", "old", "new", "owner", "https://short.example/new"); err != nil {
+		t.Fatal(err)
+	}
+
+	if renamed, err := m.Get(ctx, "", "new"); err != nil || renamed.Target != "https://example.com/old" {
+		t.Errorf("got %s, %v, want the link under its new ID", renamed.Target, err)
+	}
+	// the old ID is left redirecting to the new one, like the renamed link
+	left, err := m.Get(ctx, "", "old")
+	if err != nil || left.Target != "https://short.example/new" || left.Owner != "owner" || left.Tag != "tag" || !left.Signed {
+		t.Errorf("got %+v, %v, want a redirect to the new ID", left, err)
+	}
+
+	if err := m.Rename(ctx, "", "new", "newer", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(ctx, "", "new"); err != pgx.ErrNoRows {
+		t.Errorf("got %v for an ID renamed without a redirect, want %v", err, pgx.ErrNoRows)
+	}
+}
+
+func TestMemClicks(t *testing.T) {
+	ctx := context.Background()
+	expiring := owned("c", "owner")
+	expiring.MaxClicks = 1
+	m := withLinks(t, owned("a", "owner"), owned("b", "owner"), expiring)
+
+	clicks := map[string]int64{links.Key("", "a"): 3, links.Key("", "b"): 5, links.Key("", "c"): 50, links.Key("", "missing"): 1}
+	for n := 0; n < 2; n++ {
+		if err := m.AddClicks(ctx, clicks); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := m.Stats(ctx, "", "a", "owner")
+	if err != nil || stats.Clicks != 6 || stats.CreatedAt.IsZero() {
+		t.Errorf("got %+v, %v, want 6 clicks", stats, err)
+	}
+	if _, err := m.Stats(ctx, "", "a", "other"); err != pgx.ErrNoRows {
+		t.Errorf("got %v for stats of a link of another owner, want %v", err, pgx.ErrNoRows)
+	}
+
+	// expired and deleted links aren't top links
+	top, err := m.Top(ctx, 10)
+	if err != nil || !slices.Equal(ids(top), []string{"b", "a"}) {
+		t.Errorf("got top %v, %v, want b and a", ids(top), err)
+	}
+	if err := m.SoftDelete(ctx, "", "b", ""); err != nil {
+		t.Fatal(err)
+	}
+	if top, _ := m.Top(ctx, 1); !slices.Equal(ids(top), []string{"a"}) {
+		t.Errorf("got top %v, want a", ids(top))
+	}
+}
+
+func TestMemList(t *testing.T) {
+	ctx := context.Background()
+	protected := owned("e", "owner")
+	protected.PasswordHash = "$2a$10$hash"
+	tagged := owned("b", "owner")
+	tagged.Tags = []string{"tagged"}
+	m := withLinks(t, owned("c", "owner"), owned("a", "owner"), tagged, owned("d", "other"), protected, owned("f", "owner"),
+		links.New("example.org", "a", "https://example.org", ""))
+	if err := m.SoftDelete(ctx, "", "f", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		owner  string
+		cursor string
+		limit  int
+		tag    string
+		want   []string
+	}{
+		{"all", "", "", 10, "", []string{"a", "b", "c", "d", "e"}},
+		{"of owner", "owner", "", 10, "", []string{"a", "b", "c", "e"}},
+		{"first page", "owner", "", 2, "", []string{"a", "b"}},
+		{"next page", "owner", "b", 2, "", []string{"c", "e"}},
+		{"last page", "owner", "e", 2, "", []string{}},
+		{"tagged", "", "", 10, "tagged", []string{"b"}},
+	}
+	for _, test := range tests {
+		listed, err := m.List(ctx, "", test.owner, test.cursor, test.limit, test.tag)
+		if err != nil || !slices.Equal(ids(listed), test.want) {
+			t.Errorf("%s: got %v, %v, want %v", test.name, ids(listed), err, test.want)
+		}
+		for _, link := range listed {
+			if link.PasswordHash != "" {
+				t.Errorf("%s: link %s was listed with its password hash", test.name, link.ID)
+			}
+		}
+	}
+	if listed, _ := m.List(ctx, "example.org", "", "", 10, ""); !slices.Equal(ids(listed), []string{"a"}) {
+		t.Errorf("got %v for another domain, want only its link", ids(listed))
+	}
+}
+
+func TestMemExport(t *testing.T) {
+	ctx := context.Background()
+	m := withLinks(t, owned("b", "owner"), owned("a", "owner"), owned("c", "other"))
+	now := time.Now()
+
+	var exported []string
+	each := func(link links.Link, createdAt time.Time) error {
+		exported = append(exported, link.ID)
+		return nil
+	}
+	if err := m.Export(ctx, "", "owner", "", now.Add(-time.Minute), now.Add(time.Minute), each); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(exported, []string{"a", "b"}) {
+		t.Errorf("exported %v, want the links of the owner by ID", exported)
+	}
+
+	exported = nil
+	if err := m.Export(ctx, "", "", "", now.Add(time.Minute), now.Add(time.Hour), each); err != nil || len(exported) > 0 {
+		t.Errorf("exported %v, %v, want none created in the range", exported, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := m.Export(cancelled, "", "", "", now.Add(-time.Minute), now.Add(time.Minute), each); err != context.Canceled {
+		t.Errorf("got %v exporting with a cancelled context, want %v", err, context.Canceled)
+	}
+}
+
+func TestMemAnalytics(t *testing.T) {
+	ctx := context.Background()
+	m := WithMemory()
+	to := time.Now()
+
+	days, err := m.Analytics(ctx, "", "link", to.Add(-72*time.Hour), to, ByDay, false)
+	if err != nil || len(days) < 3 {
+		t.Errorf("got %v, %v, want every day listed", days, err)
+	}
+	for _, day := range days {
+		if day.Clicks != 0 {
+			t.Errorf("got %d clicks on %s, want none recorded", day.Clicks, day.Key)
+		}
+	}
+	if _, err := m.Analytics(ctx, "", "link", to.Add(-time.Hour), to, "unknown", false); err != ErrDimension {
+		t.Errorf("got %v for an unknown dimension, want %v", err, ErrDimension)
+	}
+}
+
+func TestMemConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	// updated and read by every goroutine
+	m := withLinks(t, links.New("", "shared", "https://example.com", ""))
+
+	const (
+		workers = 16
+		rounds  = 50
+	)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				id := fmt.Sprintf("link-%d-%d", worker, round)
+				link := links.New("", id, "https://example.com/"+id, "")
+				if conflicts, err := m.Create(ctx, []*links.Link{link}); err != nil || len(conflicts) > 0 {
+					t.Errorf("got %v, %v creating %s", conflicts, err, id)
+
+					return
+				}
+
+				target := "https://example.com/" + id + "/new"
+				tags := []string{id}
+				if err := m.Update(ctx, "", id, "", links.Patch{Target: &target}); err != nil {
+					t.Errorf("updating %s: %v", id, err)
+				}
+				if err := m.Update(ctx, "", "shared", "", links.Patch{Tags: &tags}); err != nil {
+					t.Errorf("updating the shared link: %v", err)
+				}
+				if got, err := m.Get(ctx, "", id); err != nil || got.Target != target {
+					t.Errorf("got %s, %v for %s, want its update", got.Target, err, id)
+				}
+				if got, err := m.Get(ctx, "", "shared"); err != nil || len(got.Tags) != 1 {
+					t.Errorf("got tags %v, %v for the shared link, want one of the updates", got.Tags, err)
+				}
+
+				// every other link is deleted again
+				if round%2 == 1 {
+					if err := m.Delete(ctx, "", id, ""); err != nil {
+						t.Errorf("deleting %s: %v", id, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for worker := 0; worker < workers; worker++ {
+		for round := 0; round < rounds; round++ {
+			id := fmt.Sprintf("link-%d-%d", worker, round)
+			_, err := m.Get(ctx, "", id)
+			if deleted := round%2 == 1; deleted != (err == pgx.ErrNoRows) {
+				t.Errorf("got %v for %s, want it deleted %t", err, id, deleted)
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"context"
+	"time"
+	"wormholes/internal/links"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "wormholes_db_query_duration_seconds",
+	Help:    "Time taken by link store queries.",
+	Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+}, []string{"op"})
+
+// Store that records the duration of each query.
+type metricStore struct {
+	store Store
+}
+
+func WithMetrics(s Store) Store {
+	return &metricStore{store: s}
+}
+
+func observe(op string, start time.Time) {
+	queryDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func (m *metricStore) Create(ctx context.Context, batch []*links.Link) (map[*links.Link]bool, error) {
+	defer observe("create", time.Now())
+	return m.store.Create(ctx, batch)
+}
+
+func (m *metricStore) Get(ctx context.Context, domain, id string) (links.Link, error) {
+	defer observe("get", time.Now())
+	return m.store.Get(ctx, domain, id)
+}
+
+func (m *metricStore) Update(ctx context.Context, domain, id, owner string, patch links.Patch) error {
+	defer observe("update", time.Now())
+	return m.store.Update(ctx, domain, id, owner, patch)
+}
+
+func (m *metricStore) Delete(ctx context.Context, domain, id, owner string) error {
+	defer observe("delete", time.Now())
+	return m.store.Delete(ctx, domain, id, owner)
+}
+
+func (m *metricStore) SoftDelete(ctx context.Context, domain, id, owner string) error {
+	defer observe("soft_delete", time.Now())
+	return m.store.SoftDelete(ctx, domain, id, owner)
+}
+
+func (m *metricStore) DeleteBatch(ctx context.Context, domain string, ids []string, owner string) ([]string, error) {
+	defer observe("delete_batch", time.Now())
+	return m.store.DeleteBatch(ctx, domain, ids, owner)
+}
+
+func (m *metricStore) SoftDeleteBatch(ctx context.Context, domain string, ids []string, owner string) ([]string, error) {
+	defer observe("soft_delete_batch", time.Now())
+	return m.store.SoftDeleteBatch(ctx, domain, ids, owner)
+}
+
+func (m *metricStore) Restore(ctx context.Context, domain, id, owner string) error {
+	defer observe("restore", time.Now())
+	return m.store.Restore(ctx, domain, id, owner)
+}
+
+func (m *metricStore) Rename(ctx context.Context, domain, id, newID, owner, redirect string) error {
+	defer observe("rename", time.Now())
+	return m.store.Rename(ctx, domain, id, newID, owner, redirect)
+}
+
+func (m *metricStore) SetPreview(ctx context.Context, domain, id, title, image string) error {
+	defer observe("set_preview", time.Now())
+	return m.store.SetPreview(ctx, domain, id, title, image)
+}
+
+func (m *metricStore) AddClicks(ctx context.Context, clicks map[string]int64) error {
+	defer observe("add_clicks", time.Now())
+	return m.store.AddClicks(ctx, clicks)
+}
+
+func (m *metricStore) Stats(ctx context.Context, domain, id, owner string) (links.Stats, error) {
+	defer observe("stats", time.Now())
+	return m.store.Stats(ctx, domain, id, owner)
+}
+
+func (m *metricStore) List(ctx context.Context, domain, owner, cursor string, limit int, tag string) ([]links.Link, error) {
+	defer observe("list", time.Now())
+	return m.store.List(ctx, domain, owner, cursor, limit, tag)
+}
+
+func (m *metricStore) Top(ctx context.Context, limit int) ([]links.Link, error) {
+	defer observe("top", time.Now())
+	return m.store.Top(ctx, limit)
+}
+
+func (m *metricStore) Analytics(ctx context.Context, domain, id string, from, to time.Time, by string, bots bool) ([]links.Count, error) {
+	defer observe("analytics", time.Now())
+	return m.store.Analytics(ctx, domain, id, from, to, by, bots)
+}
+
+func (m *metricStore) Export(ctx context.Context, domain, owner, tag string, from, to time.Time, each func(links.Link, time.Time) error) error {
+	defer observe("export", time.Now())
+	return m.store.Export(ctx, domain, owner, tag, from, to, each)
+}
+
+func (m *metricStore) Ping(ctx context.Context) error {
+	return m.store.Ping(ctx)
+}
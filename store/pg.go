@@ -2,73 +2,483 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 	"wormholes/internal/links"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// grouping expressions of analytics dimensions, counts by day are keyed by
+// UTC date.
+var dimensions = map[string]string{
+	ByCountry:  "country",
+	ByCity:     "city",
+	ByDay:      "to_char(created_at at time zone 'UTC', 'YYYY-MM-DD')",
+	ByBrowser:  "browser",
+	ByOS:       "os",
+	ByDevice:   "device",
+	ByReferrer: "referrer",
+	ByVariant:  "variant::text",
+}
+
+// postgres error code of inserts and updates on a taken primary key
+const uniqueViolation = "23505"
+
+// rows created before tags only have a tag
+const tagsColumn = "case when cardinality(tags) = 0 and coalesce(tag, '') <> '' then array[tag] else tags end"
+
 // SQL Queries
 const (
-	Get    = "select id, target, tag from links where id = $1"
-	Update = "update links set target = $1, tag = $2 where id = $3"
-	Delete = "delete from links where id = $1"
+	Get             = "select domain, id, target, tag, clicks, max_clicks, expires_at, coalesce(password_hash, ''), " + tagsColumn + ", coalesce(title, ''), coalesce(image, ''), geo_rules, variants, redirect_code, coalesce(owner, ''), signed from links where domain = $1 and id = $2 and deleted_at is null"
+	Update          = "update links set target = coalesce($3, target), tag = coalesce($4, tag), tags = coalesce($5, tags), redirect_code = coalesce($6, redirect_code) where domain = $1 and id = $2 and deleted_at is null and ($7::text = '' or owner = $7)"
+	Delete          = "delete from links where domain = $1 and id = $2 and ($3::text = '' or owner = $3)"
+	SoftDelete      = "update links set deleted_at = now() where domain = $1 and id = $2 and deleted_at is null and ($3::text = '' or owner = $3)"
+	DeleteBatch     = "delete from links where domain = $1 and id = any($2) and ($3::text = '' or owner = $3) returning id"
+	SoftDeleteBatch = "update links set deleted_at = now() where domain = $1 and id = any($2) and deleted_at is null and ($3::text = '' or owner = $3) returning id"
+	Restore         = "update links set deleted_at = null where domain = $1 and id = $2 and deleted_at is not null and ($3::text = '' or owner = $3)"
+	SetPreview      = "update links set title = $3, image = $4 where domain = $1 and id = $2"
+	Rename          = "update links set id = $3 where domain = $1 and id = $2 and deleted_at is null and ($4::text = '' or owner = $4)"
+	// clicks follow their link to the new id
+	RenameClicks = "update clicks set link_id = $3 where domain = $1 and link_id = $2"
+	// the old id redirects to the short URL of the new one
+	LeaveRedirect = "insert into links (domain, id, target, tag, tags, owner, signed) select domain, $2, $4, tag, tags, owner, signed from links where domain = $1 and id = $3"
+	Stats         = "select id, clicks, created_at from links where domain = $1 and id = $2 and deleted_at is null and ($3::text = '' or owner = $3)"
+	List          = "select domain, id, target, tag, clicks, max_clicks, expires_at, password_hash is not null, " + tagsColumn + ", coalesce(title, ''), coalesce(image, ''), geo_rules, variants, redirect_code, coalesce(owner, ''), signed from links where domain = $1 and id > $2 and ($3::text = '' or tags @> array[$3::text] or tag = $3) and deleted_at is null and ($5::text = '' or owner = $5) order by id limit $4"
+	// links that can still be visited, of all domains
+	Top = "select domain, id, target, tag, clicks, max_clicks, expires_at, coalesce(password_hash, ''), " + tagsColumn + ", coalesce(title, ''), coalesce(image, ''), geo_rules, variants, redirect_code, coalesce(owner, ''), signed from links where deleted_at is null and (expires_at is null or expires_at > now()) and (max_clicks = 0 or clicks < max_clicks) order by clicks desc limit $1"
+	// a link already stored with the ID is left as it is
+	Create    = "insert into links (id, tag, target, max_clicks, expires_at, password_hash, tags, domain, geo_rules, variants, redirect_code, owner, signed) values ($1, $2, $3, $4, $5, nullif($6, ''), $7, $8, $9, $10, $11, nullif($12, ''), $13) on conflict (domain, id) do nothing;"
+	AddClicks = "update links set clicks = clicks + $1 where domain = $2 and id = $3;"
+	Export    = "select id, target, coalesce(tag, ''), created_at, clicks from links where domain = $1 and ($2::text = '' or tags @> array[$2::text] or tag = $2) and created_at >= $3 and created_at < $4 and deleted_at is null and ($5::text = '' or owner = $5) order by id"
 )
 
 // postgres implementation of link db store.
 type PgStore struct {
 	db *pgxpool.Pool
+	// queries other than creates and exports are cancelled after this, 0 for
+	// no limit.
+	timeout time.Duration
 }
 
-func WithPg(pool *pgxpool.Pool) *PgStore {
+func WithPg(pool *pgxpool.Pool, timeout time.Duration) *PgStore {
 	return &PgStore{
-		db: pool,
+		db:      pool,
+		timeout: timeout,
+	}
+}
+
+func (p *PgStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+
+	return context.WithTimeout(ctx, p.timeout)
 }
 
-func (p *PgStore) Get(id string) (links.Link, error) {
+func (p *PgStore) Get(ctx context.Context, domain, id string) (links.Link, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
 	var link links.Link
 
-	err := p.db.QueryRow(context.Background(),
+	err := p.db.QueryRow(ctx,
 		Get,
-		id,
-	).Scan(&link.ID, &link.Target, &link.Tag)
+		domain, id,
+	).Scan(&link.Domain, &link.ID, &link.Target, &link.Tag, &link.Clicks, &link.MaxClicks, &link.ExpiresAt, &link.PasswordHash, &link.Tags, &link.Title, &link.Image, &link.GeoRules, &link.Variants, &link.RedirectCode, &link.Owner, &link.Signed)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return links.Link{}, err
 		}
 		return links.Link{}, fmt.Errorf("failed to retrieve link: %w", err)
 	}
+	link.Protected = link.PasswordHash != ""
 
 	return link, nil
 }
 
-func (p *PgStore) Update(link *links.Link) error {
-	_, err := p.db.Exec(context.Background(),
+// Insert links in a single batch, all of them or none, returning those that
+// weren't inserted as their ID is taken. Batches are written in the
+// background and are not cancelled after the query timeout, only with ctx.
+func (p *PgStore) Create(ctx context.Context, batch []*links.Link) (map[*links.Link]bool, error) {
+	queued := &pgx.Batch{}
+	for _, link := range batch {
+		// null rather than a JSON null without rules or variants
+		var geoRules, variants any
+		if len(link.GeoRules) > 0 {
+			geoRules = link.GeoRules
+		}
+		if len(link.Variants) > 0 {
+			variants = link.Variants
+		}
+		queued.Queue(
+			Create,
+			link.ID, link.Tag, link.Target, link.MaxClicks, link.ExpiresAt, link.PasswordHash, link.Tags, link.Domain, geoRules, variants, link.RedirectCode, link.Owner, link.Signed)
+	}
+
+	results := p.db.SendBatch(ctx, queued)
+	var conflicts map[*links.Link]bool
+	for _, link := range batch {
+		tag, err := results.Exec()
+		if err != nil {
+			results.Close()
+
+			return nil, err
+		}
+		if tag.RowsAffected() == 0 {
+			if conflicts == nil {
+				conflicts = make(map[*links.Link]bool)
+			}
+			conflicts[link] = true
+		}
+	}
+
+	return conflicts, results.Close()
+}
+
+// Add clicks, counted by link key, to their links in a single batch.
+func (p *PgStore) AddClicks(ctx context.Context, clicks map[string]int64) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	batch := &pgx.Batch{}
+	for key, count := range clicks {
+		domain, id := links.SplitKey(key)
+		batch.Queue(AddClicks, count, domain, id)
+	}
+
+	return p.db.SendBatch(ctx, batch).Close()
+}
+
+// Update the fields set in patch, pgx.ErrNoRows if there is no such link.
+func (p *PgStore) Update(ctx context.Context, domain, id, owner string, patch links.Patch) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := p.db.Exec(ctx,
 		Update,
-		link.Target, link.Tag, link.ID,
+		domain, id, patch.Target, patch.Tag, patch.Tags, patch.RedirectCode, owner,
 	)
 	if err != nil {
 		log.Printf("Error updating link : %v", err)
 
 		return fmt.Errorf("failed to update link: %w", err)
 	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
 
 	return nil
 }
 
-func (p *PgStore) Delete(id string) error {
-	_, err := p.db.Exec(context.Background(),
+// Delete a link, pgx.ErrNoRows if there is none.
+func (p *PgStore) Delete(ctx context.Context, domain, id, owner string) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := p.db.Exec(ctx,
 		Delete,
-		id,
+		domain, id, owner,
 	)
 	if err != nil {
 		log.Printf("Error deleting link %v", err)
 
 		return fmt.Errorf("failed to delete link: %w", err)
 	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return nil
+}
+
+// Store the title and image of the target page of a link.
+func (p *PgStore) SetPreview(ctx context.Context, domain, id, title, image string) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	_, err := p.db.Exec(ctx,
+		SetPreview,
+		domain, id, title, image,
+	)
+	if err != nil {
+		log.Printf("Error storing link preview %v", err)
+
+		return fmt.Errorf("failed to store link preview: %w", err)
+	}
 
 	return nil
 }
+
+// Mark link as deleted, keeping it to be restored. pgx.ErrNoRows if there is
+// no such link.
+func (p *PgStore) SoftDelete(ctx context.Context, domain, id, owner string) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := p.db.Exec(ctx,
+		SoftDelete,
+		domain, id, owner,
+	)
+	if err != nil {
+		log.Printf("Error deleting link %v", err)
+
+		return fmt.Errorf("failed to delete link: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return nil
+}
+
+// Delete links of domain with ids in one query, returning the ids of those
+// that were deleted.
+func (p *PgStore) DeleteBatch(ctx context.Context, domain string, ids []string, owner string) ([]string, error) {
+	return p.deleteBatch(ctx, DeleteBatch, domain, ids, owner)
+}
+
+// Mark links of domain with ids as deleted in one query, returning the ids
+// of those that were.
+func (p *PgStore) SoftDeleteBatch(ctx context.Context, domain string, ids []string, owner string) ([]string, error) {
+	return p.deleteBatch(ctx, SoftDeleteBatch, domain, ids, owner)
+}
+
+func (p *PgStore) deleteBatch(ctx context.Context, query, domain string, ids []string, owner string) ([]string, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := p.db.Query(ctx, query, domain, ids, owner)
+	if err == nil {
+		var deleted []string
+		deleted, err = pgx.CollectRows(rows, pgx.RowTo[string])
+		if err == nil {
+			return deleted, nil
+		}
+	}
+	log.Printf("Error deleting links %v", err)
+
+	return nil, fmt.Errorf("failed to delete links: %w", err)
+}
+
+// Restore a soft deleted link, pgx.ErrNoRows if there is none.
+func (p *PgStore) Restore(ctx context.Context, domain, id, owner string) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := p.db.Exec(ctx,
+		Restore,
+		domain, id, owner,
+	)
+	if err != nil {
+		log.Printf("Error restoring link %v", err)
+
+		return fmt.Errorf("failed to restore link: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return nil
+}
+
+// Change the id of a link to newID, leaving a link from id to redirect unless
+// it is empty. All of it happens in one transaction, so the link is reachable
+// at either id at any time. pgx.ErrNoRows if there is no such link, and
+// ErrIDTaken if newID belongs to another link, even a deleted one.
+func (p *PgStore) Rename(ctx context.Context, domain, id, newID, owner, redirect string) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	err := pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, Rename, domain, id, newID, owner)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+
+		if _, err := tx.Exec(ctx, RenameClicks, domain, id, newID); err != nil {
+			return err
+		}
+		if redirect != "" {
+			if _, err := tx.Exec(ctx, LeaveRedirect, domain, id, newID, redirect); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err == pgx.ErrNoRows {
+		return err
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return ErrIDTaken
+	}
+	if err != nil {
+		log.Printf("Error renaming link %v", err)
+
+		return fmt.Errorf("failed to rename link: %w", err)
+	}
+
+	return nil
+}
+
+func (p *PgStore) Stats(ctx context.Context, domain, id, owner string) (links.Stats, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var stats links.Stats
+
+	err := p.db.QueryRow(ctx,
+		Stats,
+		domain, id, owner,
+	).Scan(&stats.ID, &stats.Clicks, &stats.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return links.Stats{}, err
+		}
+		return links.Stats{}, fmt.Errorf("failed to retrieve stats: %w", err)
+	}
+
+	return stats, nil
+}
+
+// List up to limit links of domain after cursor ordered by id, optionally
+// with tag.
+func (p *PgStore) List(ctx context.Context, domain, owner, cursor string, limit int, tag string) ([]links.Link, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := p.db.Query(ctx,
+		List,
+		domain, cursor, tag, limit, owner,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %w", err)
+	}
+
+	result, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (links.Link, error) {
+		var link links.Link
+		err := row.Scan(&link.Domain, &link.ID, &link.Target, &link.Tag, &link.Clicks, &link.MaxClicks, &link.ExpiresAt, &link.Protected, &link.Tags, &link.Title, &link.Image, &link.GeoRules, &link.Variants, &link.RedirectCode, &link.Owner, &link.Signed)
+
+		return link, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %w", err)
+	}
+
+	return result, nil
+}
+
+// Top returns up to limit links with the most clicks that haven't expired,
+// of all domains.
+func (p *PgStore) Top(ctx context.Context, limit int) ([]links.Link, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := p.db.Query(ctx, Top, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get top links: %w", err)
+	}
+
+	result, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (links.Link, error) {
+		var link links.Link
+		err := row.Scan(&link.Domain, &link.ID, &link.Target, &link.Tag, &link.Clicks, &link.MaxClicks, &link.ExpiresAt, &link.PasswordHash, &link.Tags, &link.Title, &link.Image, &link.GeoRules, &link.Variants, &link.RedirectCode, &link.Owner, &link.Signed)
+		link.Protected = link.PasswordHash != ""
+
+		return link, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get top links: %w", err)
+	}
+
+	return result, nil
+}
+
+// Count clicks on link id of domain in [from, to) grouped by a dimension,
+// clicks of bots only if bots is set. Days without clicks are included with
+// zero clicks.
+func (p *PgStore) Analytics(ctx context.Context, domain, id string, from, to time.Time, by string, bots bool) ([]links.Count, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	key, ok := dimensions[by]
+	if !ok {
+		return nil, ErrDimension
+	}
+
+	where := " where domain = $1 and link_id = $2 and created_at >= $3 and created_at < $4 and ($5 or not bot)"
+	query := "select coalesce(" + key + ", 'unknown'), count(*) from clicks" + where + " group by 1 order by 2 desc"
+	if by == ByDay {
+		query = "select " + key + ", count(*) from clicks" + where + " group by 1 order by 1"
+	}
+
+	rows, err := p.db.Query(ctx, query, domain, id, from, to, bots)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query analytics: %w", err)
+	}
+
+	counts, err := pgx.CollectRows(rows, pgx.RowToStructByPos[links.Count])
+	if err != nil {
+		return nil, fmt.Errorf("failed to query analytics: %w", err)
+	}
+
+	if by == ByDay {
+		counts = fillDays(counts, from, to)
+	}
+
+	return counts, nil
+}
+
+// Add days without clicks to counts ordered by day.
+func fillDays(counts []links.Count, from, to time.Time) []links.Count {
+	clicks := make(map[string]int64, len(counts))
+	for _, c := range counts {
+		clicks[c.Key] = c.Clicks
+	}
+
+	filled := make([]links.Count, 0, len(counts))
+	day := from.UTC().Truncate(time.Hour * 24)
+	for ; day.Before(to); day = day.AddDate(0, 0, 1) {
+		key := day.Format(time.DateOnly)
+		filled = append(filled, links.Count{Key: key, Clicks: clicks[key]})
+	}
+
+	return filled
+}
+
+// Export calls each with links of domain created in [from, to), optionally
+// with tag, ordered by id. Rows are streamed from the database as each
+// returns, stopping at the first error. It is not cancelled after the query
+// timeout, only with ctx.
+func (p *PgStore) Export(ctx context.Context, domain, owner, tag string, from, to time.Time, each func(links.Link, time.Time) error) error {
+	rows, err := p.db.Query(ctx,
+		Export,
+		domain, tag, from, to, owner,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to export links: %w", err)
+	}
+
+	link := links.Link{Domain: domain}
+	var createdAt time.Time
+	_, err = pgx.ForEachRow(rows, []any{&link.ID, &link.Target, &link.Tag, &createdAt, &link.Clicks}, func() error {
+		return each(link, createdAt)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export links: %w", err)
+	}
+
+	return nil
+}
+
+func (p *PgStore) Ping(ctx context.Context) error {
+	return p.db.Ping(ctx)
+}
@@ -1,9 +1,48 @@
 package store
 
-import "wormholes/internal/links"
+import (
+	"context"
+	"errors"
+	"time"
+	"wormholes/internal/links"
+)
 
+// Dimensions clicks can be grouped by.
+const (
+	ByCountry  = "country"
+	ByCity     = "city"
+	ByDay      = "day"
+	ByBrowser  = "browser"
+	ByOS       = "os"
+	ByDevice   = "device"
+	ByReferrer = "referrer"
+	ByVariant  = "variant"
+)
+
+var (
+	ErrDimension = errors.New("store: unknown analytics dimension")
+	ErrIDTaken   = errors.New("store: id is taken")
+)
+
+// Links are looked up by domain and ID, the default domain is empty. Queries
+// are cancelled with ctx. Methods taking an owner only see links created with
+// its API key, or all links if it is empty.
 type Store interface {
-	Get(id string) (links.Link, error)
-	Update(link *links.Link) error
-	Delete(id string) error
+	Create(ctx context.Context, batch []*links.Link) (map[*links.Link]bool, error)
+	Get(ctx context.Context, domain, id string) (links.Link, error)
+	Update(ctx context.Context, domain, id, owner string, patch links.Patch) error
+	Delete(ctx context.Context, domain, id, owner string) error
+	SoftDelete(ctx context.Context, domain, id, owner string) error
+	DeleteBatch(ctx context.Context, domain string, ids []string, owner string) ([]string, error)
+	SoftDeleteBatch(ctx context.Context, domain string, ids []string, owner string) ([]string, error)
+	Restore(ctx context.Context, domain, id, owner string) error
+	Rename(ctx context.Context, domain, id, newID, owner, redirect string) error
+	SetPreview(ctx context.Context, domain, id, title, image string) error
+	AddClicks(ctx context.Context, clicks map[string]int64) error
+	Stats(ctx context.Context, domain, id, owner string) (links.Stats, error)
+	List(ctx context.Context, domain, owner, cursor string, limit int, tag string) ([]links.Link, error)
+	Top(ctx context.Context, limit int) ([]links.Link, error)
+	Analytics(ctx context.Context, domain, id string, from, to time.Time, by string, bots bool) ([]links.Count, error)
+	Export(ctx context.Context, domain, owner, tag string, from, to time.Time, each func(link links.Link, createdAt time.Time) error) error
+	Ping(ctx context.Context) error
 }
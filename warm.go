@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"time"
+	"wormholes/internal/cache"
+	"wormholes/store"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Cache the n links with the most clicks, so the first redirects after a
+// deploy don't all go to PostgreSQL. Links that expire are cached until
+// they do, like on a cache miss. Warming is skipped if the links can't be
+// read.
+func warmCache(backend store.Store, cache *cache.Cache, n int) {
+	start := time.Now()
+	top, err := backend.Top(context.Background(), n)
+	if err != nil {
+		log.Warn().Err(err).Msg("warm: skipping, failed to get top links")
+
+		return
+	}
+
+	warmed := 0
+	for _, link := range top {
+		key := link.Key()
+		if err := cache.SetLink(link, key); err != nil {
+			log.Warn().Err(err).Msgf("warm: stopping, failed to cache link %s", key)
+
+			break
+		}
+		if link.ExpiresAt != nil {
+			if err := cache.ExpireLink(key, time.Until(*link.ExpiresAt)); err != nil {
+				log.Warn().Err(err).Msgf("warm: failed to set cache ttl of link %s", key)
+			}
+		}
+		warmed++
+	}
+
+	log.Info().Msgf("warm: cached %d of the top %d links in %s", warmed, n, time.Since(start))
+}